@@ -0,0 +1,165 @@
+package audio
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+	"math/cmplx"
+)
+
+// Acoustic fingerprints recognise the same recording after re-encoding, resampling or trimming, where byte hashes
+// fail. The scheme follows Chromaprint's input (11025 Hz mono, 4096-sample frames) with the band-energy bits of
+// Haitsma and Kalker: one 32-bit sub-fingerprint per frame, bit m set when the energy difference between bands m and
+// m+1 grew since the previous frame. Frames start an eighth of a frame apart, so two decodes that begin at different
+// samples are never misaligned by more than 256 samples. Lossy codecs rarely flip the sign of those
+// differences, so two encodings of a recording differ in few bits while unrelated audio differs in about half.
+
+// FingerprintSampleRate is the rate the PCM passed to Fingerprint must have.
+const FingerprintSampleRate = 11025
+
+const (
+	fpFrameSize = 4096
+	fpHop       = fpFrameSize / 8
+	fpBands     = 33
+	fpMinFreq   = 300.0
+	fpMaxFreq   = 2000.0
+
+	// Alignment search of Similarity: up to 10 s of offset, at least 5 s of overlap
+	fpMaxShift   = 10 * FingerprintSampleRate / fpHop
+	fpMinOverlap = 5 * FingerprintSampleRate / fpHop
+)
+
+var (
+	fpWindow = hannWindow(fpFrameSize)
+	fpEdges  = bandEdges()
+)
+
+// Fingerprint computes the sub-fingerprints of mono 16-bit PCM sampled at FingerprintSampleRate. It returns nil
+// for audio too short or too quiet to identify.
+func Fingerprint(samples []int16) []uint32 {
+	if len(samples) < fpFrameSize*2 {
+		return nil
+	}
+	frame := make([]complex128, fpFrameSize)
+	prev := make([]float64, fpBands)
+	energy := make([]float64, fpBands)
+
+	var fingerprint []uint32
+	silent := 0
+	for start := 0; start+fpFrameSize <= len(samples); start += fpHop {
+		for i := range frame {
+			frame[i] = complex(float64(samples[start+i])/32768*fpWindow[i], 0)
+		}
+		fft(frame)
+
+		total := 0.0
+		for b := 0; b < fpBands; b++ {
+			energy[b] = 0
+			for k := fpEdges[b]; k < fpEdges[b+1]; k++ {
+				energy[b] += real(frame[k])*real(frame[k]) + imag(frame[k])*imag(frame[k])
+			}
+			total += energy[b]
+		}
+
+		if start > 0 {
+			var word uint32
+			for m := 0; m < 32; m++ {
+				if (energy[m]-energy[m+1])-(prev[m]-prev[m+1]) > 0 {
+					word |= 1 << m
+				}
+			}
+			fingerprint = append(fingerprint, word)
+			if total < 1e-6 {
+				silent++
+			}
+		}
+		copy(prev, energy)
+	}
+	if len(fingerprint) < fpMinOverlap || silent > len(fingerprint)*9/10 {
+		return nil
+	}
+	return fingerprint
+}
+
+// Similarity compares two fingerprints at the best alignment and returns 1 minus the bit error rate: close to 1
+// for the same recording, around 0.5 for unrelated audio, and 0 when they overlap too little to tell.
+func Similarity(a, b []uint32) float64 {
+	best := 0.0
+	for shift := -fpMaxShift; shift <= fpMaxShift; shift++ {
+		// Frame i of a lines up with frame i+shift of b
+		from := max(0, -shift)
+		to := min(len(a), len(b)-shift)
+		if to-from < fpMinOverlap {
+			continue
+		}
+		differing := 0
+		for i := from; i < to; i++ {
+			differing += bits.OnesCount32(a[i] ^ b[i+shift])
+		}
+		best = max(best, 1-float64(differing)/float64(32*(to-from)))
+	}
+	return best
+}
+
+// EncodeFingerprint packs a fingerprint as little-endian 32-bit words for storage.
+func EncodeFingerprint(fingerprint []uint32) []byte {
+	data := make([]byte, 4*len(fingerprint))
+	for i, word := range fingerprint {
+		binary.LittleEndian.PutUint32(data[4*i:], word)
+	}
+	return data
+}
+
+// DecodeFingerprint reverses EncodeFingerprint.
+func DecodeFingerprint(data []byte) []uint32 {
+	fingerprint := make([]uint32, len(data)/4)
+	for i := range fingerprint {
+		fingerprint[i] = binary.LittleEndian.Uint32(data[4*i:])
+	}
+	return fingerprint
+}
+
+func hannWindow(n int) []float64 {
+	w := make([]float64, n)
+	for i := range w {
+		w[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(n-1))
+	}
+	return w
+}
+
+// bandEdges splits fpMinFreq..fpMaxFreq into fpBands logarithmic bands, as FFT bin indexes.
+func bandEdges() []int {
+	edges := make([]int, fpBands+1)
+	binWidth := float64(FingerprintSampleRate) / fpFrameSize
+	for b := range edges {
+		freq := fpMinFreq * math.Pow(fpMaxFreq/fpMinFreq, float64(b)/float64(fpBands))
+		edges[b] = int(freq / binWidth)
+	}
+	return edges
+}
+
+// fft is an in-place iterative radix-2 FFT; len(x) must be a power of two.
+func fft(x []complex128) {
+	n := len(x)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j |= bit
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+	for size := 2; size <= n; size <<= 1 {
+		step := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				u, v := x[start+k], w*x[start+k+size/2]
+				x[start+k], x[start+k+size/2] = u+v, u-v
+				w *= step
+			}
+		}
+	}
+}
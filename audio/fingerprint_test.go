@@ -0,0 +1,100 @@
+package audio
+
+import (
+	"math"
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+// melody synthesizes seconds of a deterministic "recording": a new pair of tones every quarter second with a
+// decaying envelope, so the band energies change from frame to frame the way music does.
+func melody(seed int64, seconds float64) []int16 {
+	rng := rand.New(rand.NewSource(seed))
+	samples := make([]int16, int(seconds*FingerprintSampleRate))
+	note := FingerprintSampleRate / 4
+	var f1, f2 float64
+	for i := range samples {
+		if i%note == 0 {
+			f1, f2 = 300+rng.Float64()*1700, 300+rng.Float64()*1700
+		}
+		t := float64(i) / FingerprintSampleRate
+		env := math.Exp(-3 * float64(i%note) / float64(note))
+		v := env * (0.5*math.Sin(2*math.Pi*f1*t) + 0.3*math.Sin(2*math.Pi*f2*t))
+		samples[i] = int16(v * 20000)
+	}
+	return samples
+}
+
+func TestFingerprintSimilarity(t *testing.T) {
+	original := Fingerprint(melody(1, 12))
+	if original == nil {
+		t.Fatal("Fingerprint returned nil for 12 s of audio")
+	}
+
+	quieter := melody(1, 12)
+	for i := range quieter {
+		quieter[i] /= 4
+	}
+	noisy := melody(1, 12)
+	rng := rand.New(rand.NewSource(7))
+	for i := range noisy {
+		noisy[i] += int16(rng.NormFloat64() * 200)
+	}
+
+	// The default duplicate threshold is 0.7: the same recording must stay well above it, other audio below
+	tests := []struct {
+		name     string
+		samples  []int16
+		min, max float64
+	}{
+		{"identical", melody(1, 12), 1, 1},
+		{"quieter", quieter, 0.95, 1},
+		{"noisy", noisy, 0.8, 1},
+		{"trimmed by whole frames", melody(1, 12)[3*fpHop:], 1, 1},
+		{"trimmed between frames", melody(1, 12)[200:], 0.8, 1},
+		{"first two seconds cut", melody(1, 12)[2*FingerprintSampleRate+123:], 0.8, 1},
+		{"other recording", melody(2, 12), 0, 0.7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fingerprint := Fingerprint(tt.samples)
+			if fingerprint == nil {
+				t.Fatal("Fingerprint returned nil")
+			}
+			if s := Similarity(original, fingerprint); s < tt.min || s > tt.max {
+				t.Errorf("Similarity = %.3f, want %.2f to %.2f", s, tt.min, tt.max)
+			}
+			if a, b := Similarity(original, fingerprint), Similarity(fingerprint, original); a != b {
+				t.Errorf("Similarity is not symmetric: %.3f and %.3f", a, b)
+			}
+		})
+	}
+}
+
+func TestFingerprintRejectsUnusableAudio(t *testing.T) {
+	if fp := Fingerprint(melody(1, 0.5)); fp != nil {
+		t.Errorf("Fingerprint of 0.5 s = %d words, want nil", len(fp))
+	}
+	if fp := Fingerprint(make([]int16, 12*FingerprintSampleRate)); fp != nil {
+		t.Errorf("Fingerprint of silence = %d words, want nil", len(fp))
+	}
+}
+
+func TestSimilarityNeedsOverlap(t *testing.T) {
+	long := Fingerprint(melody(1, 12))
+	if s := Similarity(long, long[:fpMinOverlap-1]); s != 0 {
+		t.Errorf("Similarity with too little overlap = %.3f, want 0", s)
+	}
+}
+
+func TestEncodeFingerprint(t *testing.T) {
+	fingerprint := []uint32{0, 1, 0xDEADBEEF, math.MaxUint32}
+	data := EncodeFingerprint(fingerprint)
+	if len(data) != 16 || data[8] != 0xEF || data[11] != 0xDE {
+		t.Errorf("EncodeFingerprint = %x, want little-endian words", data)
+	}
+	if got := DecodeFingerprint(data); !slices.Equal(got, fingerprint) {
+		t.Errorf("DecodeFingerprint = %x, want %x", got, fingerprint)
+	}
+}
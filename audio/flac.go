@@ -0,0 +1,112 @@
+package audio
+
+import (
+	"io"
+	"strings"
+)
+
+// FLAC metadata block types.
+const (
+	flacStreamInfo    = 0
+	flacVorbisComment = 4
+	flacPicture       = 6
+)
+
+// probeFLAC reads STREAMINFO for the exact sample count and VORBIS_COMMENT for tags.
+func probeFLAC(r io.ReaderAt, size int64, m *Metadata) error {
+	m.Format = "flac"
+	off := int64(4)
+	for {
+		header, err := readAt(r, off, 4, size)
+		if err != nil || len(header) < 4 {
+			return ErrUnknownFormat
+		}
+		last := header[0]&0x80 != 0
+		blockType := header[0] & 0x7F
+		length := int(header[1])<<16 | int(header[2])<<8 | int(header[3])
+		off += 4
+
+		switch blockType {
+		case flacStreamInfo:
+			info, err := readAt(r, off, length, size)
+			if err != nil || len(info) < 18 {
+				return ErrUnknownFormat
+			}
+			m.SampleRate = int(info[10])<<12 | int(info[11])<<4 | int(info[12]>>4)
+			m.Channels = int((info[12]>>1)&7) + 1
+			totalSamples := int64(info[13]&0x0F)<<32 | int64(be.Uint32(info[14:18]))
+			if m.SampleRate > 0 {
+				m.Duration = secondsToDuration(float64(totalSamples) / float64(m.SampleRate))
+			}
+		case flacVorbisComment:
+			data, err := readAt(r, off, length, size)
+			if err == nil {
+				parseVorbisComments(data, m)
+			}
+		case flacPicture:
+			if length <= maxPictureSize {
+				if data, err := readAt(r, off, length, size); err == nil {
+					readFLACPicture(data, m)
+				}
+			}
+		}
+
+		off += int64(length)
+		if last {
+			break
+		}
+	}
+	m.setAverageBitrate(size - off)
+	return nil
+}
+
+// parseVorbisComments applies a Vorbis comment block (as used by FLAC, Ogg Vorbis and Opus) to m.
+// The framing is little-endian: vendor string, comment count, then length-prefixed KEY=value pairs.
+func parseVorbisComments(data []byte, m *Metadata) {
+	if len(data) < 8 {
+		return
+	}
+	pos := 4 + int(le.Uint32(data))
+	if pos+4 > len(data) {
+		return
+	}
+	count := int(le.Uint32(data[pos:]))
+	pos += 4
+
+	for i := 0; i < count && pos+4 <= len(data); i++ {
+		n := int(le.Uint32(data[pos:]))
+		pos += 4
+		if n < 0 || pos+n > len(data) {
+			return
+		}
+		key, value, ok := strings.Cut(string(data[pos:pos+n]), "=")
+		pos += n
+		if !ok {
+			continue
+		}
+		switch strings.ToUpper(key) {
+		case "TITLE":
+			setIfEmpty(&m.Title, value)
+		case "ARTIST":
+			setIfEmpty(&m.Artist, value)
+		case "ALBUM":
+			setIfEmpty(&m.Album, value)
+		case "ALBUMARTIST", "ALBUM ARTIST":
+			setIfEmpty(&m.AlbumArtist, value)
+		case "GENRE":
+			setIfEmpty(&m.Genre, value)
+		case "DATE", "YEAR":
+			setIfEmpty(&m.Year, parseYear(value))
+		case "TRACKNUMBER":
+			if m.TrackNumber == 0 {
+				m.TrackNumber = parseIndex(value)
+			}
+		case "DISCNUMBER":
+			if m.DiscNumber == 0 {
+				m.DiscNumber = parseIndex(value)
+			}
+		case "METADATA_BLOCK_PICTURE":
+			readVorbisPicture(value, m)
+		}
+	}
+}
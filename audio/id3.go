@@ -0,0 +1,266 @@
+package audio
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// ID3v2.2 uses three-character frame IDs; map the ones we read onto their v2.3/v2.4 names.
+var id3v22Frames = map[string]string{
+	"TT2": "TIT2", "TP1": "TPE1", "TP2": "TPE2", "TAL": "TALB", "TCO": "TCON",
+	"TYE": "TYER", "TRK": "TRCK", "TPA": "TPOS", "TLE": "TLEN", "PIC": "APIC",
+}
+
+// id3Tag holds the frames of an ID3v2 tag that Probe cares about.
+type id3Tag struct {
+	version byte
+	frames  map[string][]byte // frame ID -> raw frame body (first occurrence)
+}
+
+// readID3v2 parses an ID3v2 tag at the start of the file, if any, and returns it with the offset of the audio data.
+func readID3v2(r io.ReaderAt, size int64) (*id3Tag, int64, error) {
+	header, err := readAt(r, 0, 10, size)
+	if err != nil || len(header) < 10 || string(header[:3]) != "ID3" {
+		return nil, 0, nil
+	}
+	version, flags := header[3], header[5]
+	tagSize := int64(syncsafe(header[6:10]))
+	end := 10 + tagSize
+	if flags&0x10 != 0 {
+		end += 10 // footer
+	}
+
+	body, err := readAt(r, 10, int(tagSize), size)
+	if err != nil {
+		return nil, 0, err
+	}
+	if flags&0x80 != 0 && version < 4 {
+		body = removeUnsync(body)
+	}
+	if flags&0x40 != 0 && len(body) >= 4 {
+		// Skip the extended header: v2.3 size excludes its own 4 bytes, v2.4 size is syncsafe and includes them
+		if version >= 4 {
+			body = body[min(int(syncsafe(body[:4])), len(body)):]
+		} else {
+			body = body[min(int(be.Uint32(body[:4]))+4, len(body)):]
+		}
+	}
+
+	tag := &id3Tag{version: version, frames: map[string][]byte{}}
+	idLen, headerLen := 4, 10
+	if version == 2 {
+		idLen, headerLen = 3, 6
+	}
+	for pos := 0; pos+headerLen <= len(body); {
+		id := string(body[pos : pos+idLen])
+		if id[0] == 0 {
+			break // padding
+		}
+		var frameSize int
+		var frameFlags []byte
+		switch version {
+		case 2:
+			frameSize = int(body[pos+3])<<16 | int(body[pos+4])<<8 | int(body[pos+5])
+		case 3:
+			frameSize = int(be.Uint32(body[pos+4 : pos+8]))
+			frameFlags = body[pos+8 : pos+10]
+		default:
+			frameSize = int(syncsafe(body[pos+4 : pos+8]))
+			frameFlags = body[pos+8 : pos+10]
+		}
+		start := pos + headerLen
+		if frameSize <= 0 || start+frameSize > len(body) {
+			break
+		}
+		data := body[start : start+frameSize]
+		pos = start + frameSize
+
+		if version == 2 {
+			mapped, ok := id3v22Frames[id]
+			if !ok {
+				continue
+			}
+			id = mapped
+		}
+		if frameFlags != nil {
+			if version == 3 && frameFlags[1]&0xC0 != 0 {
+				continue // compressed or encrypted
+			}
+			if version >= 4 {
+				if frameFlags[1]&0x0C != 0 {
+					continue // compressed or encrypted
+				}
+				if frameFlags[1]&0x01 != 0 && len(data) >= 4 {
+					data = data[4:] // data length indicator
+				}
+				if frameFlags[1]&0x02 != 0 {
+					data = removeUnsync(data)
+				}
+			}
+		}
+		if _, seen := tag.frames[id]; !seen {
+			tag.frames[id] = data
+		}
+	}
+	return tag, end, nil
+}
+
+// text returns the first value of a text frame.
+func (t *id3Tag) text(id string) string {
+	data, ok := t.frames[id]
+	if !ok || len(data) < 2 {
+		return ""
+	}
+	text := decodeID3Text(data[0], data[1:])
+	// v2.4 separates multiple values with NUL
+	if i := strings.IndexByte(text, 0); i >= 0 {
+		text = text[:i]
+	}
+	return strings.TrimSpace(text)
+}
+
+// apply copies the tag into m without overwriting fields that are already set.
+func (t *id3Tag) apply(m *Metadata) {
+	setIfEmpty(&m.Title, t.text("TIT2"))
+	setIfEmpty(&m.Artist, t.text("TPE1"))
+	setIfEmpty(&m.AlbumArtist, t.text("TPE2"))
+	setIfEmpty(&m.Album, t.text("TALB"))
+	setIfEmpty(&m.Genre, id3Genre(t.text("TCON")))
+	year := parseYear(t.text("TDRC"))
+	if year == "" {
+		year = parseYear(t.text("TYER"))
+	}
+	setIfEmpty(&m.Year, year)
+	if m.TrackNumber == 0 {
+		m.TrackNumber = parseIndex(t.text("TRCK"))
+	}
+	if m.DiscNumber == 0 {
+		m.DiscNumber = parseIndex(t.text("TPOS"))
+	}
+	if apic, ok := t.frames["APIC"]; ok {
+		readAPIC(apic, t.version, m)
+	}
+}
+
+// lengthHint returns the TLEN frame (milliseconds), which some encoders write and others get wrong.
+func (t *id3Tag) lengthHint() int64 {
+	ms, _ := strconv.ParseInt(t.text("TLEN"), 10, 64)
+	return ms
+}
+
+// readID3v1 applies a trailing ID3v1 tag to m and returns its size (0 or 128).
+func readID3v1(r io.ReaderAt, size int64, m *Metadata) int64 {
+	if size < 128 {
+		return 0
+	}
+	tag, err := readAt(r, size-128, 128, size)
+	if err != nil || string(tag[:3]) != "TAG" {
+		return 0
+	}
+	setIfEmpty(&m.Title, latin1(tag[3:33]))
+	setIfEmpty(&m.Artist, latin1(tag[33:63]))
+	setIfEmpty(&m.Album, latin1(tag[63:93]))
+	setIfEmpty(&m.Year, parseYear(latin1(tag[93:97])))
+	// ID3v1.1 keeps the track number in the last comment byte
+	if m.TrackNumber == 0 && tag[125] == 0 && tag[126] != 0 {
+		m.TrackNumber = int(tag[126])
+	}
+	if int(tag[127]) < len(id3v1Genres) {
+		setIfEmpty(&m.Genre, id3v1Genres[tag[127]])
+	}
+	return 128
+}
+
+// id3Genre resolves numeric references such as "(17)", "(17)Rock" or "17" to genre names.
+func id3Genre(value string) string {
+	if strings.HasPrefix(value, "(") {
+		end := strings.IndexByte(value, ')')
+		if end > 0 {
+			if rest := value[end+1:]; rest != "" {
+				return rest
+			}
+			value = value[1:end]
+		}
+	}
+	if n, err := strconv.Atoi(value); err == nil {
+		if n >= 0 && n < len(id3v1Genres) {
+			return id3v1Genres[n]
+		}
+		return ""
+	}
+	return value
+}
+
+func decodeID3Text(encoding byte, data []byte) string {
+	switch encoding {
+	case 1, 2: // UTF-16 with BOM, UTF-16BE
+		bigEndian := encoding == 2
+		if len(data) >= 2 {
+			if data[0] == 0xFF && data[1] == 0xFE {
+				bigEndian, data = false, data[2:]
+			} else if data[0] == 0xFE && data[1] == 0xFF {
+				bigEndian, data = true, data[2:]
+			}
+		}
+		units := make([]uint16, 0, len(data)/2)
+		for i := 0; i+1 < len(data); i += 2 {
+			if bigEndian {
+				units = append(units, be.Uint16(data[i:]))
+			} else {
+				units = append(units, le.Uint16(data[i:]))
+			}
+		}
+		return string(utf16.Decode(units))
+	case 3: // UTF-8
+		return string(data)
+	default: // ISO-8859-1
+		return latin1(data)
+	}
+}
+
+func latin1(data []byte) string {
+	data = bytes.TrimRight(data, "\x00 ")
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
+
+func syncsafe(b []byte) uint32 {
+	return uint32(b[0]&0x7F)<<21 | uint32(b[1]&0x7F)<<14 | uint32(b[2]&0x7F)<<7 | uint32(b[3]&0x7F)
+}
+
+// removeUnsync undoes ID3 unsynchronisation (0xFF 0x00 -> 0xFF).
+func removeUnsync(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	for i := 0; i < len(data); i++ {
+		out = append(out, data[i])
+		if data[i] == 0xFF && i+1 < len(data) && data[i+1] == 0x00 {
+			i++
+		}
+	}
+	return out
+}
+
+// id3v1Genres is the genre list of the ID3v1 specification (0-79) plus the Winamp extensions (80-147).
+var id3v1Genres = []string{
+	"Blues", "Classic Rock", "Country", "Dance", "Disco", "Funk", "Grunge", "Hip-Hop", "Jazz", "Metal",
+	"New Age", "Oldies", "Other", "Pop", "R&B", "Rap", "Reggae", "Rock", "Techno", "Industrial",
+	"Alternative", "Ska", "Death Metal", "Pranks", "Soundtrack", "Euro-Techno", "Ambient", "Trip-Hop", "Vocal", "Jazz+Funk",
+	"Fusion", "Trance", "Classical", "Instrumental", "Acid", "House", "Game", "Sound Clip", "Gospel", "Noise",
+	"AlternRock", "Bass", "Soul", "Punk", "Space", "Meditative", "Instrumental Pop", "Instrumental Rock", "Ethnic", "Gothic",
+	"Darkwave", "Techno-Industrial", "Electronic", "Pop-Folk", "Eurodance", "Dream", "Southern Rock", "Comedy", "Cult", "Gangsta",
+	"Top 40", "Christian Rap", "Pop/Funk", "Jungle", "Native American", "Cabaret", "New Wave", "Psychadelic", "Rave", "Showtunes",
+	"Trailer", "Lo-Fi", "Tribal", "Acid Punk", "Acid Jazz", "Polka", "Retro", "Musical", "Rock & Roll", "Hard Rock",
+	"Folk", "Folk-Rock", "National Folk", "Swing", "Fast Fusion", "Bebob", "Latin", "Revival", "Celtic", "Bluegrass",
+	"Avantgarde", "Gothic Rock", "Progressive Rock", "Psychedelic Rock", "Symphonic Rock", "Slow Rock", "Big Band", "Chorus", "Easy Listening", "Acoustic",
+	"Humour", "Speech", "Chanson", "Opera", "Chamber Music", "Sonata", "Symphony", "Booty Bass", "Primus", "Porn Groove",
+	"Satire", "Slow Jam", "Club", "Tango", "Samba", "Folklore", "Ballad", "Power Ballad", "Rhythmic Soul", "Freestyle",
+	"Duet", "Punk Rock", "Drum Solo", "A capella", "Euro-House", "Dance Hall", "Goa", "Drum & Bass", "Club-House", "Hardcore",
+	"Terror", "Indie", "BritPop", "" /* 133: withheld */, "Polsk Punk", "Beat", "Christian Gangsta Rap", "Heavy Metal", "Black Metal", "Crossover",
+	"Contemporary Christian", "Christian Rock", "Merengue", "Salsa", "Thrash Metal", "Anime", "JPop", "Synthpop",
+}
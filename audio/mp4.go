@@ -0,0 +1,191 @@
+package audio
+
+import (
+	"io"
+	"strconv"
+)
+
+// Container atoms probeMP4 descends into; everything else is skipped by size.
+var mp4Containers = map[string]bool{
+	"moov": true, "trak": true, "mdia": true, "minf": true, "stbl": true, "udta": true, "meta": true, "ilst": true,
+}
+
+type mp4Probe struct {
+	r    io.ReaderAt
+	size int64
+	m    *Metadata
+
+	movieDuration, movieTimescale int64
+	soundTrack                    bool  // the trak being walked has a "soun" handler
+	mediaTimescale                int64 // of the sound track
+	mdatBytes                     int64
+}
+
+// probeMP4 reads the movie header for the duration, the sound track's sample description and the iTunes ilst tags.
+func probeMP4(r io.ReaderAt, size int64, m *Metadata) error {
+	m.Format = "m4a"
+	p := &mp4Probe{r: r, size: size, m: m}
+	if err := p.walk(0, size, ""); err != nil {
+		return err
+	}
+	if p.movieTimescale > 0 {
+		m.Duration = secondsToDuration(float64(p.movieDuration) / float64(p.movieTimescale))
+	}
+	if p.mdatBytes > 0 {
+		m.setAverageBitrate(p.mdatBytes)
+	} else {
+		m.setAverageBitrate(size)
+	}
+	return nil
+}
+
+func (p *mp4Probe) walk(start, end int64, parent string) error {
+	for off := start; off+8 <= end; {
+		header, err := readAt(p.r, off, 16, p.size)
+		if err != nil || len(header) < 8 {
+			return nil
+		}
+		atomSize := int64(be.Uint32(header[:4]))
+		typ := string(header[4:8])
+		headerLen := int64(8)
+		switch atomSize {
+		case 0:
+			atomSize = end - off
+		case 1:
+			if len(header) < 16 {
+				return nil
+			}
+			atomSize, headerLen = int64(be.Uint64(header[8:16])), 16
+		}
+		if atomSize < headerLen || off+atomSize > end {
+			return nil
+		}
+		body, bodyEnd := off+headerLen, off+atomSize
+
+		switch {
+		case typ == "mdat":
+			p.mdatBytes += atomSize - headerLen
+		case typ == "trak":
+			p.soundTrack, p.mediaTimescale = false, 0
+			if err := p.walk(body, bodyEnd, typ); err != nil {
+				return err
+			}
+		case typ == "meta":
+			// meta is a full atom: 4 bytes of version and flags precede the children
+			if err := p.walk(body+4, bodyEnd, typ); err != nil {
+				return err
+			}
+		case mp4Containers[typ]:
+			if err := p.walk(body, bodyEnd, typ); err != nil {
+				return err
+			}
+		case parent == "ilst":
+			p.readTag(typ, body, bodyEnd)
+		default:
+			p.readLeaf(typ, body, bodyEnd)
+		}
+		off = bodyEnd
+	}
+	return nil
+}
+
+func (p *mp4Probe) readLeaf(typ string, start, end int64) {
+	switch typ {
+	case "mvhd", "mdhd":
+		data, err := readAt(p.r, start, 32, p.size)
+		if err != nil || len(data) < 24 {
+			return
+		}
+		var timescale, duration int64
+		if data[0] == 1 {
+			if len(data) < 32 {
+				return
+			}
+			timescale, duration = int64(be.Uint32(data[20:24])), int64(be.Uint64(data[24:32]))
+		} else {
+			timescale, duration = int64(be.Uint32(data[12:16])), int64(be.Uint32(data[16:20]))
+		}
+		if typ == "mvhd" {
+			p.movieTimescale, p.movieDuration = timescale, duration
+		} else {
+			p.mediaTimescale = timescale
+		}
+	case "hdlr":
+		data, err := readAt(p.r, start, 12, p.size)
+		if err == nil && len(data) >= 12 && string(data[8:12]) == "soun" {
+			p.soundTrack = true
+			if p.m.SampleRate == 0 && p.mediaTimescale > 0 {
+				p.m.SampleRate = int(p.mediaTimescale)
+			}
+		}
+	case "stsd":
+		if !p.soundTrack || p.m.Channels != 0 {
+			return
+		}
+		// stsd header (8) + sample entry header (8) + reserved/data ref (8) + version/revision/vendor (8)
+		data, err := readAt(p.r, start, 44, p.size)
+		if err != nil || len(data) < 44 {
+			return
+		}
+		p.m.Channels = int(be.Uint16(data[32:34]))
+		if rate := int(be.Uint32(data[40:44]) >> 16); rate > 0 {
+			p.m.SampleRate = rate
+		}
+	}
+}
+
+// readTag reads one iTunes-style ilst item, whose value sits in a child "data" atom after 8 bytes of type and locale.
+func (p *mp4Probe) readTag(typ string, start, end int64) {
+	n := end - start
+	if n < 16 || n > 1<<20 && (typ != "covr" || n > maxPictureSize) {
+		return
+	}
+	item, err := readAt(p.r, start, int(n), p.size)
+	if err != nil || string(item[4:8]) != "data" {
+		return
+	}
+	dataEnd := min(int(be.Uint32(item[:4])), len(item))
+	if dataEnd < 16 {
+		return
+	}
+	value := item[16:dataEnd]
+	text := string(value)
+
+	m := p.m
+	switch typ {
+	case "\xa9nam":
+		setIfEmpty(&m.Title, text)
+	case "\xa9ART":
+		setIfEmpty(&m.Artist, text)
+	case "aART":
+		setIfEmpty(&m.AlbumArtist, text)
+	case "\xa9alb":
+		setIfEmpty(&m.Album, text)
+	case "\xa9gen":
+		setIfEmpty(&m.Genre, text)
+	case "gnre":
+		// ID3v1 genre index plus one
+		if len(value) >= 2 {
+			if idx := int(be.Uint16(value)) - 1; idx >= 0 {
+				setIfEmpty(&m.Genre, id3Genre(strconv.Itoa(idx)))
+			}
+		}
+	case "\xa9day":
+		setIfEmpty(&m.Year, parseYear(text))
+	case "trkn":
+		if m.TrackNumber == 0 && len(value) >= 4 {
+			m.TrackNumber = int(be.Uint16(value[2:4]))
+		}
+	case "covr":
+		// The data atom's type indicator says whether the artwork is JPEG (13) or PNG (14)
+		mimeType := "image/jpeg"
+		if be.Uint32(item[8:12])&0xFFFFFF == 14 {
+			mimeType = "image/png"
+		}
+		m.setPicture(mimeType, frontCover, value)
+	case "disk":
+		if m.DiscNumber == 0 && len(value) >= 4 {
+			m.DiscNumber = int(be.Uint16(value[2:4]))
+		}
+	}
+}
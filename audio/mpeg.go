@@ -0,0 +1,232 @@
+package audio
+
+import (
+	"io"
+	"time"
+)
+
+// Bitrates in kbps indexed by [version is MPEG-1][layer 1..3][bitrate index].
+var mpegBitrates = [2][4][16]int{
+	{ // MPEG-2 / 2.5
+		{},
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+	},
+	{ // MPEG-1
+		{},
+		{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448},
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},
+		{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+	},
+}
+
+// Sample rates indexed by the header's version bits (0 = 2.5, 2 = 2, 3 = 1) and rate index.
+var mpegSampleRates = [4][3]int{
+	{11025, 12000, 8000},
+	{},
+	{22050, 24000, 16000},
+	{44100, 48000, 32000},
+}
+
+var adtsSampleRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+type mpegFrame struct {
+	version    byte // header bits: 0 = MPEG-2.5, 2 = MPEG-2, 3 = MPEG-1
+	layer      int  // 1..3
+	bitrate    int  // bits per second
+	sampleRate int
+	samples    int // per frame
+	length     int // bytes, including the header
+	channels   int
+}
+
+// parseMPEGHeader decodes an MPEG audio frame header; free-format and reserved values are rejected.
+func parseMPEGHeader(b []byte) (mpegFrame, bool) {
+	if len(b) < 4 || b[0] != 0xFF || b[1]&0xE0 != 0xE0 {
+		return mpegFrame{}, false
+	}
+	version := (b[1] >> 3) & 3
+	layer := 4 - int((b[1]>>1)&3)
+	bitrateIdx := b[2] >> 4
+	rateIdx := (b[2] >> 2) & 3
+	if version == 1 || layer == 4 || bitrateIdx == 0 || bitrateIdx == 15 || rateIdx == 3 {
+		return mpegFrame{}, false
+	}
+	padding := int((b[2] >> 1) & 1)
+
+	f := mpegFrame{version: version, layer: layer, channels: 2}
+	v1 := 0
+	if version == 3 {
+		v1 = 1
+	}
+	f.bitrate = mpegBitrates[v1][layer][bitrateIdx] * 1000
+	f.sampleRate = mpegSampleRates[version][rateIdx]
+	if b[3]>>6 == 3 {
+		f.channels = 1
+	}
+
+	switch {
+	case layer == 1:
+		f.samples = 384
+		f.length = (12*f.bitrate/f.sampleRate + padding) * 4
+	case layer == 3 && version != 3:
+		f.samples = 576
+		f.length = 72*f.bitrate/f.sampleRate + padding
+	default:
+		f.samples = 1152
+		f.length = 144*f.bitrate/f.sampleRate + padding
+	}
+	return f, f.length > 4
+}
+
+type adtsFrame struct {
+	sampleRate int
+	channels   int
+	samples    int
+	length     int
+}
+
+func parseADTSHeader(b []byte) (adtsFrame, bool) {
+	if len(b) < 7 || b[0] != 0xFF || b[1]&0xF6 != 0xF0 {
+		return adtsFrame{}, false
+	}
+	rateIdx := int((b[2] >> 2) & 0x0F)
+	if rateIdx >= len(adtsSampleRates) {
+		return adtsFrame{}, false
+	}
+	f := adtsFrame{
+		sampleRate: adtsSampleRates[rateIdx],
+		channels:   int(b[2]&1)<<2 | int(b[3]>>6),
+		samples:    1024 * (int(b[6]&3) + 1),
+		length:     int(b[3]&3)<<11 | int(b[4])<<3 | int(b[5]>>5),
+	}
+	return f, f.length > 7
+}
+
+// frameScanner reads frame headers sequentially through a 64 KB window, so walking
+// every frame of a long file costs one read per window rather than one per frame.
+type frameScanner struct {
+	r         io.ReaderAt
+	size      int64
+	buf       []byte
+	bufOffset int64
+}
+
+func (s *frameScanner) peek(off int64, n int) []byte {
+	if off < s.bufOffset || off+int64(n) > s.bufOffset+int64(len(s.buf)) {
+		buf, err := readAt(s.r, off, 64*1024, s.size)
+		if err != nil {
+			return nil
+		}
+		s.buf, s.bufOffset = buf, off
+	}
+	start := int(off - s.bufOffset)
+	if start+n > len(s.buf) {
+		return nil
+	}
+	return s.buf[start : start+n]
+}
+
+// probeMPEG handles MP3 (and MP1/MP2) and raw ADTS AAC, both optionally wrapped in ID3 tags.
+func probeMPEG(r io.ReaderAt, size int64, m *Metadata) error {
+	tag, audioStart, err := readID3v2(r, size)
+	if err != nil {
+		return err
+	}
+	if tag != nil {
+		tag.apply(m)
+	}
+	audioEnd := size - readID3v1(r, size, m)
+
+	s := &frameScanner{r: r, size: audioEnd}
+	// Look for the first frame whose successor also starts with a valid header, skipping junk before it.
+	const maxJunk = 64 * 1024
+	for off := audioStart; off < audioStart+maxJunk && off+8 < audioEnd; off++ {
+		b := s.peek(off, 8)
+		if b == nil {
+			break
+		}
+		if f, ok := parseADTSHeader(b); ok {
+			if next, ok := parseADTSHeader(s.peek(off+int64(f.length), 8)); ok && next.sampleRate == f.sampleRate {
+				m.Format = "aac"
+				scanADTS(s, off, audioEnd, m)
+				return nil
+			}
+		}
+		if f, ok := parseMPEGHeader(b); ok {
+			if next, ok := parseMPEGHeader(s.peek(off+int64(f.length), 4)); ok && next.sampleRate == f.sampleRate {
+				m.Format = "mp3"
+				scanMPEG(s, off, audioEnd, f, m)
+				if m.Duration == 0 && tag != nil {
+					m.Duration = time.Duration(tag.lengthHint()) * time.Millisecond
+				}
+				m.setAverageBitrate(audioEnd - off)
+				return nil
+			}
+		}
+	}
+	return ErrUnknownFormat
+}
+
+// scanMPEG takes the frame count from a Xing/Info or VBRI header when the encoder wrote one,
+// and otherwise counts every frame, which is exact for both CBR and header-less VBR files.
+func scanMPEG(s *frameScanner, start, end int64, first mpegFrame, m *Metadata) {
+	m.SampleRate = first.sampleRate
+	m.Channels = first.channels
+
+	sideInfo := 32
+	switch {
+	case first.version == 3 && first.channels == 1:
+		sideInfo = 17
+	case first.version != 3 && first.channels == 2:
+		sideInfo = 17
+	case first.version != 3:
+		sideInfo = 9
+	}
+	if xing := s.peek(start+4+int64(sideInfo), 12); xing != nil {
+		if tag := string(xing[:4]); (tag == "Xing" || tag == "Info") && be.Uint32(xing[4:8])&1 != 0 {
+			frames := int64(be.Uint32(xing[8:12]))
+			m.Duration = secondsToDuration(float64(frames*int64(first.samples)) / float64(first.sampleRate))
+			return
+		}
+	}
+	if vbri := s.peek(start+4+32, 18); vbri != nil && string(vbri[:4]) == "VBRI" {
+		frames := int64(be.Uint32(vbri[14:18]))
+		m.Duration = secondsToDuration(float64(frames*int64(first.samples)) / float64(first.sampleRate))
+		return
+	}
+
+	var samples int64
+	for off := start; off+4 <= end; {
+		f, ok := parseMPEGHeader(s.peek(off, 4))
+		if !ok {
+			break
+		}
+		samples += int64(f.samples)
+		off += int64(f.length)
+	}
+	m.Duration = secondsToDuration(float64(samples) / float64(first.sampleRate))
+}
+
+func scanADTS(s *frameScanner, start, end int64, m *Metadata) {
+	var samples int64
+	var sampleRate int
+	for off := start; off+7 <= end; {
+		f, ok := parseADTSHeader(s.peek(off, 7))
+		if !ok {
+			break
+		}
+		if sampleRate == 0 {
+			sampleRate = f.sampleRate
+			m.SampleRate = f.sampleRate
+			m.Channels = f.channels
+		}
+		samples += int64(f.samples)
+		off += int64(f.length)
+	}
+	if sampleRate > 0 {
+		m.Duration = secondsToDuration(float64(samples) / float64(sampleRate))
+	}
+	m.setAverageBitrate(end - start)
+}
@@ -0,0 +1,145 @@
+package audio
+
+import (
+	"bytes"
+	"io"
+)
+
+type oggPage struct {
+	granule  int64
+	serial   uint32
+	segments []byte // lacing values
+	body     int64  // offset of the page body
+	next     int64  // offset of the following page
+}
+
+func readOggPage(r io.ReaderAt, off, size int64) (*oggPage, error) {
+	header, err := readAt(r, off, 27, size)
+	if err != nil || len(header) < 27 || string(header[:4]) != "OggS" {
+		return nil, ErrUnknownFormat
+	}
+	nSegments := int(header[26])
+	segments, err := readAt(r, off+27, nSegments, size)
+	if err != nil || len(segments) < nSegments {
+		return nil, ErrUnknownFormat
+	}
+	bodyLen := int64(0)
+	for _, s := range segments {
+		bodyLen += int64(s)
+	}
+	p := &oggPage{
+		granule:  int64(le.Uint64(header[6:14])),
+		serial:   le.Uint32(header[14:18]),
+		segments: segments,
+		body:     off + 27 + int64(nSegments),
+	}
+	p.next = p.body + bodyLen
+	return p, nil
+}
+
+// readOggPackets reassembles the first n packets of the first logical stream; comment packets routinely span pages.
+func readOggPackets(r io.ReaderAt, size int64, n int) ([][]byte, uint32, error) {
+	var packets [][]byte
+	var current []byte
+	var serial uint32
+	const maxHeaderBytes = 4 << 20 // bounds the walk for files with huge embedded cover art
+
+	for off := int64(0); len(packets) < n && off < size && off < maxHeaderBytes; {
+		page, err := readOggPage(r, off, size)
+		if err != nil {
+			return nil, 0, err
+		}
+		if off == 0 {
+			serial = page.serial
+		}
+		off = page.next
+		if page.serial != serial {
+			continue
+		}
+		body, err := readAt(r, page.body, int(page.next-page.body), size)
+		if err != nil {
+			return nil, 0, err
+		}
+		pos := 0
+		for _, s := range page.segments {
+			end := min(pos+int(s), len(body))
+			current = append(current, body[pos:end]...)
+			pos = end
+			if s < 255 {
+				packets = append(packets, current)
+				current = nil
+				if len(packets) == n {
+					break
+				}
+			}
+		}
+	}
+	if len(packets) < n {
+		return nil, 0, ErrUnknownFormat
+	}
+	return packets, serial, nil
+}
+
+// lastGranule finds the granule position of the last page of the stream, which gives the total sample count.
+func lastGranule(r io.ReaderAt, size int64, serial uint32) int64 {
+	const window = 64 * 1024
+	for end := size; end > 0; end -= window - 27 {
+		start := max(end-window, 0)
+		buf, err := readAt(r, start, int(end-start), size)
+		if err != nil {
+			return 0
+		}
+		for i := bytes.LastIndex(buf, []byte("OggS")); i >= 0; i = bytes.LastIndex(buf[:i], []byte("OggS")) {
+			if i+27 > len(buf) {
+				continue
+			}
+			granule := int64(le.Uint64(buf[i+6 : i+14]))
+			if le.Uint32(buf[i+14:i+18]) == serial && granule > 0 {
+				return granule
+			}
+		}
+		if start == 0 {
+			break
+		}
+	}
+	return 0
+}
+
+// probeOgg handles Ogg Vorbis and Ogg Opus.
+func probeOgg(r io.ReaderAt, size int64, m *Metadata) error {
+	packets, serial, err := readOggPackets(r, size, 2)
+	if err != nil {
+		return err
+	}
+	ident, comments := packets[0], packets[1]
+
+	var samples, rate int64
+	switch {
+	case len(ident) >= 16 && string(ident[:7]) == "\x01vorbis":
+		m.Format = "ogg"
+		m.Channels = int(ident[11])
+		m.SampleRate = int(le.Uint32(ident[12:16]))
+		if bytes.HasPrefix(comments, []byte("\x03vorbis")) {
+			parseVorbisComments(comments[7:], m)
+		}
+		samples, rate = lastGranule(r, size, serial), int64(m.SampleRate)
+	case len(ident) >= 19 && string(ident[:8]) == "OpusHead":
+		m.Format = "opus"
+		m.Channels = int(ident[9])
+		m.SampleRate = int(le.Uint32(ident[12:16])) // the input rate; Opus always decodes at 48 kHz
+		preSkip := int64(le.Uint16(ident[10:12]))
+		if bytes.HasPrefix(comments, []byte("OpusTags")) {
+			parseVorbisComments(comments[8:], m)
+		}
+		samples, rate = lastGranule(r, size, serial)-preSkip, 48000
+	default:
+		return ErrUnknownFormat
+	}
+
+	if samples > 0 && rate > 0 {
+		m.Duration = secondsToDuration(float64(samples) / float64(rate))
+		// The nominal Vorbis bitrate is often unset, so report the file average like players do
+		m.setAverageBitrate(size)
+	}
+	return nil
+}
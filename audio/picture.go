@@ -0,0 +1,110 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/base64"
+)
+
+// frontCover is the picture type of the front cover in ID3 APIC frames and FLAC PICTURE blocks.
+const frontCover = 3
+
+// maxPictureSize bounds how much embedded artwork Probe keeps in memory.
+const maxPictureSize = 16 << 20
+
+// Picture is artwork embedded in the file's tags.
+type Picture struct {
+	MIMEType string // as declared by the tag, may be empty or wrong; sniff Data when it matters
+	Data     []byte
+}
+
+// setPicture keeps the first picture found, unless a front cover turns up later.
+func (m *Metadata) setPicture(mimeType string, pictureType int, data []byte) {
+	if len(data) == 0 || len(data) > maxPictureSize {
+		return
+	}
+	if m.Picture != nil && (m.pictureType == frontCover || pictureType != frontCover) {
+		return
+	}
+	m.Picture = &Picture{MIMEType: mimeType, Data: data}
+	m.pictureType = pictureType
+}
+
+// readAPIC parses an ID3v2.3/2.4 APIC frame, or a v2.2 PIC frame (3-character image format instead of a MIME type).
+func readAPIC(data []byte, version byte, m *Metadata) {
+	if len(data) < 4 {
+		return
+	}
+	encoding := data[0]
+	rest := data[1:]
+
+	var mimeType string
+	if version == 2 {
+		mimeType = "image/" + string(bytes.ToLower(rest[:3]))
+		rest = rest[3:]
+	} else {
+		end := bytes.IndexByte(rest, 0)
+		if end < 0 {
+			return
+		}
+		mimeType = string(rest[:end])
+		rest = rest[end+1:]
+	}
+	if len(rest) < 1 {
+		return
+	}
+	pictureType := int(rest[0])
+	rest = rest[1:]
+
+	// Skip the description, terminated by one NUL (Latin-1/UTF-8) or two aligned NULs (UTF-16)
+	if encoding == 1 || encoding == 2 {
+		i := 0
+		for i+1 < len(rest) && (rest[i] != 0 || rest[i+1] != 0) {
+			i += 2
+		}
+		rest = rest[min(i+2, len(rest)):]
+	} else {
+		end := bytes.IndexByte(rest, 0)
+		if end < 0 {
+			return
+		}
+		rest = rest[end+1:]
+	}
+	m.setPicture(mimeType, pictureType, rest)
+}
+
+// readFLACPicture parses a FLAC PICTURE block, which Ogg files also carry base64-encoded in METADATA_BLOCK_PICTURE.
+func readFLACPicture(data []byte, m *Metadata) {
+	field := func(pos int) (int, bool) {
+		if pos+4 > len(data) {
+			return 0, false
+		}
+		return int(be.Uint32(data[pos:])), true
+	}
+	pictureType, ok := field(0)
+	if !ok {
+		return
+	}
+	mimeLen, ok := field(4)
+	if !ok || 8+mimeLen > len(data) {
+		return
+	}
+	mimeType := string(data[8 : 8+mimeLen])
+	pos := 8 + mimeLen
+	descLen, ok := field(pos)
+	if !ok {
+		return
+	}
+	pos += 4 + descLen + 16 // description, then width, height, depth and palette size
+	dataLen, ok := field(pos)
+	if !ok || pos+4+dataLen > len(data) {
+		return
+	}
+	m.setPicture(mimeType, pictureType, data[pos+4:pos+4+dataLen])
+}
+
+func readVorbisPicture(value string, m *Metadata) {
+	data, err := base64.StdEncoding.DecodeString(value)
+	if err == nil {
+		readFLACPicture(data, m)
+	}
+}
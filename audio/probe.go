@@ -0,0 +1,124 @@
+// Package audio reads tags, embedded artwork and stream properties (duration, bitrate, sample rate) from uploaded audio files
+// without decoding them: ID3v1/ID3v2 and MPEG/ADTS frame headers, FLAC and Ogg Vorbis comments, MP4 atoms
+// and WAV chunks.
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrUnknownFormat is returned by Probe when the content is not one of the supported containers.
+var ErrUnknownFormat = errors.New("unrecognized audio format")
+
+// Metadata is what Probe could learn about a file. Tag fields are empty when the file has no such tag.
+type Metadata struct {
+	Format      string // "mp3", "aac", "m4a", "ogg", "opus", "flac" or "wav"
+	Title       string
+	Artist      string
+	Album       string
+	AlbumArtist string
+	Genre       string
+	Year        string
+	TrackNumber int
+	DiscNumber  int
+
+	Duration   time.Duration
+	Bitrate    int // average bits per second over the audio data
+	SampleRate int
+	Channels   int
+
+	Picture     *Picture // embedded cover art, nil when there is none
+	pictureType int
+}
+
+// Probe inspects the file and returns its metadata. r must hold exactly size bytes.
+func Probe(r io.ReaderAt, size int64) (*Metadata, error) {
+	head, err := readAt(r, 0, 12, size)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Metadata{}
+	switch {
+	case bytes.HasPrefix(head, []byte("fLaC")):
+		err = probeFLAC(r, size, m)
+	case bytes.HasPrefix(head, []byte("OggS")):
+		err = probeOgg(r, size, m)
+	case len(head) >= 12 && string(head[4:8]) == "ftyp":
+		err = probeMP4(r, size, m)
+	case len(head) >= 12 && string(head[0:4]) == "RIFF" && string(head[8:12]) == "WAVE":
+		err = probeWAV(r, size, m)
+	default:
+		err = probeMPEG(r, size, m)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// readAt reads n bytes at off, clamped to the file size.
+func readAt(r io.ReaderAt, off int64, n int, size int64) ([]byte, error) {
+	if off >= size {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if remaining := size - off; int64(n) > remaining {
+		n = int(remaining)
+	}
+	buf := make([]byte, n)
+	if _, err := r.ReadAt(buf, off); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// setAverageBitrate derives the bitrate from the size of the audio payload when the container does not state it.
+func (m *Metadata) setAverageBitrate(audioBytes int64) {
+	if m.Bitrate == 0 && m.Duration > 0 && audioBytes > 0 {
+		m.Bitrate = int(float64(audioBytes*8) / m.Duration.Seconds())
+	}
+}
+
+// setIfEmpty fills *field with value unless a higher-priority tag already set it.
+func setIfEmpty(field *string, value string) {
+	value = strings.TrimSpace(strings.TrimRight(value, "\x00"))
+	if *field == "" && value != "" {
+		*field = value
+	}
+}
+
+// parseYear extracts the year from dates such as "2019", "2019-05-01" or "2019-05-01T10:00:00".
+func parseYear(value string) string {
+	value = strings.TrimSpace(value)
+	if len(value) >= 4 {
+		if _, err := strconv.Atoi(value[:4]); err == nil {
+			return value[:4]
+		}
+	}
+	return ""
+}
+
+// parseIndex reads the first number of "3" or "3/12".
+func parseIndex(value string) int {
+	value = strings.TrimSpace(value)
+	if i := strings.IndexByte(value, '/'); i >= 0 {
+		value = value[:i]
+	}
+	n, _ := strconv.Atoi(value)
+	return n
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+var (
+	be = binary.BigEndian
+	le = binary.LittleEndian
+)
@@ -0,0 +1,157 @@
+package audio
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// The files in testdata are minimal hand-built containers: real headers, tags and frame layouts around silent or
+// zeroed payloads, so the expected durations and bitrates follow from the numbers written into them.
+func TestProbe(t *testing.T) {
+	tests := []struct {
+		file        string
+		want        Metadata
+		duration    time.Duration
+		pictureMIME string
+	}{
+		{
+			// ID3v2.4 tag, 25 CBR frames of 1152 samples at 48 kHz
+			file: "tagged.mp3",
+			want: Metadata{Format: "mp3", Title: "Intro", Artist: "The Band", AlbumArtist: "Various Artists", Album: "First Light",
+				Genre: "Rock", Year: "2019", TrackNumber: 3, DiscNumber: 2, Bitrate: 128000, SampleRate: 48000, Channels: 2},
+			duration: 600 * time.Millisecond,
+		},
+		{
+			// UTF-16 ID3v2.3 title and cover, Xing header claiming 250 frames, ID3v1.1 tag filling in the rest
+			file: "xing_v1.mp3",
+			want: Metadata{Format: "mp3", Title: "Café", Artist: "V1 Artist", Album: "V1 Album", Genre: "Rock", Year: "1999",
+				TrackNumber: 7, Bitrate: 5120, SampleRate: 48000, Channels: 2},
+			duration:    6 * time.Second,
+			pictureMIME: "image/png",
+		},
+		{
+			// 75 ADTS frames of 1024 samples at 48 kHz
+			file:     "adts.aac",
+			want:     Metadata{Format: "aac", Bitrate: 96000, SampleRate: 48000, Channels: 2},
+			duration: 1600 * time.Millisecond,
+		},
+		{
+			// iTunes ilst tags with a numeric genre, mvhd duration, 20000 byte mdat
+			file: "tagged.m4a",
+			want: Metadata{Format: "m4a", Title: "Night Drive", Artist: "Synth Club", AlbumArtist: "Synth Club", Album: "Neon",
+				Genre: "Techno", Year: "2021", TrackNumber: 4, DiscNumber: 1, Bitrate: 64000, SampleRate: 44100, Channels: 2},
+			duration:    2500 * time.Millisecond,
+			pictureMIME: "image/jpeg",
+		},
+		{
+			// Comment packet spanning two pages, last granule 132300 at 44.1 kHz
+			file: "tagged.ogg",
+			want: Metadata{Format: "ogg", Title: "Low Tide", Artist: "Harbour", Album: "Coastline", Genre: "Ambient", Year: "2018",
+				TrackNumber: 7, DiscNumber: 1, Bitrate: 4780 * 8 / 3, SampleRate: 44100, Channels: 2},
+			duration: 3 * time.Second,
+		},
+		{
+			// Lower-case comment keys; the 312 sample pre-skip is not part of the duration
+			file:     "tagged.opus",
+			want:     Metadata{Format: "opus", Title: "Static", Artist: "Radio Days", TrackNumber: 2, Bitrate: 3195 * 8 / 2, SampleRate: 44100, Channels: 2},
+			duration: 2 * time.Second,
+		},
+		{
+			// STREAMINFO with 176400 samples at 44.1 kHz, Vorbis comments, PICTURE block, 32000 bytes of frames
+			file: "tagged.flac",
+			want: Metadata{Format: "flac", Title: "Glass", Artist: "Prism", AlbumArtist: "Prism", Album: "Spectra", Genre: "Electronic",
+				Year: "2020", TrackNumber: 1, DiscNumber: 2, Bitrate: 64000, SampleRate: 44100, Channels: 2},
+			duration:    4 * time.Second,
+			pictureMIME: "image/jpeg",
+		},
+		{
+			// LIST/INFO before the data chunk, with an odd-sized value followed by a pad byte
+			file: "tagged.wav",
+			want: Metadata{Format: "wav", Title: "Field Recording", Artist: "Abc", Album: "Outdoors", Genre: "Nature", Year: "2017",
+				TrackNumber: 5, Bitrate: 705600, SampleRate: 22050, Channels: 2},
+			duration: 500 * time.Millisecond,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			m, err := Probe(bytes.NewReader(data), int64(len(data)))
+			if err != nil {
+				t.Fatalf("Probe: %v", err)
+			}
+
+			if d := m.Duration - tt.duration; d < -time.Millisecond || d > time.Millisecond {
+				t.Errorf("Duration = %v, want %v", m.Duration, tt.duration)
+			}
+			if tt.pictureMIME == "" && m.Picture != nil {
+				t.Errorf("Picture = %q, want none", m.Picture.MIMEType)
+			}
+			if tt.pictureMIME != "" && (m.Picture == nil || m.Picture.MIMEType != tt.pictureMIME || len(m.Picture.Data) == 0) {
+				t.Errorf("Picture = %+v, want %s", m.Picture, tt.pictureMIME)
+			}
+
+			got := *m
+			got.Duration, got.Picture, got.pictureType = 0, nil, 0
+			if got != tt.want {
+				t.Errorf("Probe =\n%+v\nwant\n%+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSniff(t *testing.T) {
+	tests := map[string]string{
+		"tagged.mp3":  "mp3",
+		"xing_v1.mp3": "mp3",
+		"adts.aac":    "aac",
+		"tagged.m4a":  "m4a",
+		"tagged.ogg":  "ogg",
+		"tagged.opus": "opus",
+		"tagged.flac": "flac",
+		"tagged.wav":  "wav",
+	}
+	for file, want := range tests {
+		data, err := os.ReadFile(filepath.Join("testdata", file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := Sniff(data[:SniffLen]); got != want {
+			t.Errorf("Sniff(%s) = %q, want %q", file, got, want)
+		}
+	}
+
+	for _, head := range [][]byte{[]byte("%PDF-1.7"), []byte("PK\x03\x04"), make([]byte, SniffLen)} {
+		if got := Sniff(head); got != "" {
+			t.Errorf("Sniff(%q) = %q, want none", head, got)
+		}
+	}
+}
+
+func TestProbeRejectsUnknownContent(t *testing.T) {
+	data := bytes.Repeat([]byte("not audio "), 100)
+	if _, err := Probe(bytes.NewReader(data), int64(len(data))); err != ErrUnknownFormat {
+		t.Errorf("Probe = %v, want ErrUnknownFormat", err)
+	}
+}
+
+func TestID3Genre(t *testing.T) {
+	tests := map[string]string{
+		"(17)":      "Rock",
+		"(17)Indie": "Indie",
+		"17":        "Rock",
+		"Shoegaze":  "Shoegaze",
+		"(999)":     "",
+	}
+	for value, want := range tests {
+		if got := id3Genre(value); got != want {
+			t.Errorf("id3Genre(%q) = %q, want %q", value, got, want)
+		}
+	}
+}
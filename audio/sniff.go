@@ -0,0 +1,95 @@
+package audio
+
+import (
+	"bytes"
+	"strings"
+)
+
+// SniffLen is how many leading bytes Sniff needs to recognize every supported format.
+const SniffLen = 64
+
+var formatTypes = map[string]struct {
+	mimeType  string
+	extension string
+}{
+	"mp3":  {"audio/mpeg", ".mp3"},
+	"aac":  {"audio/aac", ".aac"},
+	"m4a":  {"audio/mp4", ".m4a"},
+	"ogg":  {"audio/ogg", ".ogg"},
+	"opus": {"audio/ogg", ".opus"},
+	"flac": {"audio/flac", ".flac"},
+	"wav":  {"audio/wav", ".wav"},
+}
+
+// MP4 brands of audio-only files and of the generic profiles audio encoders commonly write.
+var mp4AudioBrands = map[string]bool{
+	"M4A ": true, "M4B ": true, "M4P ": true, "mp41": true, "mp42": true, "isom": true, "iso2": true, "dash": true, "3gp4": true, "3gp5": true,
+}
+
+// Sniff identifies the format from the leading bytes of a file by magic number only, ignoring the file name
+// and any client-supplied content type. It returns "" for anything that is not a supported audio format.
+func Sniff(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte("ID3")):
+		// ID3 tags front MP3 almost exclusively; Probe refines this to "aac" for tagged ADTS streams
+		return "mp3"
+	case bytes.HasPrefix(head, []byte("fLaC")):
+		return "flac"
+	case bytes.HasPrefix(head, []byte("OggS")):
+		// The first page carries the identification header of the first logical stream
+		if len(head) >= 28 {
+			body := head[28:]
+			if bytes.HasPrefix(body, []byte("OpusHead")) {
+				return "opus"
+			}
+			if bytes.HasPrefix(body, []byte("\x01vorbis")) {
+				return "ogg"
+			}
+		}
+		return ""
+	case len(head) >= 12 && string(head[0:4]) == "RIFF" && string(head[8:12]) == "WAVE":
+		return "wav"
+	case len(head) >= 12 && string(head[4:8]) == "ftyp":
+		if mp4AudioBrands[string(head[8:12])] {
+			return "m4a"
+		}
+		return ""
+	}
+	if _, ok := parseADTSHeader(head); ok {
+		return "aac"
+	}
+	if _, ok := parseMPEGHeader(head); ok {
+		return "mp3"
+	}
+	return ""
+}
+
+// MIMEType returns the content type to store a file of the given format with.
+func MIMEType(format string) string {
+	if t, ok := formatTypes[format]; ok {
+		return t.mimeType
+	}
+	return "application/octet-stream"
+}
+
+// Extension returns the canonical file extension (with the dot) for the given format.
+func Extension(format string) string {
+	return formatTypes[format].extension
+}
+
+// Supported reports whether format is one of the audio formats accepted for upload.
+func Supported(format string) bool {
+	_, ok := formatTypes[format]
+	return ok
+}
+
+// FormatFromExtension maps a file extension such as ".MP3" to its format, for when only the name is known yet.
+func FormatFromExtension(ext string) string {
+	ext = strings.ToLower(ext)
+	for format, t := range formatTypes {
+		if t.extension == ext {
+			return format
+		}
+	}
+	return ""
+}
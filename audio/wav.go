@@ -0,0 +1,78 @@
+package audio
+
+import "io"
+
+// probeWAV reads the fmt and data chunks for the stream properties and a LIST/INFO chunk for tags.
+func probeWAV(r io.ReaderAt, size int64, m *Metadata) error {
+	m.Format = "wav"
+	var byteRate, dataBytes int64
+	for off := int64(12); off+8 <= size; {
+		header, err := readAt(r, off, 8, size)
+		if err != nil || len(header) < 8 {
+			break
+		}
+		id := string(header[:4])
+		length := int64(le.Uint32(header[4:8]))
+		body := off + 8
+
+		switch id {
+		case "fmt ":
+			data, err := readAt(r, body, 16, size)
+			if err != nil || len(data) < 16 {
+				return ErrUnknownFormat
+			}
+			m.Channels = int(le.Uint16(data[2:4]))
+			m.SampleRate = int(le.Uint32(data[4:8]))
+			byteRate = int64(le.Uint32(data[8:12]))
+		case "data":
+			// Streamed recordings may leave the size unset or too large
+			dataBytes = min(length, size-body)
+		case "LIST":
+			if length <= 1<<20 {
+				if data, err := readAt(r, body, int(length), size); err == nil {
+					parseWAVInfo(data, m)
+				}
+			}
+		}
+		// Chunks are padded to an even size
+		off = body + length + length&1
+	}
+
+	if byteRate > 0 && dataBytes > 0 {
+		m.Duration = secondsToDuration(float64(dataBytes) / float64(byteRate))
+		m.Bitrate = int(byteRate * 8)
+	}
+	return nil
+}
+
+func parseWAVInfo(data []byte, m *Metadata) {
+	if len(data) < 4 || string(data[:4]) != "INFO" {
+		return
+	}
+	for pos := 4; pos+8 <= len(data); {
+		id := string(data[pos : pos+4])
+		n := int(le.Uint32(data[pos+4 : pos+8]))
+		pos += 8
+		if pos+n > len(data) {
+			return
+		}
+		value := latin1(data[pos : pos+n])
+		switch id {
+		case "INAM":
+			setIfEmpty(&m.Title, value)
+		case "IART":
+			setIfEmpty(&m.Artist, value)
+		case "IPRD":
+			setIfEmpty(&m.Album, value)
+		case "IGNR":
+			setIfEmpty(&m.Genre, value)
+		case "ICRD":
+			setIfEmpty(&m.Year, parseYear(value))
+		case "ITRK", "IPRT":
+			if m.TrackNumber == 0 {
+				m.TrackNumber = parseIndex(value)
+			}
+		}
+		pos += n + n&1
+	}
+}
@@ -0,0 +1,112 @@
+package audio
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"math"
+)
+
+// Waveform holds peak data for drawing a seek bar: the minimum and maximum sample of every run of SamplesPerPixel
+// mono samples, interleaved as min, max. It is written in the formats of BBC's audiowaveform (version 2), which
+// waveform.js and peaks.js read directly.
+type Waveform struct {
+	SampleRate      int
+	SamplesPerPixel int
+	Peaks           []int16 // min, max per pixel
+}
+
+// Points returns the number of min/max pairs.
+func (w *Waveform) Points() int {
+	return len(w.Peaks) / 2
+}
+
+// PeakBuilder computes a Waveform from a stream of 16-bit samples without keeping the samples.
+type PeakBuilder struct {
+	waveform   Waveform
+	count      int
+	minV, maxV int16
+}
+
+// NewPeakBuilder starts a waveform with the given resolution.
+func NewPeakBuilder(sampleRate, samplesPerPixel int) *PeakBuilder {
+	return &PeakBuilder{
+		waveform: Waveform{SampleRate: sampleRate, SamplesPerPixel: samplesPerPixel},
+		minV:     math.MaxInt16,
+		maxV:     math.MinInt16,
+	}
+}
+
+// Add feeds the next samples.
+func (b *PeakBuilder) Add(samples []int16) {
+	for _, s := range samples {
+		b.minV, b.maxV = min(b.minV, s), max(b.maxV, s)
+		if b.count++; b.count == b.waveform.SamplesPerPixel {
+			b.flush()
+		}
+	}
+}
+
+func (b *PeakBuilder) flush() {
+	b.waveform.Peaks = append(b.waveform.Peaks, b.minV, b.maxV)
+	b.count, b.minV, b.maxV = 0, math.MaxInt16, math.MinInt16
+}
+
+// Waveform returns the peaks so far, including a final partial pixel.
+func (b *PeakBuilder) Waveform() *Waveform {
+	if b.count > 0 {
+		b.flush()
+	}
+	return &b.waveform
+}
+
+// Downsample merges pixels so the result has at most points pixels; the resolution stays a whole multiple of w's.
+func (w *Waveform) Downsample(points int) *Waveform {
+	group := max(1, (w.Points()+points-1)/points)
+	out := &Waveform{SampleRate: w.SampleRate, SamplesPerPixel: w.SamplesPerPixel * group}
+	for start := 0; start < w.Points(); start += group {
+		minV, maxV := int16(math.MaxInt16), int16(math.MinInt16)
+		for i := start; i < min(start+group, w.Points()); i++ {
+			minV, maxV = min(minV, w.Peaks[2*i]), max(maxV, w.Peaks[2*i+1])
+		}
+		out.Peaks = append(out.Peaks, minV, maxV)
+	}
+	return out
+}
+
+// to8 scales a 16-bit peak to the 8-bit range audiowaveform uses for its compact output.
+func to8(v int16) int8 {
+	return int8(v >> 8)
+}
+
+// MarshalDat encodes the waveform in audiowaveform's binary format, version 2 with 8-bit data:
+// a little-endian header (version, flags, sample rate, samples per pixel, length, channels) then the peaks.
+func (w *Waveform) MarshalDat() []byte {
+	data := make([]byte, 24+len(w.Peaks))
+	binary.LittleEndian.PutUint32(data[0:], 2) // version
+	binary.LittleEndian.PutUint32(data[4:], 1) // flags: 8-bit data
+	binary.LittleEndian.PutUint32(data[8:], uint32(w.SampleRate))
+	binary.LittleEndian.PutUint32(data[12:], uint32(w.SamplesPerPixel))
+	binary.LittleEndian.PutUint32(data[16:], uint32(w.Points())) // length in pixels
+	binary.LittleEndian.PutUint32(data[20:], 1)                  // channels
+	for i, v := range w.Peaks {
+		data[24+i] = byte(to8(v))
+	}
+	return data
+}
+
+// MarshalJSON encodes the waveform in audiowaveform's JSON format, version 2 with 8-bit data.
+func (w *Waveform) MarshalJSON() ([]byte, error) {
+	peaks := make([]int8, len(w.Peaks))
+	for i, v := range w.Peaks {
+		peaks[i] = to8(v)
+	}
+	return json.Marshal(struct {
+		Version         int    `json:"version"`
+		Channels        int    `json:"channels"`
+		SampleRate      int    `json:"sample_rate"`
+		SamplesPerPixel int    `json:"samples_per_pixel"`
+		Bits            int    `json:"bits"`
+		Length          int    `json:"length"`
+		Data            []int8 `json:"data"`
+	}{2, 1, w.SampleRate, w.SamplesPerPixel, 8, w.Points(), peaks})
+}
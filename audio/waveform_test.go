@@ -0,0 +1,107 @@
+package audio
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+func TestPeakBuilder(t *testing.T) {
+	tests := []struct {
+		name            string
+		samplesPerPixel int
+		chunks          [][]int16
+		want            []int16
+	}{
+		{"whole pixels", 2, [][]int16{{1, -1, 5, 3}}, []int16{-1, 1, 3, 5}},
+		{"pixel split across Add calls", 3, [][]int16{{1, 2}, {-4, 7}, {0, 0}}, []int16{-4, 2, 0, 7}},
+		{"final partial pixel", 4, [][]int16{{10, -10, 0, 0, 32767, -32768}}, []int16{-10, 10, -32768, 32767}},
+		{"no samples", 4, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewPeakBuilder(44100, tt.samplesPerPixel)
+			for _, chunk := range tt.chunks {
+				b.Add(chunk)
+			}
+			w := b.Waveform()
+			if !slices.Equal(w.Peaks, tt.want) {
+				t.Errorf("Peaks = %v, want %v", w.Peaks, tt.want)
+			}
+			if w.Points() != len(tt.want)/2 || w.SampleRate != 44100 || w.SamplesPerPixel != tt.samplesPerPixel {
+				t.Errorf("Waveform = %d points at %d Hz, %d samples per pixel", w.Points(), w.SampleRate, w.SamplesPerPixel)
+			}
+		})
+	}
+}
+
+func TestDownsample(t *testing.T) {
+	w := &Waveform{SampleRate: 44100, SamplesPerPixel: 256, Peaks: []int16{-1, 1, -5, 2, -2, 9, -3, 3, -7, 4}}
+
+	tests := []struct {
+		points          int
+		samplesPerPixel int
+		want            []int16
+	}{
+		{5, 256, []int16{-1, 1, -5, 2, -2, 9, -3, 3, -7, 4}},
+		{10, 256, []int16{-1, 1, -5, 2, -2, 9, -3, 3, -7, 4}},
+		{3, 512, []int16{-5, 2, -3, 9, -7, 4}}, // the last group has a single pixel
+		{2, 768, []int16{-5, 9, -7, 4}},
+		{1, 1280, []int16{-7, 9}},
+	}
+	for _, tt := range tests {
+		got := w.Downsample(tt.points)
+		if got.SamplesPerPixel != tt.samplesPerPixel || !slices.Equal(got.Peaks, tt.want) {
+			t.Errorf("Downsample(%d) = %d samples per pixel %v, want %d %v", tt.points, got.SamplesPerPixel, got.Peaks, tt.samplesPerPixel, tt.want)
+		}
+		if got.SampleRate != w.SampleRate {
+			t.Errorf("Downsample(%d) sample rate = %d", tt.points, got.SampleRate)
+		}
+	}
+}
+
+func TestWaveformMarshalDat(t *testing.T) {
+	w := &Waveform{SampleRate: 22050, SamplesPerPixel: 512, Peaks: []int16{-32768, 32767, -256, 255}}
+	data := w.MarshalDat()
+
+	header := []uint32{2, 1, 22050, 512, 2, 1} // version, 8-bit flag, rate, resolution, length, channels
+	if len(data) != 24+len(w.Peaks) {
+		t.Fatalf("len = %d, want %d", len(data), 24+len(w.Peaks))
+	}
+	for i, want := range header {
+		if got := binary.LittleEndian.Uint32(data[4*i:]); got != want {
+			t.Errorf("header word %d = %d, want %d", i, got, want)
+		}
+	}
+	if peaks := []int8{int8(data[24]), int8(data[25]), int8(data[26]), int8(data[27])}; !slices.Equal(peaks, []int8{-128, 127, -1, 0}) {
+		t.Errorf("peaks = %v, want [-128 127 -1 0]", peaks)
+	}
+}
+
+func TestWaveformMarshalJSON(t *testing.T) {
+	w := &Waveform{SampleRate: 44100, SamplesPerPixel: 256, Peaks: []int16{-32768, 32767, -512, 512}}
+	data, err := json.Marshal(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got struct {
+		Version         int    `json:"version"`
+		Channels        int    `json:"channels"`
+		SampleRate      int    `json:"sample_rate"`
+		SamplesPerPixel int    `json:"samples_per_pixel"`
+		Bits            int    `json:"bits"`
+		Length          int    `json:"length"`
+		Data            []int8 `json:"data"`
+	}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Version != 2 || got.Channels != 1 || got.SampleRate != 44100 || got.SamplesPerPixel != 256 || got.Bits != 8 || got.Length != 2 {
+		t.Errorf("header = %+v", got)
+	}
+	if !slices.Equal(got.Data, []int8{-128, 127, -2, 2}) {
+		t.Errorf("data = %v, want [-128 127 -2 2]", got.Data)
+	}
+}
@@ -0,0 +1,31 @@
+// Command firestoreindexes writes the composite indexes and field overrides the API's queries need in the
+// firestore.indexes.json format, for deployment with `firebase deploy --only firestore:indexes`. Run it through
+// go generate ./services.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"lipur_backend/services"
+	"lipur_backend/workers"
+	"log"
+	"os"
+)
+
+func main() {
+	out := flag.String("o", "firestore.indexes.json", "output file")
+	flag.Parse()
+
+	indexes := append(services.SongCatalogIndexes(), workers.JobIndexes()...)
+	data, err := json.MarshalIndent(struct {
+		Indexes        []services.FirestoreIndex         `json:"indexes"`
+		FieldOverrides []services.FirestoreFieldOverride `json:"fieldOverrides"`
+	}{indexes, services.PlaylistFieldOverrides()}, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(*out, append(data, '\n'), 0o644); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Wrote %d indexes to %s", len(indexes), *out)
+}
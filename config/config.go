@@ -13,10 +13,13 @@ func LoadEnv() {
 		log.Println("No .env file found, relying on system environment variables")
 	}
 	log.Println("B2_ACCOUNT_ID:", os.Getenv("B2_ACCOUNT_ID"))
-	log.Println("B2_APPLICATION_KEY:", os.Getenv("B2_APPLICATION_KEY")[:5]+"...")
+	if appKey := os.Getenv("B2_APPLICATION_KEY"); len(appKey) > 5 {
+		log.Println("B2_APPLICATION_KEY:", appKey[:5]+"...")
+	}
 	log.Println("B2_BUCKET_NAME:", os.Getenv("B2_BUCKET_NAME"))
 	log.Println("B2_REGION:", os.Getenv("B2_REGION"))
 	log.Println("B2_ENDPOINT:", os.Getenv("B2_ENDPOINT"))
+	log.Println("STORAGE_BACKEND:", os.Getenv("STORAGE_BACKEND"))
 	log.Println("PORT:", os.Getenv("PORT"))
 }
 
@@ -0,0 +1,551 @@
+package controllers
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"lipur_backend/audio"
+	"lipur_backend/models"
+	"lipur_backend/services"
+	"lipur_backend/utils"
+	"lipur_backend/workers"
+	"log"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// maxAlbumTracks bounds one batch: up to four writes per track (song, job, fingerprint, flag) plus the album,
+// artist and outbox stay below Firestore's 500 writes per batch.
+const maxAlbumTracks = 100
+
+const (
+	UploadErrInvalidArchive = "INVALID_ARCHIVE"
+	UploadErrTooManyTracks  = "TOO_MANY_TRACKS"
+	UploadErrNoValidTracks  = "NO_VALID_TRACKS"
+)
+
+// Track states reported per file.
+const (
+	trackCreated  = "created"
+	trackRejected = "rejected"
+	trackFailed   = "failed"
+)
+
+// Leading track numbers in file names: "01 Intro.mp3", "1-03 Song.flac" (disc-track), "07. Outro.ogg".
+var trackNumberPattern = regexp.MustCompile(`^\s*(?:(\d{1,2})[-.])?(\d{1,3})\b`)
+
+// albumTrack is one submitted file, from a multipart part or a ZIP entry.
+type albumTrack struct {
+	Index    int // submission order
+	Filename string
+	File     songFile
+	Size     int64
+	Format   string
+	Tags     *audio.Metadata
+	Result   gin.H
+}
+
+// UploadAlbum accepts several audio files ("files" parts) and/or ZIP archives ("zip" parts), orders the tracks
+// by their tags or file names, and writes the album, a shared artist and all songs in one Firestore batch.
+// The album cover comes from the "cover" part, a cover/folder/front image in the archive, the first embedded
+// picture or an initials placeholder, and is shared by every track. Each file gets its own status in the response.
+func UploadAlbum(c *gin.Context, storage services.Storage, policy *services.UploadPolicy, processor *workers.SongProcessor, fingerprinter *services.Fingerprinter, firestoreClient *firestore.Client) {
+	role := uploadRole(c)
+	limit := policy.MaxBytes(role)
+	albumLimit := policy.MaxAlbumBytes(role)
+	if limit <= 0 {
+		checkUploadSize(c, policy, 1)
+		return
+	}
+	if albumLimit <= 0 {
+		uploadError(c, http.StatusForbidden, UploadErrNotAllowed, fmt.Sprintf("Album uploads are not allowed for %s users", role), gin.H{"role": role})
+		return
+	}
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, albumLimit+maxCoverBytes+multipartOverhead)
+
+	form, err := c.MultipartForm()
+	if err != nil {
+		uploadError(c, http.StatusBadRequest, UploadErrFileRequired, fmt.Sprintf("Failed to read form: %v", err), nil)
+		return
+	}
+	parts := form.File["files"]
+	archives := form.File["zip"]
+	if len(parts) == 0 && len(archives) == 0 {
+		uploadError(c, http.StatusBadRequest, UploadErrFileRequired, `Send audio files as "files" parts or a ZIP as a "zip" part`, nil)
+		return
+	}
+
+	var tracks []*albumTrack
+	var archiveCover []byte
+	var cleanup []func()
+	defer func() {
+		for _, fn := range cleanup {
+			fn()
+		}
+	}()
+
+	for _, part := range parts {
+		track := &albumTrack{Index: len(tracks), Filename: path.Base(part.Filename), Size: part.Size}
+		tracks = append(tracks, track)
+		if part.Size > limit {
+			track.reject(UploadErrFileTooLarge, fmt.Sprintf("File is larger than the %d byte limit", limit))
+			continue
+		}
+		f, err := part.Open()
+		if err != nil {
+			track.reject(UploadErrFileRequired, fmt.Sprintf("Failed to open file: %v", err))
+			continue
+		}
+		cleanup = append(cleanup, func() { f.Close() })
+		track.File = f
+	}
+	// What the archives inflate to is bounded by the album limit too, not only what was sent
+	budget := albumLimit
+	for _, archive := range archives {
+		extracted, cover, err := extractAlbumArchive(archive, limit, &budget, len(tracks), &cleanup)
+		if err != nil {
+			uploadError(c, http.StatusBadRequest, UploadErrInvalidArchive, fmt.Sprintf("Failed to read %s: %v", archive.Filename, err), nil)
+			return
+		}
+		tracks = append(tracks, extracted...)
+		if archiveCover == nil {
+			archiveCover = cover
+		}
+	}
+	if len(tracks) > maxAlbumTracks {
+		uploadError(c, http.StatusBadRequest, UploadErrTooManyTracks, fmt.Sprintf("An album can have at most %d tracks", maxAlbumTracks),
+			gin.H{"tracks": len(tracks)})
+		return
+	}
+
+	// Sniff and probe everything first: the tags decide the track order and the album defaults
+	var accepted []*albumTrack
+	for _, track := range tracks {
+		if track.File == nil {
+			continue
+		}
+		if track.Size == 0 {
+			track.reject(UploadErrEmptyFile, "File is empty")
+			continue
+		}
+		head := make([]byte, min(track.Size, audio.SniffLen))
+		if _, err := track.File.ReadAt(head, 0); err != nil && err != io.EOF {
+			track.reject(UploadErrFileRequired, fmt.Sprintf("Failed to read file: %v", err))
+			continue
+		}
+		if track.Format = audio.Sniff(head); track.Format == "" {
+			track.reject(UploadErrUnsupportedFormat, "File is not a supported audio format")
+			continue
+		}
+		track.Tags = probeUpload(&songUpload{File: track.File, Size: track.Size, Filename: track.Filename})
+		accepted = append(accepted, track)
+	}
+	if len(accepted) == 0 {
+		uploadError(c, http.StatusUnprocessableEntity, UploadErrNoValidTracks, "None of the files is a supported audio track",
+			gin.H{"tracks": trackResults(tracks)})
+		return
+	}
+	orderAlbumTracks(accepted)
+
+	// Album-wide values: form fields first, then the first track's tags
+	first := accepted[0].Tags
+	albumId := uuid.New().String()
+	albumTitle := firstNonEmpty(c.PostForm("album"), c.PostForm("title"), first.Album, "Untitled Album")
+	artistName := firstNonEmpty(c.PostForm("artist"), first.AlbumArtist, first.Artist, "Unknown Artist")
+	artistId := c.PostForm("artistId")
+	createdYear := firstNonEmpty(c.PostForm("createdYear"), first.Year, time.Now().Format("2006"))
+	upload_user := firstNonEmpty(c.PostForm("upload_user"), "admin")
+
+	cover, ok := readCoverPart(c)
+	if !ok {
+		return
+	}
+	var newArtist *models.Artist
+	if artistId == "" {
+		artistId = uuid.New().String()
+		newArtist = models.NewArtist(artistId, artistName)
+		if err := newArtist.Validate(); err != nil {
+			respondSaveError(c, err)
+			return
+		}
+	}
+
+	uploads := make([]*songUpload, len(accepted))
+	for position, track := range accepted {
+		fields := map[string]string{
+			"artist":      artistName,
+			"artistId":    artistId,
+			"album":       albumTitle,
+			"genre":       c.PostForm("genre"),
+			"createdYear": createdYear,
+			"upload_user": upload_user,
+			"title":       track.Tags.Title,
+		}
+		if fields["title"] == "" {
+			fields["title"] = strings.TrimSuffix(track.Filename, path.Ext(track.Filename))
+		}
+		uploads[position] = &songUpload{
+			File:     track.File,
+			Size:     track.Size,
+			Filename: track.Filename,
+			Format:   track.Format,
+			Fields:   fields,
+			Uploader: c.GetString("uid"),
+			Tags:     track.Tags,
+			AlbumID:  albumId,
+		}
+		uploads[position].DiscNumber, uploads[position].TrackNumber = albumTrackNumber(track, position)
+		uploads[position].resolve()
+	}
+
+	// The album is checked against every planned track before anything is stored; the tracks that fail
+	// are dropped from it later
+	album := &models.Album{
+		ID:          albumId,
+		Title:       albumTitle,
+		ArtistID:    artistId,
+		ArtistName:  artistName,
+		Genre:       firstNonEmpty(c.PostForm("genre"), first.Genre, "Unknown"),
+		CreatedYear: createdYear,
+		TrackCount:  len(uploads),
+		UploadUser:  upload_user,
+		CreatedAt:   time.Now(),
+	}
+	for _, u := range uploads {
+		album.SongIDs = append(album.SongIDs, u.SongID)
+	}
+	if err := album.Validate(); err != nil {
+		respondSaveError(c, err)
+		return
+	}
+
+	// Record every object the album may store before storing the first one (see services.BeginOutbox).
+	// The per-track cover keys are listed too, as tracks fall back to their own covers if the shared one fails.
+	ctx := context.Background()
+	entry := services.NewOutboxEntry("album")
+	entry.Documents = []string{"albums/" + albumId}
+	for _, size := range services.CoverSizes {
+		entry.Objects = append(entry.Objects, services.CoverKey(services.AlbumPrefix(albumId), size.Size))
+	}
+	for _, u := range uploads {
+		entry.Objects = append(entry.Objects, songObjectKeys(u)...)
+	}
+	if err := services.BeginOutbox(ctx, firestoreClient, entry); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to record upload: %v", err)})
+		return
+	}
+
+	coverUrls := storeAlbumCover(ctx, storage, albumId, cover, archiveCover, accepted, albumTitle, artistName)
+
+	// Store every track; the documents are only written once all of them are prepared
+	var songs []*preparedSong
+	var songTracks []*albumTrack
+	for i, track := range accepted {
+		u := uploads[i]
+		u.SharedCover = coverUrls
+		song, err := prepareSong(ctx, storage, processor, fingerprinter, firestoreClient, u)
+		var nearDuplicate *nearDuplicateError
+		if errors.As(err, &nearDuplicate) {
+			track.reject(UploadErrDuplicateAudio, err.Error())
+			track.Result["duplicateOf"] = nearDuplicate.Match.SongID
+			continue
+		}
+		var invalid *models.ValidationError
+		if errors.As(err, &invalid) {
+			track.reject(UploadErrInvalidMetadata, err.Error())
+			track.Result["fields"] = invalid.Fields
+			continue
+		}
+		if err != nil {
+			log.Printf("Album %s: track %s failed: %v", albumId, track.Filename, err)
+			services.DeleteObjects(ctx, storage, songObjectKeys(u))
+			track.Result = gin.H{"status": trackFailed, "error": err.Error()}
+			continue
+		}
+		songs = append(songs, song)
+		songTracks = append(songTracks, track)
+	}
+	if len(songs) == 0 {
+		services.CompensateOutbox(ctx, storage, firestoreClient, entry, errors.New("no track could be stored"))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "No track could be stored", "tracks": trackResults(tracks)})
+		return
+	}
+
+	album.CoverURL, album.CoverURLs = coverUrls["large"], coverUrls
+	album.SongIDs, album.TrackCount = nil, len(songs)
+	for _, song := range songs {
+		album.SongIDs = append(album.SongIDs, song.ID)
+		album.TotalDuration += song.Song.Duration
+	}
+	album.TotalDuration = math.Round(album.TotalDuration*1000) / 1000
+
+	batch := firestoreClient.Batch()
+	if newArtist != nil {
+		batch.Set(firestoreClient.Collection("artists").Doc(artistId), newArtist)
+	}
+	batch.Set(firestoreClient.Collection("albums").Doc(albumId), album)
+	for _, song := range songs {
+		addSongWrites(firestoreClient, processor, batch, song)
+	}
+	services.CommitOutbox(firestoreClient, batch, entry)
+	if _, err := batch.Commit(ctx); err != nil {
+		services.CompensateOutbox(ctx, storage, firestoreClient, entry, fmt.Errorf("Failed to save album: %w", err))
+		for _, track := range songTracks {
+			track.Result = gin.H{"status": trackFailed, "error": fmt.Sprintf("Failed to save metadata: %v", err)}
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to save album: %v", err), "tracks": trackResults(tracks)})
+		return
+	}
+
+	processor.Notify()
+	for i, song := range songs {
+		songTracks[i].Result = gin.H{
+			"status":      trackCreated,
+			"songId":      song.ID,
+			"jobId":       song.Song.JobID,
+			"title":       song.Song.Title,
+			"trackNumber": song.Song.TrackNumber,
+		}
+	}
+	log.Printf("Album %s (%s) created with %d of %d tracks", albumId, albumTitle, len(songs), len(tracks))
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":  "Album uploaded",
+		"albumId":  albumId,
+		"title":    albumTitle,
+		"artistId": artistId,
+		"coverUrl": coverUrls["large"],
+		"created":  len(songs),
+		"total":    len(tracks),
+		"tracks":   trackResults(tracks),
+	})
+}
+
+func (t *albumTrack) reject(code, message string) {
+	t.Result = gin.H{"status": trackRejected, "code": code, "error": message}
+}
+
+// trackResults lists every submitted file in submission order with its outcome.
+func trackResults(tracks []*albumTrack) []gin.H {
+	results := make([]gin.H, len(tracks))
+	for i, track := range tracks {
+		result := gin.H{"index": track.Index, "filename": track.Filename}
+		for k, v := range track.Result {
+			result[k] = v
+		}
+		results[i] = result
+	}
+	return results
+}
+
+// orderAlbumTracks sorts by disc and track number when every track is tagged with one, otherwise by the
+// numbers leading the file names when every name has one, otherwise keeps the submission order.
+func orderAlbumTracks(tracks []*albumTrack) {
+	tagged, named := true, true
+	for _, t := range tracks {
+		if t.Tags.TrackNumber == 0 {
+			tagged = false
+		}
+		if _, n := fileTrackNumber(t.Filename); n == 0 {
+			named = false
+		}
+	}
+	sort.SliceStable(tracks, func(i, j int) bool {
+		a, b := tracks[i], tracks[j]
+		switch {
+		case tagged:
+			if a.Tags.DiscNumber != b.Tags.DiscNumber {
+				return a.Tags.DiscNumber < b.Tags.DiscNumber
+			}
+			return a.Tags.TrackNumber < b.Tags.TrackNumber
+		case named:
+			discA, trackA := fileTrackNumber(a.Filename)
+			discB, trackB := fileTrackNumber(b.Filename)
+			if discA != discB {
+				return discA < discB
+			}
+			return trackA < trackB
+		default:
+			return a.Index < b.Index
+		}
+	})
+}
+
+// albumTrackNumber numbers a track by its tags, else by its file name, else by its position in the album. Tags
+// and names keep the numbering of multi-disc albums, where every disc starts again at 1.
+func albumTrackNumber(t *albumTrack, position int) (disc, track int) {
+	if t.Tags.TrackNumber > 0 {
+		return t.Tags.DiscNumber, t.Tags.TrackNumber
+	}
+	if disc, track := fileTrackNumber(t.Filename); track > 0 {
+		return max(disc, t.Tags.DiscNumber), track
+	}
+	return t.Tags.DiscNumber, position + 1
+}
+
+func fileTrackNumber(filename string) (disc, track int) {
+	m := trackNumberPattern.FindStringSubmatch(filename)
+	if m == nil {
+		return 0, 0
+	}
+	disc, _ = strconv.Atoi(m[1])
+	track, _ = strconv.Atoi(m[2])
+	return disc, track
+}
+
+// extractAlbumArchive unpacks the audio entries of a ZIP into temporary files. Entries are read through the
+// file limit and what is left of the album budget, so a compressed bomb cannot fill the disk. Entries that are
+// not audio (booklets, cue sheets, logs) are skipped and do not count as tracks. An image named cover, folder
+// or front is returned as artwork.
+func extractAlbumArchive(fh *multipart.FileHeader, limit int64, budget *int64, firstIndex int, cleanup *[]func()) ([]*albumTrack, []byte, error) {
+	f, err := fh.Open()
+	if err != nil {
+		return nil, nil, err
+	}
+	*cleanup = append(*cleanup, func() { f.Close() })
+	zr, err := zip.NewReader(f, fh.Size)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var tracks []*albumTrack
+	var cover []byte
+	for _, entry := range zr.File {
+		name := path.Base(entry.Name)
+		if entry.FileInfo().IsDir() || strings.HasPrefix(entry.Name, "__MACOSX/") || strings.HasPrefix(name, ".") {
+			continue
+		}
+		if isArchiveCover(name) {
+			if cover == nil && entry.UncompressedSize64 <= maxCoverBytes {
+				cover, _ = readZipEntry(entry, maxCoverBytes)
+			}
+			continue
+		}
+		if !isAudioEntry(entry) {
+			continue
+		}
+		if len(tracks)+firstIndex >= maxAlbumTracks {
+			return nil, nil, fmt.Errorf("more than %d audio files", maxAlbumTracks)
+		}
+
+		track := &albumTrack{Index: firstIndex + len(tracks), Filename: name, Size: int64(entry.UncompressedSize64)}
+		tracks = append(tracks, track)
+		if track.Size > limit {
+			track.reject(UploadErrFileTooLarge, fmt.Sprintf("File is larger than the %d byte limit", limit))
+			continue
+		}
+		if track.Size > *budget {
+			return nil, nil, errors.New("the extracted files exceed the album size limit")
+		}
+		tmp, size, err := extractZipEntry(entry, min(limit, *budget))
+		if tmp != nil {
+			*cleanup = append(*cleanup, func() { tmp.Close(); os.Remove(tmp.Name()) })
+		}
+		if err != nil && *budget < limit {
+			return nil, nil, errors.New("the extracted files exceed the album size limit")
+		}
+		if err != nil {
+			track.reject(UploadErrFileTooLarge, err.Error())
+			continue
+		}
+		*budget -= size
+		track.File, track.Size = tmp, size
+	}
+	return tracks, cover, nil
+}
+
+func isArchiveCover(name string) bool {
+	ext := strings.ToLower(path.Ext(name))
+	if ext != ".jpg" && ext != ".jpeg" && ext != ".png" {
+		return false
+	}
+	switch strings.ToLower(strings.TrimSuffix(name, path.Ext(name))) {
+	case "cover", "folder", "front":
+		return true
+	}
+	return false
+}
+
+// isAudioEntry sniffs the first bytes of an entry.
+func isAudioEntry(entry *zip.File) bool {
+	head, err := readZipEntry(entry, audio.SniffLen)
+	return err == nil && audio.Sniff(head) != ""
+}
+
+func readZipEntry(entry *zip.File, limit int64) ([]byte, error) {
+	rc, err := entry.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(io.LimitReader(rc, limit))
+}
+
+// extractZipEntry copies an entry into a temporary file, failing when it inflates past limit
+// regardless of the size its header declares.
+func extractZipEntry(entry *zip.File, limit int64) (*os.File, int64, error) {
+	rc, err := entry.Open()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rc.Close()
+
+	tmp, err := os.CreateTemp("", "album-track-*")
+	if err != nil {
+		return nil, 0, err
+	}
+	n, err := io.Copy(tmp, io.LimitReader(rc, limit+1))
+	if err == nil && n > limit {
+		err = fmt.Errorf("file is larger than the %d byte limit", limit)
+	}
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	return tmp, n, err
+}
+
+// storeAlbumCover stores the album artwork once under albums/{albumId}/cover/ for all tracks to share.
+func storeAlbumCover(ctx context.Context, storage services.Storage, albumId string, uploaded image.Image, archiveCover []byte, tracks []*albumTrack, title, artist string) map[string]string {
+	img := uploaded
+	if img == nil && archiveCover != nil {
+		if decoded, err := services.DecodeCover(archiveCover); err == nil {
+			img = decoded
+		}
+	}
+	for _, track := range tracks {
+		if img != nil {
+			break
+		}
+		if track.Tags.Picture != nil {
+			if decoded, err := services.DecodeCover(track.Tags.Picture.Data); err == nil {
+				img = decoded
+			}
+		}
+	}
+	if img == nil {
+		img = utils.GenerateAvatar(title, artist, services.CoverSizes[len(services.CoverSizes)-1].Size)
+	}
+
+	urls, err := services.StoreCover(ctx, storage, services.AlbumPrefix(albumId), img)
+	if err != nil {
+		// Tracks fall back to covers of their own
+		log.Printf("Failed to store cover of album %s: %v", albumId, err)
+		return nil
+	}
+	return urls
+}
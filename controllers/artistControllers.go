@@ -0,0 +1,40 @@
+package controllers
+
+import (
+	"context"
+	"lipur_backend/models"
+	"lipur_backend/services"
+	"log"
+	"net/http"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+)
+
+// GetArtists lists artists by name, one page at a time (?limit, ?cursor).
+func GetArtists(c *gin.Context, firestoreClient *firestore.Client) {
+	limit, cursor, ok := pageParams(c)
+	if !ok {
+		return
+	}
+	page, err := services.Paginate(context.Background(), firestoreClient.Collection("artists").Query,
+		[]services.Order{{Field: "name", Direction: firestore.Asc}}, limit, cursor)
+	if err != nil {
+		respondPageError(c, "artists", err)
+		return
+	}
+
+	artists := []models.Artist{}
+	for _, doc := range page.Docs {
+		var artist models.Artist
+		if err := doc.DataTo(&artist); err != nil {
+			log.Printf("Skipping artist %s: %v", doc.Ref.ID, err)
+			continue
+		}
+		// Artists created before documents carried their ID
+		artist.ID = doc.Ref.ID
+		artists = append(artists, artist)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"artists": artists, "nextCursor": nextCursor(page)})
+}
@@ -0,0 +1,18 @@
+package controllers
+
+import (
+	"expvar"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DebugVars serves the runtime metrics published through expvar (e.g. b2_download_auth_cache) to admins.
+// They include the command line and memory statistics, so they are not public.
+func DebugVars(c *gin.Context) {
+	if !c.GetBool("admin") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only admins can read runtime metrics"})
+		return
+	}
+	expvar.Handler().ServeHTTP(c.Writer, c.Request)
+}
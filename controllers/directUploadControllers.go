@@ -0,0 +1,309 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"lipur_backend/audio"
+	"lipur_backend/services"
+	"lipur_backend/utils"
+	"lipur_backend/workers"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// directUploadTTL is how long a presigned upload stays usable.
+const directUploadTTL = 30 * time.Minute
+
+var sha1Pattern = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// pendingUpload is a direct-to-bucket upload between /uploads/init and /uploads/complete,
+// stored in pendingUploads/{songId}.
+type pendingUpload struct {
+	Key         string            `firestore:"key"`
+	Filename    string            `firestore:"filename"`
+	Size        int64             `firestore:"size"`
+	SHA1        string            `firestore:"sha1"`
+	ContentType string            `firestore:"contentType"`
+	Uid         string            `firestore:"uid"`
+	Fields      map[string]string `firestore:"fields"`
+	Status      string            `firestore:"status"` // "pending", "processing", "completed" or "failed"
+	Error       string            `firestore:"error,omitempty"`
+	SongID      string            `firestore:"songId"`
+	CreatedAt   time.Time         `firestore:"createdAt"`
+	ExpiresAt   time.Time         `firestore:"expiresAt"`
+	ClaimedAt   time.Time         `firestore:"claimedAt,omitempty"`
+}
+
+// InitDirectUpload reserves a song ID and object key and returns the request the client must send to the
+// bucket itself. The declared size and SHA-1 are checked again on completion.
+func InitDirectUpload(c *gin.Context, storage services.Storage, policy *services.UploadPolicy, firestoreClient *firestore.Client) {
+	uploader, ok := storage.(services.DirectUploader)
+	if !ok {
+		uploadError(c, http.StatusNotImplemented, UploadErrDirectUnsupported, "The configured storage backend does not support direct uploads, use POST /upload", nil)
+		return
+	}
+
+	var request struct {
+		Filename string            `json:"filename"`
+		Size     int64             `json:"size"`
+		SHA1     string            `json:"sha1"`
+		Metadata map[string]string `json:"metadata"` // same keys as the POST /upload form fields
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid request: %v", err)})
+		return
+	}
+	if request.Filename == "" {
+		uploadError(c, http.StatusBadRequest, UploadErrFileRequired, "Filename is required", nil)
+		return
+	}
+	if !sha1Pattern.MatchString(request.SHA1) {
+		uploadError(c, http.StatusBadRequest, UploadErrInvalidChecksum, "sha1 must be the lowercase hex SHA-1 of the file", nil)
+		return
+	}
+	if !checkUploadSize(c, policy, request.Size) {
+		return
+	}
+	// Only the name is known before the bytes arrive; the content is sniffed on completion
+	format := audio.FormatFromExtension(path.Ext(request.Filename))
+	if format == "" {
+		uploadError(c, http.StatusUnsupportedMediaType, UploadErrUnsupportedFormat,
+			"File is not a supported audio format (MP3, AAC, M4A, OGG, Opus, FLAC or WAV)", gin.H{"filename": request.Filename})
+		return
+	}
+
+	songId := uuid.New().String()
+	key := services.SongObjectKey(songId, "original"+audio.Extension(format))
+	contentType := audio.MIMEType(format)
+
+	ctx := context.Background()
+	direct, err := uploader.PrepareDirectUpload(ctx, key, contentType, request.Size, request.SHA1, directUploadTTL)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to prepare upload: %v", err)})
+		return
+	}
+
+	fields := map[string]string{}
+	for _, field := range songUploadFields {
+		if v := request.Metadata[field]; v != "" {
+			fields[field] = v
+		}
+	}
+	_, err = firestoreClient.Collection("pendingUploads").Doc(songId).Set(ctx, pendingUpload{
+		Key:         key,
+		Filename:    request.Filename,
+		Size:        request.Size,
+		SHA1:        request.SHA1,
+		ContentType: contentType,
+		Uid:         c.GetString("uid"),
+		Fields:      fields,
+		Status:      "pending",
+		CreatedAt:   time.Now(),
+		ExpiresAt:   direct.ExpiresAt,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to save upload: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"uploadId": songId,
+		"key":      key,
+		"upload":   direct,
+	})
+}
+
+// CompleteDirectUpload checks that the object the client uploaded exists with the declared size and SHA-1,
+// sniffs its content and creates the song through saveSong. The checksum comes from the backend and the tags
+// are read with ranged requests, so the object never passes through the API in full. Completing twice
+// returns the same song; a completion that is already running is answered with 409.
+func CompleteDirectUpload(c *gin.Context, storage services.Storage, processor *workers.SongProcessor, fingerprinter *services.Fingerprinter, firestoreClient *firestore.Client) {
+	var request struct {
+		UploadID string `json:"uploadId"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil || request.UploadID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "uploadId is required"})
+		return
+	}
+
+	ctx := context.Background()
+	pendingRef := firestoreClient.Collection("pendingUploads").Doc(request.UploadID)
+	pending, err := claimPendingUpload(ctx, firestoreClient, pendingRef, c.GetString("uid"))
+	var claimErr *pendingClaimError
+	if errors.As(err, &claimErr) {
+		switch claimErr.Status {
+		case "completed":
+			c.JSON(http.StatusOK, gin.H{"message": "Upload already completed", "songId": claimErr.Pending.SongID})
+		case "processing":
+			uploadError(c, http.StatusConflict, UploadErrInProgress, "The upload is already being completed", nil)
+		case "failed":
+			uploadError(c, http.StatusGone, UploadErrUploadFailed, "The upload failed and its file was removed, start a new upload",
+				gin.H{"reason": claimErr.Pending.Error})
+		default:
+			uploadError(c, http.StatusNotFound, UploadErrNotFound, "Upload not found", nil)
+		}
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to load upload: %v", err)})
+		return
+	}
+
+	// From here on this request owns the upload. It ends pending again (the client may still upload the file),
+	// completed, or failed once the object has been deleted.
+	release := func(status, reason string) {
+		updates := []firestore.Update{{Path: "status", Value: status}}
+		if reason != "" {
+			updates = append(updates, firestore.Update{Path: "error", Value: reason})
+		}
+		if _, err := pendingRef.Update(ctx, updates); err != nil {
+			log.Printf("Failed to mark upload %s %s: %v", request.UploadID, status, err)
+		}
+	}
+
+	info, err := storage.StatFile(ctx, pending.Key)
+	if errors.Is(err, services.ErrFileNotFound) {
+		release("pending", "")
+		uploadError(c, http.StatusConflict, UploadErrObjectMissing, "The file has not been uploaded to the bucket yet", gin.H{"key": pending.Key})
+		return
+	}
+	if err != nil {
+		release("pending", "")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to check uploaded file: %v", err)})
+		return
+	}
+
+	// Whatever fails verification is removed, so a rejected upload never lingers in the bucket
+	reject := func(status int, code, message string, details gin.H) {
+		if err := storage.DeleteFile(ctx, pending.Key); err != nil {
+			log.Printf("Failed to delete rejected upload %s: %v", pending.Key, err)
+		}
+		release("failed", message)
+		uploadError(c, status, code, message, details)
+	}
+	if info.Size != pending.Size {
+		reject(http.StatusUnprocessableEntity, UploadErrSizeMismatch, "Uploaded file size does not match the declared size",
+			gin.H{"expected": pending.Size, "actual": info.Size})
+		return
+	}
+
+	f := services.NewObjectReader(ctx, storage, pending.Key, info.Size)
+	defer f.Close()
+	if info.SHA1 == "" {
+		// The backend keeps no verified hash of this object; reading it through is the only way to check it
+		log.Printf("Storage reports no SHA-1 for %s, hashing it", pending.Key)
+		info.SHA1, err = utils.SHA1Hex(f)
+		if err == nil {
+			_, err = f.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			release("pending", "")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to read uploaded file: %v", err)})
+			return
+		}
+	}
+	if info.SHA1 != pending.SHA1 {
+		reject(http.StatusUnprocessableEntity, UploadErrChecksumMismatch, "Uploaded file does not match the declared SHA-1",
+			gin.H{"expected": pending.SHA1, "actual": info.SHA1})
+		return
+	}
+
+	format, ok := sniffUpload(c, f, info.Size)
+	if !ok {
+		if err := storage.DeleteFile(ctx, pending.Key); err != nil {
+			log.Printf("Failed to delete rejected upload %s: %v", pending.Key, err)
+		}
+		release("failed", "unsupported format")
+		return
+	}
+
+	result, err := saveSong(ctx, storage, processor, fingerprinter, firestoreClient, &songUpload{
+		File:     f,
+		Size:     info.Size,
+		Filename: pending.Filename,
+		Format:   format,
+		Fields:   pending.Fields,
+		SongID:   request.UploadID,
+		Stored:   info,
+		Uploader: pending.Uid,
+	})
+	if err != nil {
+		// saveSong's compensation deleted the object, so the upload cannot be completed any more
+		release("failed", err.Error())
+		respondSaveError(c, err)
+		return
+	}
+
+	_, err = pendingRef.Update(ctx, []firestore.Update{
+		{Path: "status", Value: "completed"},
+		{Path: "songId", Value: result["songId"]},
+	})
+	if err != nil {
+		log.Printf("Failed to mark upload %s completed: %v", request.UploadID, err)
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// completeClaimTimeout is how long a completion may hold an upload; after that it is assumed to have died
+// and another request may take over.
+const completeClaimTimeout = 10 * time.Minute
+
+// pendingClaimError explains why an upload could not be claimed, with the upload as it is.
+type pendingClaimError struct {
+	Status  string // "completed", "processing", "failed" or "" for not found
+	Pending *pendingUpload
+}
+
+func (e *pendingClaimError) Error() string {
+	if e.Status == "" {
+		return "upload not found"
+	}
+	return "upload is " + e.Status
+}
+
+// claimPendingUpload moves the upload from pending to processing in a transaction, so that only one request
+// completes it. Uploads of another user are reported as not found.
+func claimPendingUpload(ctx context.Context, firestoreClient *firestore.Client, pendingRef *firestore.DocumentRef, uid string) (*pendingUpload, error) {
+	var pending pendingUpload
+	err := firestoreClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(pendingRef)
+		if status.Code(err) == codes.NotFound {
+			return &pendingClaimError{}
+		}
+		if err != nil {
+			return err
+		}
+		pending = pendingUpload{}
+		if err := doc.DataTo(&pending); err != nil {
+			return err
+		}
+		if pending.Uid != "" && pending.Uid != uid {
+			return &pendingClaimError{}
+		}
+		switch {
+		case pending.Status == "completed", pending.Status == "failed":
+			return &pendingClaimError{Status: pending.Status, Pending: &pending}
+		case pending.Status == "processing" && time.Since(pending.ClaimedAt) < completeClaimTimeout:
+			return &pendingClaimError{Status: pending.Status, Pending: &pending}
+		}
+		return tx.Update(pendingRef, []firestore.Update{
+			{Path: "status", Value: "processing"},
+			{Path: "claimedAt", Value: time.Now()},
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &pending, nil
+}
@@ -0,0 +1,26 @@
+package controllers
+
+import (
+	"lipur_backend/services"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ServeLocalFile serves objects of the local storage backend for URLs produced by LocalStorage.GenerateSignedURL.
+// http.ServeFile takes care of Range requests, so players can seek.
+func ServeLocalFile(c *gin.Context, localStorage *services.LocalStorage) {
+	key := strings.TrimPrefix(c.Param("key"), "/")
+	if !localStorage.VerifySignedURL(key, c.Query("expires"), c.Query("sig")) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid or expired signature"})
+		return
+	}
+
+	filePath, err := localStorage.Path(key)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.File(filePath)
+}
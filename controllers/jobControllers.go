@@ -0,0 +1,61 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"lipur_backend/workers"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetJob returns a background job (see workers.JobQueue): its status, stage, progress and last error.
+// With ?stream=1 or Accept: text/event-stream, it instead sends a "job" server-sent event on every change
+// until the job succeeds or fails for good, or the client goes away.
+func GetJob(c *gin.Context, jobQueue *workers.JobQueue) {
+	jobId := c.Param("id")
+	job, err := jobQueue.Get(context.Background(), jobId)
+	if errors.Is(err, workers.ErrJobNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to get job: %v", err)})
+		return
+	}
+
+	if c.Query("stream") == "" && !strings.Contains(c.GetHeader("Accept"), "text/event-stream") {
+		c.JSON(http.StatusOK, job)
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.SSEvent("job", job)
+	c.Writer.Flush()
+	if job.Finished() {
+		return
+	}
+
+	// The listener's first snapshot is the current state again; it ends when the client disconnects
+	snapshots := jobQueue.Ref(jobId).Snapshots(c.Request.Context())
+	defer snapshots.Stop()
+	for {
+		snap, err := snapshots.Next()
+		if err != nil || !snap.Exists() {
+			return
+		}
+		var update workers.Job
+		if err := snap.DataTo(&update); err != nil {
+			return
+		}
+		c.SSEvent("job", update)
+		c.Writer.Flush()
+		if update.Finished() {
+			return
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Moderation flags (moderationFlags/{id}) are opened by uploads that sound like an existing song, when
+// FINGERPRINT_DUPLICATES is "flag". Admins review them here.
+
+// GetModerationFlags lists flags with the given ?status (default "open"), newest first. Admins only.
+func GetModerationFlags(c *gin.Context, firestoreClient *firestore.Client) {
+	if !c.GetBool("admin") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only admins can review flags"})
+		return
+	}
+
+	docs, err := firestoreClient.Collection("moderationFlags").
+		Where("status", "==", c.DefaultQuery("status", "open")).
+		Documents(context.Background()).GetAll()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to get flags: %v", err)})
+		return
+	}
+
+	flags := []map[string]interface{}{}
+	for _, doc := range docs {
+		flags = append(flags, doc.Data())
+	}
+	// Sorted here rather than in the query, which would need a composite index
+	sort.Slice(flags, func(i, j int) bool {
+		return flagCreatedAt(flags[i]).After(flagCreatedAt(flags[j]))
+	})
+	c.JSON(http.StatusOK, flags)
+}
+
+func flagCreatedAt(flag map[string]interface{}) time.Time {
+	t, _ := flag["createdAt"].(time.Time)
+	return t
+}
+
+// ResolveModerationFlag closes a flag as "confirmed" (the upload is a duplicate) or "dismissed". Admins only.
+// Deleting a confirmed duplicate is left to DELETE /songs/:id.
+func ResolveModerationFlag(c *gin.Context, firestoreClient *firestore.Client) {
+	if !c.GetBool("admin") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only admins can resolve flags"})
+		return
+	}
+	var request struct {
+		Status string `json:"status"`
+		Note   string `json:"note"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil || (request.Status != "confirmed" && request.Status != "dismissed") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": `status must be "confirmed" or "dismissed"`})
+		return
+	}
+
+	_, err := firestoreClient.Collection("moderationFlags").Doc(c.Param("id")).Update(context.Background(), []firestore.Update{
+		{Path: "status", Value: request.Status},
+		{Path: "note", Value: request.Note},
+		{Path: "resolvedBy", Value: c.GetString("uid")},
+		{Path: "resolvedAt", Value: time.Now()},
+	})
+	if status.Code(err) == codes.NotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Flag not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to resolve flag: %v", err)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Flag resolved", "id": c.Param("id"), "status": request.Status})
+}
@@ -0,0 +1,43 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"lipur_backend/services"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// pageParams reads ?limit (default services.DefaultPageSize, at most services.MaxPageSize) and the opaque
+// ?cursor returned as nextCursor by the previous page. It responds with 400 and returns false when invalid.
+func pageParams(c *gin.Context) (int, string, bool) {
+	limit := services.DefaultPageSize
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > services.MaxPageSize {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", services.MaxPageSize)})
+			return 0, "", false
+		}
+		limit = n
+	}
+	return limit, c.Query("cursor"), true
+}
+
+// respondPageError reports a failed services.Paginate: 400 for a bad cursor, 500 otherwise.
+func respondPageError(c *gin.Context, what string, err error) {
+	if errors.Is(err, services.ErrInvalidCursor) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to fetch %s: %v", what, err)})
+}
+
+// nextCursor is the nextCursor of a list response: null on the last page.
+func nextCursor(page *services.Page) interface{} {
+	if page.NextCursor == "" {
+		return nil
+	}
+	return page.NextCursor
+}
@@ -0,0 +1,65 @@
+package controllers
+
+import (
+	"fmt"
+	"lipur_backend/models"
+	"lipur_backend/search"
+	"lipur_backend/services"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Search finds songs and artists matching ?q by title, artist and album, tolerating typos and incomplete
+// words, best matches and most popular first. ?type=song|artist narrows the results, ?limit caps them.
+func Search(c *gin.Context, index *search.Index) {
+	query := strings.TrimSpace(c.Query("q"))
+	if query == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "q is required"})
+		return
+	}
+	typ := c.Query("type")
+	if typ != "" && typ != search.TypeSong && typ != search.TypeArtist {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "type must be song or artist"})
+		return
+	}
+	limit := services.DefaultPageSize
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > services.MaxPageSize {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", services.MaxPageSize)})
+			return
+		}
+		limit = n
+	}
+
+	// The index is loaded from Firestore at startup
+	if !index.Ready(search.TypeSong, search.TypeArtist) {
+		c.Header("Retry-After", "5")
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Search index is still loading"})
+		return
+	}
+
+	hits, total := index.Search(query, typ, limit)
+	results := make([]gin.H, 0, len(hits))
+	for _, hit := range hits {
+		result := gin.H{"type": hit.Document.Type, "id": hit.Document.ID, "score": hit.Score}
+		switch source := hit.Document.Source.(type) {
+		case *models.Song:
+			result["title"] = source.Title
+			result["artistName"] = source.ArtistName
+			result["artistId"] = source.ArtistID
+			result["album"] = source.Album
+			result["coverUrl"] = source.CoverURL
+			result["duration"] = source.Duration
+		case *models.Artist:
+			result["name"] = source.Name
+			result["profileImageUrl"] = source.ProfileImageURL
+		}
+		results = append(results, result)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"results": results, "total": total})
+}
@@ -0,0 +1,349 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"lipur_backend/models"
+	"lipur_backend/services"
+	"lipur_backend/utils"
+	"lipur_backend/workers"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DeleteSong removes a song's storage objects, its processing job, its Firestore document and every playlist
+// entry that references it.
+//
+// Progress is tracked in songDeletions/{id}: the record is written first and removed last, so a failure at any
+// step leaves a record that a retried DELETE (or a later reconciliation run) resumes from. Every step is idempotent.
+func DeleteSong(c *gin.Context, storage services.Storage, jobQueue *workers.JobQueue, firestoreClient *firestore.Client) {
+	uid := c.GetString("uid")
+	songId := c.Param("id")
+	ctx := context.Background()
+
+	deletionRef := firestoreClient.Collection("songDeletions").Doc(songId)
+	songDoc, err := firestoreClient.Collection("songs").Doc(songId).Get(ctx)
+	var fileName, hlsPlaylistKey, jobId string
+	switch {
+	case err == nil:
+		var song models.Song
+		if err := songDoc.DataTo(&song); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to read song: %v", err)})
+			return
+		}
+		if !canEditSong(c, &song) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only the uploader or an admin can delete this song"})
+			return
+		}
+		fileName, hlsPlaylistKey, jobId = song.FileName, song.HLSPlaylistKey, song.JobID
+
+		_, err = deletionRef.Set(ctx, map[string]interface{}{
+			"songId":         songId,
+			"fileName":       fileName,
+			"hlsPlaylistKey": hlsPlaylistKey,
+			"jobId":          jobId,
+			"requestedBy":    uid,
+			"startedAt":      time.Now(),
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to start deletion: %v", err)})
+			return
+		}
+	case status.Code(err) == codes.NotFound:
+		// The song document is gone; finish an earlier deletion if one was interrupted. Only whoever started it
+		// (or an admin) may, as the record is all that is left to check permissions against.
+		deletionDoc, err := deletionRef.Get(ctx)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Song not found"})
+			return
+		}
+		requestedBy, _ := deletionDoc.Data()["requestedBy"].(string)
+		if !c.GetBool("admin") && (uid == "" || requestedBy != uid) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only the uploader or an admin can delete this song"})
+			return
+		}
+		fileName, _ = deletionDoc.Data()["fileName"].(string)
+		hlsPlaylistKey, _ = deletionDoc.Data()["hlsPlaylistKey"].(string)
+		jobId, _ = deletionDoc.Data()["jobId"].(string)
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to fetch song: %v", err)})
+		return
+	}
+
+	fail := func(step string, err error) {
+		log.Printf("Deleting song %s failed at %s: %v", songId, step, err)
+		deletionRef.Update(ctx, []firestore.Update{
+			{Path: "failedStep", Value: step},
+			{Path: "lastError", Value: err.Error()},
+			{Path: "failedAt", Value: time.Now()},
+		})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to delete song (%s): %v. Retry the request to resume.", step, err)})
+	}
+
+	// 1. Cancel processing. A job that is already running stops at its next upload, as it finds the deletion record.
+	if jobId != "" {
+		if err := jobQueue.Delete(ctx, jobId); err != nil {
+			fail("job", err)
+			return
+		}
+	}
+
+	// 2. Drop the song from every playlist
+	removed, err := services.RemoveSongFromPlaylists(ctx, firestoreClient, songId)
+	if err != nil {
+		fail("playlists", err)
+		return
+	}
+
+	// 3. Delete the audio and its HLS rendition, each unless a deduplicated upload still points at it
+	audioInUse, err := referencedByOtherSong(ctx, firestoreClient, songId, "fileName", fileName)
+	if err != nil {
+		fail("storage", err)
+		return
+	}
+	hlsInUse, err := referencedByOtherSong(ctx, firestoreClient, songId, "hlsPlaylistKey", hlsPlaylistKey)
+	if err != nil {
+		fail("storage", err)
+		return
+	}
+	err = utils.Retry(3, 500*time.Millisecond, func() error {
+		if hlsPlaylistKey != "" && !hlsInUse {
+			if err := services.DeleteHLSRendition(ctx, storage, hlsPlaylistKey); err != nil {
+				return err
+			}
+		}
+		if fileName != "" && !audioInUse {
+			return storage.DeleteFile(ctx, fileName)
+		}
+		return nil
+	})
+	if err != nil {
+		fail("storage", err)
+		return
+	}
+
+	// 4. Everything else under the song's prefix belongs to it alone: cover renditions, waveforms, and whatever
+	// a processing job uploaded before it was stopped
+	keep := func(key string) bool {
+		return (audioInUse && key == fileName) || (hlsInUse && strings.HasPrefix(key, path.Dir(hlsPlaylistKey)+"/"))
+	}
+	if err := utils.Retry(3, 500*time.Millisecond, func() error {
+		keys, err := storage.ListFiles(ctx, services.SongPrefix(songId))
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if keep(key) {
+				continue
+			}
+			if err := storage.DeleteFile(ctx, key); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		fail("objects", err)
+		return
+	}
+
+	// 5. Delete the song document with its fingerprint, then the progress record
+	batch := firestoreClient.Batch()
+	batch.Delete(services.FingerprintRef(firestoreClient, songId))
+	batch.Delete(firestoreClient.Collection("songs").Doc(songId))
+	if _, err := batch.Commit(ctx); err != nil {
+		fail("song", err)
+		return
+	}
+	if _, err := deletionRef.Delete(ctx); err != nil {
+		log.Printf("Song %s deleted but its deletion record remains: %v", songId, err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":           "Song deleted",
+		"songId":            songId,
+		"playlistsAffected": removed,
+	})
+}
+
+// referencedByOtherSong reports whether a song other than songId has field set to value.
+func referencedByOtherSong(ctx context.Context, firestoreClient *firestore.Client, songId, field, value string) (bool, error) {
+	if value == "" {
+		return false, nil
+	}
+	docs, err := firestoreClient.Collection("songs").Where(field, "==", value).Limit(2).Documents(ctx).GetAll()
+	if err != nil {
+		return false, err
+	}
+	for _, doc := range docs {
+		if doc.Ref.ID != songId {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// StreamSong proxies a song's audio from the storage backend so clients never see bucket URLs or tokens.
+// Range, If-Range and conditional requests are handled by http.ServeContent, so players can seek.
+func StreamSong(c *gin.Context, storage services.Storage, firestoreClient *firestore.Client) {
+	songId := c.Param("id")
+	ctx := c.Request.Context()
+
+	songDoc, err := firestoreClient.Collection("songs").Doc(songId).Get(ctx)
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Song not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to fetch song: %v", err)})
+		return
+	}
+	var song models.Song
+	if err := songDoc.DataTo(&song); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to read song: %v", err)})
+		return
+	}
+	fileName := song.FileName
+
+	info, err := storage.StatFile(ctx, fileName)
+	if err != nil {
+		if errors.Is(err, services.ErrFileNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Audio file not found"})
+			return
+		}
+		c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("Failed to read audio file: %v", err)})
+		return
+	}
+
+	// The content hash is a stable strong validator; fall back to the backend's own ETag for legacy songs.
+	etag := info.ETag
+	if song.ContentSha1 != "" {
+		etag = song.ContentSha1
+	}
+	contentType := info.ContentType
+	if contentType == "" || contentType == "application/octet-stream" {
+		contentType = mime.TypeByExtension(path.Ext(fileName))
+	}
+	if contentType == "" {
+		contentType = "audio/mpeg"
+	}
+
+	c.Header("ETag", `"`+etag+`"`)
+	c.Header("Content-Type", contentType)
+	setLoudnessHeaders(c, &song)
+	c.Header("Accept-Ranges", "bytes")
+	c.Header("Cache-Control", "private, max-age=3600")
+
+	reader := services.NewObjectReader(ctx, storage, fileName, info.Size)
+	defer reader.Close()
+	http.ServeContent(c.Writer, c.Request, "", info.UpdatedAt, reader)
+
+	// Count a play when playback starts, not on every seek or cache revalidation
+	served := c.Writer.Status() == http.StatusOK || c.Writer.Status() == http.StatusPartialContent
+	if c.Request.Method == http.MethodGet && served && isPlaybackStart(c.GetHeader("Range")) {
+		_, err := songDoc.Ref.Update(context.Background(), []firestore.Update{
+			{Path: "playCount", Value: firestore.Increment(1)},
+			{Path: "lastPlayedAt", Value: time.Now()},
+		})
+		if err != nil {
+			log.Printf("Failed to record play of %s: %v", songId, err)
+		}
+	}
+}
+
+// GetSongWaveform serves a song's peaks for the seek bar, in audiowaveform's JSON (default) or binary format:
+// ?resolution=low|medium|high (default medium) and ?format=json|dat. Peaks never change once generated, so
+// responses are cacheable for a day and revalidated by ETag.
+func GetSongWaveform(c *gin.Context, storage services.Storage, firestoreClient *firestore.Client) {
+	songId := c.Param("id")
+	ctx := c.Request.Context()
+
+	resolution := c.DefaultQuery("resolution", "medium")
+	known := false
+	for _, r := range services.WaveformResolutions {
+		known = known || r.Name == resolution
+	}
+	if !known {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "resolution must be low, medium or high"})
+		return
+	}
+	format := c.DefaultQuery("format", "json")
+	contentType, ok := services.WaveformFormats[format]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be json or dat"})
+		return
+	}
+
+	songDoc, err := firestoreClient.Collection("songs").Doc(songId).Get(ctx)
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Song not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to fetch song: %v", err)})
+		return
+	}
+	var song models.Song
+	if err := songDoc.DataTo(&song); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to read song: %v", err)})
+		return
+	}
+	if song.Waveform == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Waveform not generated yet", "status": song.Status})
+		return
+	}
+
+	key := services.SongWaveformKey(songId, resolution, format)
+	info, err := storage.StatFile(ctx, key)
+	if err != nil {
+		if errors.Is(err, services.ErrFileNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Waveform file not found"})
+			return
+		}
+		c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("Failed to read waveform file: %v", err)})
+		return
+	}
+
+	c.Header("ETag", `"`+info.ETag+`"`)
+	c.Header("Content-Type", contentType)
+	c.Header("Cache-Control", "private, max-age=86400")
+
+	reader := services.NewObjectReader(ctx, storage, key, info.Size)
+	defer reader.Close()
+	http.ServeContent(c.Writer, c.Request, "", info.UpdatedAt, reader)
+}
+
+// setLoudnessHeaders adds the ReplayGain (dB, linear peaks) and EBU R128 (LUFS, dBTP) values of a song that
+// has been analyzed, for players that only see the audio.
+func setLoudnessHeaders(c *gin.Context, song *models.Song) {
+	if song == nil || song.ReplayGain == nil || song.Loudness == nil {
+		return
+	}
+	headers := map[string]float64{
+		"X-ReplayGain-Track-Gain": song.ReplayGain.TrackGain,
+		"X-ReplayGain-Track-Peak": song.ReplayGain.TrackPeak,
+		"X-ReplayGain-Album-Gain": song.ReplayGain.AlbumGain,
+		"X-ReplayGain-Album-Peak": song.ReplayGain.AlbumPeak,
+		"X-Loudness-Integrated":   song.Loudness.Integrated,
+		"X-Loudness-True-Peak":    song.Loudness.TruePeak,
+	}
+	for header, v := range headers {
+		c.Header(header, strconv.FormatFloat(v, 'f', -1, 64))
+	}
+}
+
+// isPlaybackStart reports whether a Range header asks for the whole file: none at all, or the open-ended
+// "bytes=0-" players send first. "bytes=0-1" probes and multi-range requests are not playback.
+func isPlaybackStart(rangeHeader string) bool {
+	return rangeHeader == "" || strings.TrimSpace(rangeHeader) == "bytes=0-"
+}
@@ -0,0 +1,263 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"lipur_backend/models"
+	"lipur_backend/services"
+	"lipur_backend/utils"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// GetSong returns one song.
+func GetSong(c *gin.Context, firestoreClient *firestore.Client) {
+	song, ok := loadSong(c, firestoreClient, c.Param("id"))
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, song)
+}
+
+// songEdit is the body of PATCH /songs/:id, as JSON or as a multipart form that may carry a "cover" image.
+// Fields that are left out stay as they are.
+type songEdit struct {
+	Title       *string `json:"title" form:"title"`
+	Genre       *string `json:"genre" form:"genre"`
+	CreatedYear *string `json:"createdYear" form:"createdYear"`
+	Artist      *string `json:"artist" form:"artist"`     // artist name; an artist of that name is reused, else created
+	ArtistID    *string `json:"artistId" form:"artistId"` // an existing artist, instead of artist
+	CoverURL    *string `json:"coverUrl" form:"coverUrl"` // "" goes back to a generated placeholder
+}
+
+// UpdateSong edits a song's title, genre, year, artist or cover. Only the uploader (by verified uid, not by
+// upload_user) or an admin may edit. The playlist copies of the song are updated as well; if that fails, the
+// song itself is already changed and repeating the request finishes the job.
+func UpdateSong(c *gin.Context, storage services.Storage, firestoreClient *firestore.Client) {
+	songId := c.Param("id")
+	ctx := context.Background()
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxCoverBytes+multipartOverhead)
+	var edit songEdit
+	if err := c.ShouldBind(&edit); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid request body: %v", err)})
+		return
+	}
+	if edit.Artist != nil && edit.ArtistID != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Send either artist or artistId, not both"})
+		return
+	}
+	var cover image.Image
+	if c.ContentType() == "multipart/form-data" {
+		var ok bool
+		if cover, ok = readCoverPart(c); !ok {
+			return
+		}
+	}
+	if edit.CoverURL != nil && *edit.CoverURL != "" {
+		if u, err := url.Parse(*edit.CoverURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "coverUrl must be an http or https URL"})
+			return
+		}
+	}
+	if edit == (songEdit{}) && cover == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Nothing to update"})
+		return
+	}
+
+	song, ok := loadSong(c, firestoreClient, songId)
+	if !ok {
+		return
+	}
+	if !canEditSong(c, song) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the uploader or an admin can edit this song"})
+		return
+	}
+	before := *song
+
+	if edit.Title != nil {
+		song.Title = strings.TrimSpace(*edit.Title)
+	}
+	if edit.Genre != nil {
+		song.Genre = strings.TrimSpace(*edit.Genre)
+	}
+	if edit.CreatedYear != nil {
+		song.CreatedYear = strings.TrimSpace(*edit.CreatedYear)
+	}
+
+	// The artist is either picked by ID or named; a name is matched against existing artists first
+	var newArtist *models.Artist
+	switch {
+	case edit.ArtistID != nil:
+		artistDoc, err := firestoreClient.Collection("artists").Doc(*edit.ArtistID).Get(ctx)
+		if status.Code(err) == codes.NotFound {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Artist not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to fetch artist: %v", err)})
+			return
+		}
+		var artist models.Artist
+		if err := artistDoc.DataTo(&artist); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to read artist: %v", err)})
+			return
+		}
+		song.ArtistID, song.ArtistName = artistDoc.Ref.ID, artist.Name
+	case edit.Artist != nil && strings.TrimSpace(*edit.Artist) != song.ArtistName:
+		name := strings.TrimSpace(*edit.Artist)
+		existing, err := firestoreClient.Collection("artists").Where("name", "==", name).Limit(1).Documents(ctx).GetAll()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to look up artist: %v", err)})
+			return
+		}
+		if len(existing) > 0 {
+			song.ArtistID = existing[0].Ref.ID
+		} else {
+			newArtist = models.NewArtist(uuid.New().String(), name)
+			song.ArtistID = newArtist.ID
+		}
+		song.ArtistName = name
+	}
+
+	if newArtist != nil {
+		if err := newArtist.Validate(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "fields": err.(*models.ValidationError).Fields})
+			return
+		}
+	}
+	if err := validateSongEdit(song, &edit); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "fields": err.Fields})
+		return
+	}
+
+	// Covers: an uploaded image or a URL replaces the current one. Placeholders show the title and artist, so
+	// they are drawn again when either changes.
+	coverSource := "upload"
+	renamed := song.Title != before.Title || song.ArtistName != before.ArtistName
+	switch {
+	case cover != nil:
+	case edit.CoverURL != nil && *edit.CoverURL != "":
+		song.CoverURL, song.CoverURLs, song.CoverSource = *edit.CoverURL, nil, "url"
+	case edit.CoverURL != nil || (renamed && song.CoverSource == "placeholder"):
+		cover = utils.GenerateAvatar(song.Title, song.ArtistName, services.CoverSizes[len(services.CoverSizes)-1].Size)
+		coverSource = "placeholder"
+	}
+	if cover != nil {
+		urls, err := services.StoreCover(ctx, storage, services.SongPrefix(songId), cover)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to store cover: %v", err)})
+			return
+		}
+		song.CoverURL, song.CoverURLs, song.CoverSource = urls["large"], urls, coverSource
+	}
+
+	// Only the editable fields are written, so processing results stored meanwhile are kept
+	var coverURLs interface{} = song.CoverURLs
+	if song.CoverURLs == nil {
+		coverURLs = firestore.Delete
+	}
+	batch := firestoreClient.Batch()
+	if newArtist != nil {
+		batch.Create(firestoreClient.Collection("artists").Doc(newArtist.ID), newArtist)
+	}
+	batch.Update(firestoreClient.Collection("songs").Doc(songId), []firestore.Update{
+		{Path: "title", Value: song.Title},
+		{Path: "genre", Value: song.Genre},
+		{Path: "createdYear", Value: song.CreatedYear},
+		{Path: "artistId", Value: song.ArtistID},
+		{Path: "artistName", Value: song.ArtistName},
+		{Path: "coverUrl", Value: song.CoverURL},
+		{Path: "coverUrls", Value: coverURLs},
+		{Path: "coverSource", Value: song.CoverSource},
+	})
+	if _, err := batch.Commit(ctx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to update song: %v", err)})
+		return
+	}
+
+	// Renditions of this song's own cover are orphaned once it points at a URL (album covers are shared)
+	if song.CoverSource == "url" && before.CoverURLs != nil && before.CoverSource != "album" {
+		if err := services.DeleteCover(ctx, storage, services.SongPrefix(songId)); err != nil {
+			log.Printf("Failed to delete old cover of song %s: %v", songId, err)
+		}
+	}
+
+	updated, err := services.UpdateSongInPlaylists(ctx, firestoreClient, songId, func(entry *models.Song) {
+		entry.Title, entry.Genre, entry.CreatedYear = song.Title, song.Genre, song.CreatedYear
+		entry.ArtistID, entry.ArtistName = song.ArtistID, song.ArtistName
+		entry.CoverURL, entry.CoverURLs, entry.CoverSource = song.CoverURL, song.CoverURLs, song.CoverSource
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Song updated, but updating its playlists failed: %v. Retry the request to finish.", err)})
+		return
+	}
+	log.Printf("Song %s edited by %s, %d playlists updated", songId, c.GetString("uid"), updated)
+
+	c.JSON(http.StatusOK, song)
+}
+
+// validateSongEdit validates the fields edit changes. Songs stored before validation existed may break rules in
+// fields the edit leaves alone (early uploads saved createdYear as a code snippet), which must not block it.
+func validateSongEdit(song *models.Song, edit *songEdit) *models.ValidationError {
+	err := song.Validate()
+	if err == nil {
+		return nil
+	}
+	edited := map[string]bool{
+		"title":       edit.Title != nil,
+		"genre":       edit.Genre != nil,
+		"createdYear": edit.CreatedYear != nil,
+		"artistName":  edit.Artist != nil || edit.ArtistID != nil,
+		"artistId":    edit.Artist != nil || edit.ArtistID != nil,
+	}
+	invalid := err.(*models.ValidationError)
+	for field := range invalid.Fields {
+		if !edited[field] {
+			delete(invalid.Fields, field)
+		}
+	}
+	if len(invalid.Fields) == 0 {
+		return nil
+	}
+	return invalid
+}
+
+// loadSong fetches songs/{songId}, responding with 404 or 500 and returning false when it cannot.
+func loadSong(c *gin.Context, firestoreClient *firestore.Client, songId string) (*models.Song, bool) {
+	songDoc, err := firestoreClient.Collection("songs").Doc(songId).Get(context.Background())
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Song not found"})
+			return nil, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to fetch song: %v", err)})
+		return nil, false
+	}
+	var song models.Song
+	if err := songDoc.DataTo(&song); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to read song: %v", err)})
+		return nil, false
+	}
+	song.ID = songDoc.Ref.ID
+	return &song, true
+}
+
+// canEditSong reports whether the authenticated user may change or delete song: admins always, others only
+// songs they uploaded while signed in. The client-supplied upload_user field is not proof of anything.
+func canEditSong(c *gin.Context, song *models.Song) bool {
+	if c.GetBool("admin") {
+		return true
+	}
+	uid := c.GetString("uid")
+	return uid != "" && song.UploaderUID == uid
+}
@@ -0,0 +1,57 @@
+package controllers
+
+import (
+	"lipur_backend/models"
+	"maps"
+	"slices"
+	"testing"
+)
+
+func TestValidateSongEdit(t *testing.T) {
+	// As the first version of POST /upload stored songs uploaded without a year
+	legacy := func() *models.Song {
+		return &models.Song{
+			ID:          "legacy",
+			Title:       "Old Song",
+			ArtistName:  "Someone",
+			ArtistID:    "artist-1",
+			CreatedYear: `time.Now().Format("2006")`,
+			FileName:    "old song.mp3",
+			UploadUser:  "admin",
+		}
+	}
+	str := func(s string) *string { return &s }
+
+	tests := []struct {
+		name  string
+		apply func(*models.Song)
+		edit  songEdit
+		want  []string // fields reported invalid
+	}{
+		{"title only", func(s *models.Song) { s.Title = "New Title" }, songEdit{Title: str("New Title")}, nil},
+		{"genre only", func(s *models.Song) { s.Genre = "Rock" }, songEdit{Genre: str("Rock")}, nil},
+		{"year fixed", func(s *models.Song) { s.CreatedYear = "1999" }, songEdit{CreatedYear: str("1999")}, nil},
+		{"year cleared", func(s *models.Song) { s.CreatedYear = "" }, songEdit{CreatedYear: str("")}, nil},
+		{"invalid year", func(s *models.Song) { s.CreatedYear = "99" }, songEdit{CreatedYear: str("99")}, []string{"createdYear"}},
+		{"empty title", func(s *models.Song) { s.Title = "" }, songEdit{Title: str("")}, []string{"title"}},
+		{
+			"empty title and untouched legacy year",
+			func(s *models.Song) { s.Title, s.Genre = "", "Pop" },
+			songEdit{Title: str(""), Genre: str("Pop")},
+			[]string{"title"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			song := legacy()
+			tt.apply(song)
+			var got []string
+			if err := validateSongEdit(song, &tt.edit); err != nil {
+				got = slices.Sorted(maps.Keys(err.Fields))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("invalid fields = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,433 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"lipur_backend/audio"
+	"lipur_backend/models"
+	"lipur_backend/services"
+	"lipur_backend/utils"
+	"lipur_backend/workers"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// songUpload is a fully received audio file together with the metadata the client sent with it,
+// whether it arrived as a multipart form or through a resumable upload.
+type songUpload struct {
+	File     songFile
+	Size     int64
+	Filename string
+	Format   string            // sniffed by sniffUpload
+	Fields   map[string]string // title, artist, artistId, genre, createdYear, album, upload_user, coverUrl
+	Cover    image.Image       // uploaded artwork, nil when none was sent
+	Uploader string            // authenticated uid of the uploader, "" for anonymous uploads
+
+	// Set for direct-to-bucket uploads: the song ID reserved at init and the object the client already stored
+	SongID string
+	Stored *services.FileInfo
+
+	// Set for album tracks: tags probed while ordering the tracks, the album's position and shared cover
+	Tags        *audio.Metadata
+	AlbumID     string
+	TrackNumber int
+	DiscNumber  int
+	SharedCover map[string]string
+}
+
+type songFile interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+}
+
+// songUploadFields are the client-supplied metadata keys saveSong understands.
+var songUploadFields = []string{"title", "artist", "artistId", "genre", "createdYear", "album", "upload_user", "coverUrl"}
+
+// preparedSong is an upload whose audio and cover are stored and whose documents are ready to be written.
+type preparedSong struct {
+	ID          string
+	Song        *models.Song           // songs/{ID}
+	NewArtist   *models.Artist         // nil when the artist already exists
+	Fingerprint map[string]interface{} // fingerprints/{ID}, nil when the song was not fingerprinted
+	Flag        map[string]interface{} // moderationFlags/{Flag["id"]} for a near-duplicate, else nil
+	Response    gin.H
+}
+
+// nearDuplicateError rejects an upload that sounds like an existing song (FINGERPRINT_DUPLICATES=reject).
+type nearDuplicateError struct {
+	Match *services.FingerprintMatch
+}
+
+func (e *nearDuplicateError) Error() string {
+	return fmt.Sprintf("Upload sounds like existing song %s", e.Match.SongID)
+}
+
+// respondSaveError reports a failed saveSong: 400 for invalid metadata, 409 for near-duplicates,
+// 500 for everything else.
+func respondSaveError(c *gin.Context, err error) {
+	var invalid *models.ValidationError
+	if errors.As(err, &invalid) {
+		uploadError(c, http.StatusBadRequest, UploadErrInvalidMetadata, err.Error(), gin.H{"fields": invalid.Fields})
+		return
+	}
+	var nearDuplicate *nearDuplicateError
+	if errors.As(err, &nearDuplicate) {
+		uploadError(c, http.StatusConflict, UploadErrDuplicateAudio, err.Error(), gin.H{
+			"songId":     nearDuplicate.Match.SongID,
+			"similarity": nearDuplicate.Match.Similarity,
+		})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+}
+
+// saveSong stores an accepted upload (or links it to identical content already stored), then writes the song
+// and, if needed, its new artist in one batch. If anything fails after the first object is stored, the objects
+// are deleted again; the outbox entry records the outcome. It returns the response body for the client.
+func saveSong(ctx context.Context, storage services.Storage, processor *workers.SongProcessor, fingerprinter *services.Fingerprinter, firestoreClient *firestore.Client, u *songUpload) (gin.H, error) {
+	u.resolve()
+	entry := services.NewOutboxEntry("song")
+	entry.Objects = songObjectKeys(u)
+	entry.Documents = []string{"songs/" + u.SongID}
+	if err := services.BeginOutbox(ctx, firestoreClient, entry); err != nil {
+		return nil, fmt.Errorf("Failed to record upload: %w", err)
+	}
+
+	song, err := prepareSong(ctx, storage, processor, fingerprinter, firestoreClient, u)
+	if err != nil {
+		services.CompensateOutbox(ctx, storage, firestoreClient, entry, err)
+		return nil, err
+	}
+
+	batch := firestoreClient.Batch()
+	addSongWrites(firestoreClient, processor, batch, song)
+	services.CommitOutbox(firestoreClient, batch, entry)
+	if _, err := batch.Commit(ctx); err != nil {
+		err = fmt.Errorf("Failed to save metadata: %w", err)
+		services.CompensateOutbox(ctx, storage, firestoreClient, entry, err)
+		return nil, err
+	}
+	processor.Notify()
+	return song.Response, nil
+}
+
+// resolve fills in what the object keys depend on: the tags (and with them the real format) and the song ID.
+func (u *songUpload) resolve() {
+	if u.Tags == nil {
+		u.Tags = probeUpload(u)
+	}
+	if u.SongID == "" {
+		u.SongID = uuid.New().String()
+	}
+}
+
+func (u *songUpload) format() string {
+	if u.Tags != nil && u.Tags.Format != "" {
+		return u.Tags.Format
+	}
+	return u.Format
+}
+
+func (u *songUpload) fileKey() string {
+	if u.Stored != nil {
+		return u.Stored.Key
+	}
+	return services.SongObjectKey(u.SongID, "original"+audio.Extension(u.format()))
+}
+
+// songObjectKeys lists every object prepareSong may store for u: the audio and, unless the album's is shared,
+// the cover renditions. A deduplicated upload stores no audio; deleting its unused key is harmless.
+func songObjectKeys(u *songUpload) []string {
+	keys := []string{u.fileKey()}
+	if u.SharedCover == nil {
+		for _, size := range services.CoverSizes {
+			keys = append(keys, services.CoverKey(services.SongPrefix(u.SongID), size.Size))
+		}
+	}
+	return keys
+}
+
+// addSongWrites adds the documents of a prepared song to batch: its new artist if any, its processing job
+// (linked from the song, and only visible together with it), the song, its fingerprint and a near-duplicate flag.
+func addSongWrites(firestoreClient *firestore.Client, processor *workers.SongProcessor, batch *firestore.WriteBatch, song *preparedSong) {
+	if song.NewArtist != nil {
+		batch.Set(firestoreClient.Collection("artists").Doc(song.NewArtist.ID), song.NewArtist)
+	}
+	job := processor.Schedule(batch, song.ID)
+	song.Song.JobID = job.ID
+	song.Response["jobId"] = job.ID
+	batch.Set(firestoreClient.Collection("songs").Doc(song.ID), song.Song)
+	if song.Fingerprint != nil {
+		batch.Set(services.FingerprintRef(firestoreClient, song.ID), song.Fingerprint)
+	}
+	if song.Flag != nil {
+		batch.Set(firestoreClient.Collection("moderationFlags").Doc(song.Flag["id"].(string)), song.Flag)
+	}
+}
+
+// probeUpload reads tags and stream properties from the file itself; a file we cannot parse is still accepted.
+func probeUpload(u *songUpload) *audio.Metadata {
+	tags, err := audio.Probe(u.File, u.Size)
+	if err != nil {
+		log.Printf("Could not read audio metadata of %s: %v", u.Filename, err)
+		return &audio.Metadata{}
+	}
+	return tags
+}
+
+// prepareSong does everything for an upload except the Firestore writes: probing, validation, deduplication,
+// storing the audio and cover, and building the song (and possibly artist) document.
+func prepareSong(ctx context.Context, storage services.Storage, processor *workers.SongProcessor, fingerprinter *services.Fingerprinter, firestoreClient *firestore.Client, u *songUpload) (*preparedSong, error) {
+	u.resolve()
+	tags, format := u.Tags, u.format()
+
+	// Generate artistId if not provided
+	var newArtist *models.Artist
+	artistId := u.Fields["artistId"]
+	artistName := firstNonEmpty(u.Fields["artist"], tags.Artist, tags.AlbumArtist, "Unknown Artist")
+	if artistId == "" {
+		artistId = uuid.New().String()
+		newArtist = models.NewArtist(artistId, artistName)
+	}
+
+	trackNumber, discNumber := tags.TrackNumber, tags.DiscNumber
+	if u.TrackNumber > 0 {
+		trackNumber, discNumber = u.TrackNumber, u.DiscNumber
+	}
+
+	// Values sent by the client take precedence over the file's own tags. The song is checked before anything
+	// is stored; storage fills in the rest below.
+	song := &models.Song{
+		ID:               u.SongID,
+		Title:            firstNonEmpty(u.Fields["title"], tags.Title, u.Filename),
+		ArtistName:       artistName,
+		ArtistID:         artistId,
+		Album:            firstNonEmpty(u.Fields["album"], tags.Album),
+		AlbumID:          u.AlbumID,
+		TrackNumber:      trackNumber,
+		DiscNumber:       discNumber,
+		Genre:            firstNonEmpty(u.Fields["genre"], tags.Genre, "Unknown"),
+		CreatedYear:      firstNonEmpty(u.Fields["createdYear"], tags.Year, time.Now().Format("2006")),
+		FileName:         u.fileKey(),
+		OriginalFileName: u.Filename,
+		ContentType:      audio.MIMEType(format),
+		Format:           format,
+		Duration:         math.Round(tags.Duration.Seconds()*1000) / 1000,
+		Bitrate:          tags.Bitrate / 1000,
+		SampleRate:       tags.SampleRate,
+		Channels:         tags.Channels,
+		UploadUser:       firstNonEmpty(u.Fields["upload_user"], "admin"),
+		UploaderUID:      u.Uploader,
+		UploadedAt:       time.Now(),
+		Status:           workers.SongProcessing,
+	}
+	if newArtist != nil {
+		if err := newArtist.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	if err := song.Validate(); err != nil {
+		return nil, err
+	}
+
+	// Hash the content up front so identical bytes are linked to the existing object instead of stored again.
+	// Objects already in the bucket come with the hash the backend verified.
+	var contentSha1 string
+	var err error
+	if u.Stored != nil && u.Stored.SHA1 != "" {
+		contentSha1 = u.Stored.SHA1
+	} else {
+		contentSha1, err = utils.SHA1Hex(u.File)
+		if err == nil {
+			_, err = u.File.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read file: %w", err)
+		}
+	}
+	song.ContentSha1 = contentSha1
+
+	duplicates, err := firestoreClient.Collection("songs").Where("contentSha1", "==", contentSha1).Limit(1).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to check for duplicates: %w", err)
+	}
+	var existing *models.Song
+	if len(duplicates) > 0 {
+		existing = &models.Song{}
+		if err := duplicates[0].DataTo(existing); err != nil {
+			return nil, fmt.Errorf("Failed to read song %s: %w", duplicates[0].Ref.ID, err)
+		}
+	}
+
+	// Re-encodes of an existing recording get past the byte hash; compare how they sound
+	var fingerprint []uint32
+	var nearDuplicate *services.FingerprintMatch
+	if existing == nil && fingerprinter.Enabled() && song.Duration > 0 {
+		fingerprint, nearDuplicate = matchFingerprint(ctx, storage, fingerprinter, firestoreClient, u, song.Duration)
+		if nearDuplicate != nil && fingerprinter.Policy == services.DuplicatesReject {
+			return nil, &nearDuplicateError{Match: nearDuplicate}
+		}
+	}
+
+	if existing != nil {
+		// Share the original's audio and HLS rendition
+		song.DuplicateOf = duplicates[0].Ref.ID
+		song.FileName, song.FileURL = existing.FileName, existing.FileURL
+		song.HLSStatus, song.HLSPlaylistKey = existing.HLSStatus, existing.HLSPlaylistKey
+		song.HLSPlaylistURL, song.HLSPrefix = existing.HLSPlaylistURL, existing.HLSPrefix
+		log.Printf("Upload matches song %s (sha1 %s), reusing %s", song.DuplicateOf, contentSha1, song.FileName)
+		if u.Stored != nil && u.Stored.Key != song.FileName {
+			if err := storage.DeleteFile(ctx, u.Stored.Key); err != nil {
+				log.Printf("Failed to delete duplicate object %s: %v", u.Stored.Key, err)
+			}
+		}
+	} else {
+		if u.Stored != nil {
+			song.FileURL = u.Stored.URL
+		} else {
+			// Stream the file to the configured storage backend
+			fileInfo, err := storage.UploadFile(ctx, song.FileName, u.File, u.Size, song.ContentType)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to upload file: %w", err)
+			}
+			if fileInfo.SHA1 != "" && fileInfo.SHA1 != contentSha1 {
+				return nil, errors.New("Uploaded content does not match its checksum")
+			}
+			song.FileURL = fileInfo.URL
+		}
+		if processor.HLSEnabled() {
+			song.HLSStatus = workers.HLSPending
+		}
+	}
+
+	// Generate signed URL
+	signedUrl, err := storage.GenerateSignedURL(ctx, song.FileName, time.Hour)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to generate signed URL: %w", err)
+	}
+
+	song.CoverURL, song.CoverURLs, song.CoverSource = storeSongCover(ctx, storage, song.ID, u, tags, song.Title, song.ArtistName)
+
+	var fingerprintDoc, flag map[string]interface{}
+	if fingerprint != nil {
+		fingerprintDoc = services.FingerprintDoc(fingerprint, song.Duration)
+	}
+	if nearDuplicate != nil {
+		song.NearDuplicateOf = nearDuplicate.SongID
+		song.NearDuplicateSimilarity = math.Round(nearDuplicate.Similarity*1000) / 1000
+		flag = map[string]interface{}{
+			"id":          uuid.New().String(),
+			"type":        "nearDuplicate",
+			"songId":      song.ID,
+			"matchSongId": nearDuplicate.SongID,
+			"similarity":  song.NearDuplicateSimilarity,
+			"status":      "open",
+			"upload_user": song.UploadUser,
+			"createdAt":   time.Now(),
+		}
+	}
+
+	response := gin.H{
+		"message":      "File uploaded successfully",
+		"songId":       song.ID,
+		"publicUrl":    song.FileURL,
+		"signedUrl":    signedUrl,
+		"filename":     u.Filename,
+		"fileKey":      song.FileName,
+		"contentSha1":  contentSha1,
+		"deduplicated": song.DuplicateOf != "",
+		"title":        song.Title,
+		"artist":       song.ArtistName,
+		"duration":     song.Duration,
+		"coverUrl":     song.CoverURL,
+		"status":       song.Status,
+	}
+	if nearDuplicate != nil {
+		response["nearDuplicateOf"] = nearDuplicate.SongID
+	}
+	return &preparedSong{ID: song.ID, Song: song, NewArtist: newArtist, Fingerprint: fingerprintDoc, Flag: flag, Response: response}, nil
+}
+
+// matchFingerprint fingerprints the upload and looks for an existing song that sounds the same.
+// Fingerprinting problems are logged and never fail the upload.
+func matchFingerprint(ctx context.Context, storage services.Storage, fingerprinter *services.Fingerprinter, firestoreClient *firestore.Client, u *songUpload, duration float64) ([]uint32, *services.FingerprintMatch) {
+	var fingerprint []uint32
+	var err error
+	if u.Stored != nil {
+		// Already in the bucket: let ffmpeg fetch the part it decodes rather than copying the whole object here
+		var signedUrl string
+		if signedUrl, err = storage.GenerateSignedURL(ctx, u.Stored.Key, 10*time.Minute); err == nil {
+			fingerprint, err = fingerprinter.ComputeURL(ctx, signedUrl)
+		}
+	} else {
+		fingerprint, err = fingerprinter.Compute(ctx, u.File, u.Size)
+	}
+	if err != nil {
+		log.Printf("Could not fingerprint %s: %v", u.Filename, err)
+		return nil, nil
+	}
+	if fingerprint == nil {
+		return nil, nil
+	}
+	match, err := fingerprinter.FindMatch(ctx, firestoreClient, fingerprint, duration)
+	if err != nil {
+		log.Printf("Could not check %s for near-duplicates: %v", u.Filename, err)
+		return fingerprint, nil
+	}
+	if match != nil {
+		log.Printf("Upload %s sounds like song %s (similarity %.3f)", u.Filename, match.SongID, match.Similarity)
+	}
+	return fingerprint, match
+}
+
+// storeSongCover picks the song's artwork (the uploaded image, else the picture embedded in the file, else the
+// client's coverUrl, else a rendered initials placeholder) and stores its resized renditions.
+// Artwork problems are logged and never fail the upload.
+func storeSongCover(ctx context.Context, storage services.Storage, songId string, u *songUpload, tags *audio.Metadata, title, artist string) (string, map[string]string, string) {
+	if u.SharedCover != nil {
+		return u.SharedCover["large"], u.SharedCover, "album"
+	}
+	img, source := u.Cover, "upload"
+	if img == nil && tags.Picture != nil {
+		decoded, err := services.DecodeCover(tags.Picture.Data)
+		if err != nil {
+			log.Printf("Ignoring embedded artwork of song %s: %v", songId, err)
+		} else {
+			img, source = decoded, "embedded"
+		}
+	}
+	if img == nil {
+		if coverUrl := u.Fields["coverUrl"]; coverUrl != "" {
+			return coverUrl, nil, "url"
+		}
+		img, source = utils.GenerateAvatar(title, artist, services.CoverSizes[len(services.CoverSizes)-1].Size), "placeholder"
+	}
+
+	urls, err := services.StoreCover(ctx, storage, services.SongPrefix(songId), img)
+	if err != nil {
+		log.Printf("Failed to store cover of song %s: %v", songId, err)
+		return u.Fields["coverUrl"], nil, ""
+	}
+	return urls["large"], urls, source
+}
+
+// firstNonEmpty returns the first value that is not blank.
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,288 @@
+package controllers
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"lipur_backend/audio"
+	"lipur_backend/services"
+	"lipur_backend/workers"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+)
+
+// Resumable uploads implement the tus 1.0 core protocol with the creation, termination and expiration
+// extensions (https://tus.io/protocols/resumable-upload). Completed uploads go through saveSong exactly like
+// POST /upload; the song ID is returned in the Upload-Song-Id header of the final PATCH and of later HEADs.
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination,expiration"
+)
+
+// TusOptions advertises the server's tus capabilities.
+func TusOptions(c *gin.Context, policy *services.UploadPolicy) {
+	c.Header("Tus-Resumable", tusVersion)
+	c.Header("Tus-Version", tusVersion)
+	c.Header("Tus-Extension", tusExtensions)
+	c.Header("Tus-Max-Size", strconv.FormatInt(policy.MaxBytes(uploadRole(c)), 10))
+	c.Status(http.StatusNoContent)
+}
+
+// checkTusResumable rejects clients speaking another protocol version.
+func checkTusResumable(c *gin.Context) bool {
+	c.Header("Tus-Resumable", tusVersion)
+	if c.GetHeader("Tus-Resumable") != tusVersion {
+		c.Header("Tus-Version", tusVersion)
+		c.AbortWithStatusJSON(http.StatusPreconditionFailed, gin.H{"error": "Unsupported tus version, expected " + tusVersion})
+		return false
+	}
+	return true
+}
+
+// TusCreate starts an upload. The declared Upload-Length is checked against the caller's limit up front.
+func TusCreate(c *gin.Context, store *services.TusStore, policy *services.UploadPolicy) {
+	if !checkTusResumable(c) {
+		return
+	}
+	if c.GetHeader("Upload-Defer-Length") != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Upload-Defer-Length is not supported"})
+		return
+	}
+	length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A valid Upload-Length header is required"})
+		return
+	}
+	if !checkUploadSize(c, policy, length) {
+		return
+	}
+
+	raw := c.GetHeader("Upload-Metadata")
+	metadata, err := parseTusMetadata(raw)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid Upload-Metadata: %v", err)})
+		return
+	}
+	if metadata["filename"] == "" {
+		uploadError(c, http.StatusBadRequest, UploadErrFileRequired, "Upload-Metadata must include a filename", nil)
+		return
+	}
+
+	upload := &services.TusUpload{
+		Length:      length,
+		Metadata:    metadata,
+		RawMetadata: raw,
+		Uid:         c.GetString("uid"),
+	}
+	if err := store.Create(upload); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to create upload: %v", err)})
+		return
+	}
+	log.Printf("Created resumable upload %s: %s, %d bytes", upload.ID, metadata["filename"], length)
+
+	c.Header("Location", strings.TrimSuffix(c.Request.URL.Path, "/")+"/"+upload.ID)
+	c.Header("Upload-Expires", store.ExpiresAt(upload).UTC().Format(http.TimeFormat))
+	c.Status(http.StatusCreated)
+}
+
+// TusHead reports how many bytes the server has, so the client knows where to resume.
+func TusHead(c *gin.Context, store *services.TusStore) {
+	if !checkTusResumable(c) {
+		return
+	}
+	upload, ok := loadTusUpload(c, store)
+	if !ok {
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	setTusHeaders(c, store, upload)
+	c.Header("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	if upload.RawMetadata != "" {
+		c.Header("Upload-Metadata", upload.RawMetadata)
+	}
+	c.Status(http.StatusOK)
+}
+
+// TusPatch appends a chunk at Upload-Offset. The request completing the upload also creates the song;
+// if that fails the bytes are kept and an empty PATCH at the final offset retries it.
+func TusPatch(c *gin.Context, store *services.TusStore, storage services.Storage, processor *workers.SongProcessor, fingerprinter *services.Fingerprinter, firestoreClient *firestore.Client) {
+	if !checkTusResumable(c) {
+		return
+	}
+	if c.ContentType() != "application/offset+octet-stream" {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Content-Type must be application/offset+octet-stream"})
+		return
+	}
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A valid Upload-Offset header is required"})
+		return
+	}
+
+	unlock := store.Lock(c.Param("id"))
+	defer unlock()
+	upload, ok := loadTusUpload(c, store)
+	if !ok {
+		return
+	}
+	if upload.SongID != "" {
+		setTusHeaders(c, store, upload)
+		c.Status(http.StatusNoContent)
+		return
+	}
+	if offset != upload.Offset {
+		c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Upload-Offset %d does not match the current offset %d", offset, upload.Offset)})
+		return
+	}
+
+	_, err = store.Append(upload, c.Request.Body)
+	if err != nil {
+		log.Printf("Resumable upload %s interrupted at %d of %d bytes: %v", upload.ID, upload.Offset, upload.Length, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to store chunk: %v", err)})
+		return
+	}
+
+	// Reject non-audio as soon as the magic bytes are in, instead of after the whole file
+	if upload.Format == "" && (upload.Offset >= audio.SniffLen || upload.Offset == upload.Length) {
+		if !sniffTusUpload(c, store, upload) {
+			return
+		}
+	}
+
+	if upload.Offset == upload.Length {
+		if !finishTusUpload(c, store, upload, storage, processor, fingerprinter, firestoreClient) {
+			return
+		}
+	}
+	setTusHeaders(c, store, upload)
+	c.Status(http.StatusNoContent)
+}
+
+// TusDelete terminates an upload and discards its bytes.
+func TusDelete(c *gin.Context, store *services.TusStore) {
+	if !checkTusResumable(c) {
+		return
+	}
+	unlock := store.Lock(c.Param("id"))
+	defer unlock()
+	upload, ok := loadTusUpload(c, store)
+	if !ok {
+		return
+	}
+	if err := store.Delete(upload.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to delete upload: %v", err)})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// loadTusUpload fetches the upload named in the URL. Uploads created with a token belong to that user;
+// others get a 404 so upload IDs cannot be probed.
+func loadTusUpload(c *gin.Context, store *services.TusStore) (*services.TusUpload, bool) {
+	upload, err := store.Get(c.Param("id"))
+	if errors.Is(err, services.ErrUploadNotFound) || (err == nil && upload.Uid != "" && upload.Uid != c.GetString("uid")) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+		return nil, false
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to load upload: %v", err)})
+		return nil, false
+	}
+	return upload, true
+}
+
+func setTusHeaders(c *gin.Context, store *services.TusStore, upload *services.TusUpload) {
+	c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	if upload.SongID != "" {
+		c.Header("Upload-Song-Id", upload.SongID)
+	} else {
+		c.Header("Upload-Expires", store.ExpiresAt(upload).UTC().Format(http.TimeFormat))
+	}
+}
+
+func sniffTusUpload(c *gin.Context, store *services.TusStore, upload *services.TusUpload) bool {
+	f, err := store.Open(upload.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to read upload: %v", err)})
+		return false
+	}
+	format, ok := sniffUpload(c, f, upload.Offset)
+	f.Close()
+	if !ok {
+		if err := store.Delete(upload.ID); err != nil {
+			log.Printf("Failed to discard rejected upload %s: %v", upload.ID, err)
+		}
+		return false
+	}
+	upload.Format = format
+	if err := store.Save(upload); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to save upload: %v", err)})
+		return false
+	}
+	return true
+}
+
+func finishTusUpload(c *gin.Context, store *services.TusStore, upload *services.TusUpload, storage services.Storage, processor *workers.SongProcessor, fingerprinter *services.Fingerprinter, firestoreClient *firestore.Client) bool {
+	f, err := store.Open(upload.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to read upload: %v", err)})
+		return false
+	}
+	defer f.Close()
+
+	fields := map[string]string{}
+	for _, key := range songUploadFields {
+		fields[key] = upload.Metadata[key]
+	}
+	started := time.Now()
+	result, err := saveSong(context.Background(), storage, processor, fingerprinter, firestoreClient, &songUpload{
+		File:     f,
+		Size:     upload.Length,
+		Filename: upload.Metadata["filename"],
+		Format:   upload.Format,
+		Fields:   fields,
+		Uploader: upload.Uid,
+	})
+	if err != nil {
+		respondSaveError(c, err)
+		return false
+	}
+
+	upload.SongID, _ = result["songId"].(string)
+	if err := store.Save(upload); err != nil {
+		log.Printf("Failed to record song %s for upload %s: %v", upload.SongID, upload.ID, err)
+	}
+	if err := store.ReleaseData(upload.ID); err != nil {
+		log.Printf("Failed to remove staged data of upload %s: %v", upload.ID, err)
+	}
+	log.Printf("Resumable upload %s finished as song %s in %s", upload.ID, upload.SongID, time.Since(started).Round(time.Millisecond))
+	return true
+}
+
+// parseTusMetadata decodes "key base64value,key2 base64value2"; values are optional.
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("empty key")
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("value of %q is not base64", key)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
@@ -2,25 +2,52 @@ package controllers
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"io"
+	"lipur_backend/models"
 	"lipur_backend/services"
+	"lipur_backend/workers"
 	"log"
 	"net/http"
 	"net/url"
-	"path"
+	"strings"
 	"time"
 
 	"cloud.google.com/go/firestore"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
-func UploadSong(c *gin.Context, storageService *services.StorageService, firestoreClient *firestore.Client) {
+// multipartOverhead is the allowance for the form fields and part headers around the file.
+const multipartOverhead = 1 << 20
+
+func UploadSong(c *gin.Context, storage services.Storage, policy *services.UploadPolicy, processor *workers.SongProcessor, fingerprinter *services.Fingerprinter, firestoreClient *firestore.Client) {
+	// Refuse oversized bodies while they are being received rather than after buffering them. The body may
+	// carry a cover image next to the file.
+	limit := policy.MaxBytes(uploadRole(c))
+	if limit > 0 {
+		bodyLimit := limit + maxCoverBytes + multipartOverhead
+		if c.Request.ContentLength > bodyLimit {
+			checkUploadSize(c, policy, c.Request.ContentLength-maxCoverBytes-multipartOverhead)
+			return
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, bodyLimit)
+	}
+
 	// Get file from form-data
 	file, err := c.FormFile("file")
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Failed to get file: %v", err)})
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			uploadError(c, http.StatusRequestEntityTooLarge, UploadErrFileTooLarge, "File exceeds the upload limit", gin.H{"maxBytes": limit})
+			return
+		}
+		uploadError(c, http.StatusBadRequest, UploadErrFileRequired, fmt.Sprintf("Failed to get file: %v", err), nil)
+		return
+	}
+	if !checkUploadSize(c, policy, file.Size) {
 		return
 	}
 
@@ -32,111 +59,50 @@ func UploadSong(c *gin.Context, storageService *services.StorageService, firesto
 	}
 	defer f.Close()
 
-	// Read file data
-	data, err := io.ReadAll(f)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to read file: %v", err)})
-		return
-	}
-
 	// Log file details
-	log.Printf("Uploading file: %s, size: %d bytes", file.Filename, len(data))
+	log.Printf("Uploading file: %s, size: %d bytes", file.Filename, file.Size)
 
-	// Get metadata from form-data
+	// The client file name is only kept as metadata:
+	// objects are keyed by song ID so uploads with the same name never overwrite each other.
 	filename := file.Filename
 	if filename == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Filename is required"})
+		uploadError(c, http.StatusBadRequest, UploadErrFileRequired, "Filename is required", nil)
 		return
 	}
-	title := c.PostForm("title")
-	if title == "" {
-		title = filename // Fallback to filename if title is empty
-	}
-	artistName := c.PostForm("artist")
-	if artistName == "" {
-		artistName = "Unknown Artist"
-	}
-	artistId := c.PostForm("artistId")
-	genre := c.PostForm("genre")
-	if genre == "" {
-		genre = "Unknown"
-	}
-	createdYear := c.PostForm("createdYear")
-	if createdYear == "" {
-		createdYear = "time.Now().Format(\"2006\")"
-	}
-	upload_user := c.PostForm("upload_user")
-	if upload_user == "" {
-		upload_user = "admin"
-	}
-	coverUrl := c.PostForm("coverUrl")
 
-	// Upload to Backblaze B2
-	ctx := context.Background()
-	publicURL, err := storageService.UploadFile(ctx, filename, data)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to upload file: %v", err)})
+	// Only audio is accepted, judged by content rather than by name or client content type
+	format, ok := sniffUpload(c, f, file.Size)
+	if !ok {
 		return
 	}
 
-	// Generate signed URL
-	signedUrl, err := storageService.GenerateSignedURL(filename)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to generate signed URL: %v", err)})
+	// Optional artwork as a second part; otherwise the embedded picture or a placeholder is used
+	cover, ok := readCoverPart(c)
+	if !ok {
 		return
 	}
 
-	// Generate artistId if not provided
-	if artistId == "" {
-		artistId = uuid.New().String()
-		_, err = firestoreClient.Collection("artists").Doc(artistId).Set(ctx, map[string]interface{}{
-			"name":            artistName,
-			"bio":             "",
-			"profileImageUrl": "",
-			"createdAt":       time.Now(),
-		})
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to save artist: %v", err)})
-			return
-		}
+	fields := map[string]string{}
+	for _, key := range songUploadFields {
+		fields[key] = c.PostForm(key)
 	}
-
-	// Save song metadata to Firestore
-	songId := uuid.New().String()
-	metadata := map[string]interface{}{
-		"id":          songId,
-		"title":       title,
-		"artistName":  artistName,
-		"artistId":    artistId,
-		"fileName":    filename,
-		"fileUrl":     publicURL,
-		"duration":    0,
-		"genre":       genre,
-		"uploadedAt":  time.Now(),
-		"coverUrl":    coverUrl,
-		"likes":       0,
-		"downloads":   0,
-		"playCount":   0,
-		"createdYear": createdYear,
-		"upload_user": upload_user,
-	}
-
-	_, err = firestoreClient.Collection("songs").Doc(songId).Set(ctx, metadata)
+	result, err := saveSong(context.Background(), storage, processor, fingerprinter, firestoreClient, &songUpload{
+		File:     f,
+		Size:     file.Size,
+		Filename: filename,
+		Format:   format,
+		Fields:   fields,
+		Cover:    cover,
+		Uploader: c.GetString("uid"),
+	})
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to save metadata: %v", err)})
+		respondSaveError(c, err)
 		return
 	}
-
-	c.JSON(http.StatusOK, gin.H{
-		"message":   "File uploaded successfully",
-		"songId":    songId,
-		"publicUrl": publicURL,
-		"signedUrl": signedUrl,
-		"filename":  filename,
-	})
+	c.JSON(http.StatusOK, result)
 }
 
-func GetSignedMusicURL(c *gin.Context, storageService *services.StorageService) {
+func GetSignedMusicURL(c *gin.Context, storage services.Storage, firestoreClient *firestore.Client) {
 
 	fullFileUrl := c.Query("file")
 	if fullFileUrl == "" {
@@ -152,27 +118,63 @@ func GetSignedMusicURL(c *gin.Context, storageService *services.StorageService)
 		return
 	}
 
-	// 3. Extract the Object Key (Filename)
-	// parsedUrl.Path gives us the URL path string (e.g., "/file/LipurMusic/Happier.mp3")
-	// path.Base() returns the last element of the path (e.g., "Happier.mp3")
-	// This is the robust way to extract the key regardless of the B2 structure.
-	objectKey := path.Base(parsedUrl.Path) // <--- FINAL FIX: Use path.Base()
+	// 3. Extract the Object Key
+	// parsedUrl.Path gives us the URL path string (e.g., "/file/LipurMusic/songs/{songId}/original.mp3")
+	// Keys contain "/" since songs are stored under songs/{songId}/, so strip the backend's URL prefix
+	// instead of taking the last path element.
+	objectKey := services.ObjectKeyFromURL(parsedUrl.Path)
 
 	if objectKey == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Could not determine file key from URL path."})
 		return
 	}
 
-	// 4. Call the service with ONLY the object key (e.g., "Happier.mp3")
-	url, err := storageService.GenerateSignedURL(objectKey)
+	// Loudness values are only looked up when the client names the song with ?songId=; GET /songs/:id has them too
+	var song *models.Song
+	if songId := c.Query("songId"); songId != "" {
+		songDoc, err := firestoreClient.Collection("songs").Doc(songId).Get(context.Background())
+		if err == nil {
+			song = &models.Song{}
+			err = songDoc.DataTo(song)
+		}
+		if err != nil && status.Code(err) != codes.NotFound {
+			log.Printf("Failed to look up song %s: %v", songId, err)
+		}
+		if err != nil || (song.FileName != objectKey && song.HLSPlaylistKey != objectKey) {
+			song = nil
+		}
+	}
+
+	// HLS playlists are answered with the playlist itself, every segment URI rewritten to a signed URL,
+	// so players can load /stream-url?file=<hlsPlaylistUrl> directly.
+	if strings.HasSuffix(objectKey, ".m3u8") {
+		playlist, err := services.SignHLSPlaylist(context.Background(), storage, objectKey, time.Hour)
+		if err != nil {
+			log.Printf("Failed to sign HLS playlist: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to sign HLS playlist: %v", err)})
+			return
+		}
+		setLoudnessHeaders(c, song)
+		c.Data(http.StatusOK, services.HLSContentType, playlist)
+		return
+	}
+
+	// 4. Call the service with ONLY the object key (e.g., "songs/{songId}/original.mp3")
+	url, err := storage.GenerateSignedURL(context.Background(), objectKey, time.Hour)
 	if err != nil {
 		log.Printf("Failed to generate signed URL: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to generate signed URL: %v", err)})
 		return
 	}
 
-	// 5. Response structure
-	c.JSON(http.StatusOK, gin.H{"url": url})
+	// 5. Response structure, with the normalization values when the song has been analyzed
+	response := gin.H{"url": url}
+	if song != nil {
+		response["songId"] = song.ID
+		response["replayGain"] = song.ReplayGain
+		response["loudness"] = song.Loudness
+	}
+	c.JSON(http.StatusOK, response)
 	// fileName := c.Query("file")
 	// if fileName == "" {
 	// 	c.JSON(http.StatusBadRequest, gin.H{"error": "File name is required to uppload "})
@@ -188,33 +190,72 @@ func GetSignedMusicURL(c *gin.Context, storageService *services.StorageService)
 	// c.JSON(http.StatusOK, gin.H{"url": url})
 }
 
+// GetSongs lists the catalog one page at a time (?limit, ?cursor). Songs can be filtered by ?genre, ?artistId,
+// ?createdYear and ?uploadUser (combinable) and sorted by ?sort=uploadedAt|playCount|likes|title with
+// ?order=asc|desc; the default is newest first. See services.SongCatalogIndexes for the indexes this needs.
 func GetSongs(c *gin.Context, firestoreClient *firestore.Client) {
+	limit, cursor, ok := pageParams(c)
+	if !ok {
+		return
+	}
+
+	query := firestoreClient.Collection("songs").Query
+	for _, filter := range services.SongFilters {
+		if value := c.Query(filter.Param); value != "" {
+			query = query.Where(filter.Field, "==", value)
+		}
+	}
+
+	sort := services.SongSorts[0]
+	if key := c.Query("sort"); key != "" {
+		found := false
+		for _, s := range services.SongSorts {
+			if s.Key == key {
+				sort, found = s, true
+			}
+		}
+		if !found {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "sort must be uploadedAt, playCount, likes or title"})
+			return
+		}
+	}
+	switch c.Query("order") {
+	case "":
+	case "asc":
+		sort.Direction = firestore.Asc
+	case "desc":
+		sort.Direction = firestore.Desc
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "order must be asc or desc"})
+		return
+	}
+
 	ctx := context.Background()
-	docs, err := firestoreClient.Collection("songs").OrderBy("uploadedAt", firestore.Desc).Documents(ctx).GetAll()
+	page, err := services.Paginate(ctx, query, []services.Order{{Field: sort.Key, Direction: sort.Direction}}, limit, cursor)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to fetch songs: %v", err)})
+		respondPageError(c, "songs", err)
 		return
 	}
 
-	log.Printf("Fetched %d songs from Firestore", len(docs))
-
-	songs := []map[string]interface{}{}
-	for _, doc := range docs {
-		data := doc.Data()
-		// Convert Firestore timestamp (time.Time) to Unix seconds
-		if ts, ok := data["uploadedAt"].(time.Time); ok {
-			data["uploadedAt"] = ts.Unix()
+	// uploadedAt is sent as Unix seconds (see models.Song)
+	songs := []models.Song{}
+	for _, doc := range page.Docs {
+		var song models.Song
+		if err := doc.DataTo(&song); err != nil {
+			log.Printf("Skipping song %s: %v", doc.Ref.ID, err)
+			continue
 		}
-		songs = append(songs, data)
+		songs = append(songs, song)
 	}
 
-	c.JSON(http.StatusOK, gin.H{"songs": songs})
+	c.JSON(http.StatusOK, gin.H{"songs": songs, "nextCursor": nextCursor(page)})
 }
 
 // for playlist and user
 func CreatePlaylist(c *gin.Context, firestoreClient *firestore.Client) {
-	userId, exists := c.Get("userId")
-	if !exists {
+	// Set by AuthMiddleware
+	userId := c.GetString("uid")
+	if userId == "" {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
 		return
 	}
@@ -228,22 +269,22 @@ func CreatePlaylist(c *gin.Context, firestoreClient *firestore.Client) {
 		return
 	}
 
-	if request.Name == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Playlist name is required"})
-		return
-	}
-
 	playlistId := uuid.New().String()
-	playlist := map[string]interface{}{
-		"id":          playlistId,
-		"name":        request.Name,
-		"description": request.Description,
-		"songs":       []map[string]interface{}{},
-		"createdAt":   time.Now(),
+	playlist := &models.Playlist{
+		ID:          playlistId,
+		Name:        request.Name,
+		Description: request.Description,
+		Songs:       []models.Song{},
+		SongIDs:     []string{},
+		CreatedAt:   time.Now(),
+	}
+	if err := playlist.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "fields": err.(*models.ValidationError).Fields})
+		return
 	}
 
 	ctx := context.Background()
-	_, err := firestoreClient.Collection("users").Doc(userId.(string)).Collection("playlists").Doc(playlistId).Set(ctx, playlist)
+	_, err := firestoreClient.Collection("users").Doc(userId).Collection("playlists").Doc(playlistId).Set(ctx, playlist)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to create playlist: %v", err)})
 		return
@@ -256,34 +297,43 @@ func CreatePlaylist(c *gin.Context, firestoreClient *firestore.Client) {
 }
 
 func GetPlaylists(c *gin.Context, firestoreClient *firestore.Client) {
-	userId, exists := c.Get("userId")
-	if !exists {
+	// Set by AuthMiddleware
+	userId := c.GetString("uid")
+	if userId == "" {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
 		return
 	}
 
+	limit, cursor, ok := pageParams(c)
+	if !ok {
+		return
+	}
 	ctx := context.Background()
-	docs, err := firestoreClient.Collection("users").Doc(userId.(string)).Collection("playlists").OrderBy("createdAt", firestore.Desc).Documents(ctx).GetAll()
+	page, err := services.Paginate(ctx, firestoreClient.Collection("users").Doc(userId).Collection("playlists").Query,
+		[]services.Order{{Field: "createdAt", Direction: firestore.Desc}}, limit, cursor)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to fetch playlists: %v", err)})
+		respondPageError(c, "playlists", err)
 		return
 	}
 
-	playlists := []map[string]interface{}{}
-	for _, doc := range docs {
-		data := doc.Data()
-		if ts, ok := data["createdAt"].(time.Time); ok {
-			data["createdAt"] = ts.Unix()
+	// createdAt is sent as Unix seconds (see models.Playlist)
+	playlists := []models.Playlist{}
+	for _, doc := range page.Docs {
+		var playlist models.Playlist
+		if err := doc.DataTo(&playlist); err != nil {
+			log.Printf("Skipping playlist %s: %v", doc.Ref.Path, err)
+			continue
 		}
-		playlists = append(playlists, data)
+		playlists = append(playlists, playlist)
 	}
 
-	c.JSON(http.StatusOK, gin.H{"playlists": playlists})
+	c.JSON(http.StatusOK, gin.H{"playlists": playlists, "nextCursor": nextCursor(page)})
 }
 
 func AddSongToPlaylist(c *gin.Context, firestoreClient *firestore.Client) {
-	userId, exists := c.Get("userId")
-	if !exists {
+	// Set by AuthMiddleware
+	userId := c.GetString("uid")
+	if userId == "" {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
 		return
 	}
@@ -309,12 +359,17 @@ func AddSongToPlaylist(c *gin.Context, firestoreClient *firestore.Client) {
 		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Song not found: %v", err)})
 		return
 	}
-	songData := songDoc.Data()
+	var song models.Song
+	if err := songDoc.DataTo(&song); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to read song: %v", err)})
+		return
+	}
 
 	// Update playlist
-	playlistRef := firestoreClient.Collection("users").Doc(userId.(string)).Collection("playlists").Doc(playlistId)
+	playlistRef := firestoreClient.Collection("users").Doc(userId).Collection("playlists").Doc(playlistId)
 	_, err = playlistRef.Update(ctx, []firestore.Update{
-		{Path: "songs", Value: firestore.ArrayUnion(songData)},
+		{Path: "songs", Value: firestore.ArrayUnion(song)},
+		{Path: "songIds", Value: firestore.ArrayUnion(songDoc.Ref.ID)},
 	})
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to add song to playlist: %v", err)})
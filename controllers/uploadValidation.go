@@ -0,0 +1,123 @@
+package controllers
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"lipur_backend/audio"
+	"lipur_backend/services"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Machine-readable codes returned with rejected uploads, next to the human-readable "error" message.
+const (
+	UploadErrFileRequired      = "FILE_REQUIRED"
+	UploadErrEmptyFile         = "EMPTY_FILE"
+	UploadErrFileTooLarge      = "FILE_TOO_LARGE"
+	UploadErrUnsupportedFormat = "UNSUPPORTED_FORMAT"
+	UploadErrNotAllowed        = "UPLOAD_NOT_ALLOWED"
+	UploadErrInvalidChecksum   = "INVALID_CHECKSUM"
+	UploadErrChecksumMismatch  = "CHECKSUM_MISMATCH"
+	UploadErrSizeMismatch      = "SIZE_MISMATCH"
+	UploadErrNotFound          = "UPLOAD_NOT_FOUND"
+	UploadErrObjectMissing     = "OBJECT_MISSING"
+	UploadErrInProgress        = "UPLOAD_IN_PROGRESS"
+	UploadErrUploadFailed      = "UPLOAD_FAILED"
+	UploadErrDirectUnsupported = "DIRECT_UPLOAD_UNSUPPORTED"
+	UploadErrCoverTooLarge     = "COVER_TOO_LARGE"
+	UploadErrInvalidCover      = "INVALID_COVER"
+	UploadErrDuplicateAudio    = "DUPLICATE_AUDIO"
+	UploadErrInvalidMetadata   = "INVALID_METADATA"
+)
+
+// uploadError aborts the request with {"error": message, "code": code} plus optional details.
+func uploadError(c *gin.Context, status int, code, message string, details gin.H) {
+	body := gin.H{"error": message, "code": code}
+	if details != nil {
+		body["details"] = details
+	}
+	c.AbortWithStatusJSON(status, body)
+}
+
+// uploadRole maps the caller's token (set by OptionalAuthMiddleware) onto an upload policy role.
+func uploadRole(c *gin.Context) string {
+	if c.GetBool("admin") {
+		return services.RoleAdmin
+	}
+	if c.GetString("uid") != "" {
+		return services.RoleUser
+	}
+	return services.RoleAnonymous
+}
+
+// checkUploadSize rejects empty files and files over the caller's limit before anything is sent to storage.
+func checkUploadSize(c *gin.Context, policy *services.UploadPolicy, size int64) bool {
+	role := uploadRole(c)
+	limit := policy.MaxBytes(role)
+	switch {
+	case limit <= 0:
+		uploadError(c, http.StatusForbidden, UploadErrNotAllowed, fmt.Sprintf("Uploads are not allowed for %s users", role), gin.H{"role": role})
+		return false
+	case size == 0:
+		uploadError(c, http.StatusBadRequest, UploadErrEmptyFile, "File is empty", nil)
+		return false
+	case size > limit:
+		uploadError(c, http.StatusRequestEntityTooLarge, UploadErrFileTooLarge,
+			fmt.Sprintf("File is %d bytes, the limit for %s users is %d bytes", size, role, limit),
+			gin.H{"size": size, "maxBytes": limit, "role": role})
+		return false
+	}
+	return true
+}
+
+// sniffUpload identifies the audio format from the file's magic bytes and rejects anything else.
+func sniffUpload(c *gin.Context, r io.ReaderAt, size int64) (string, bool) {
+	head := make([]byte, min(size, audio.SniffLen))
+	if _, err := r.ReadAt(head, 0); err != nil && err != io.EOF {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to read file: %v", err)})
+		return "", false
+	}
+	format := audio.Sniff(head)
+	if format == "" {
+		uploadError(c, http.StatusUnsupportedMediaType, UploadErrUnsupportedFormat,
+			"File is not a supported audio format (MP3, AAC, M4A, OGG, Opus, FLAC or WAV)",
+			gin.H{"detectedType": http.DetectContentType(head)})
+		return "", false
+	}
+	return format, true
+}
+
+// maxCoverBytes is the largest cover image accepted as the "cover" form part.
+const maxCoverBytes = 10 << 20
+
+// readCoverPart decodes the optional "cover" image part. It returns nil without error when there is none.
+func readCoverPart(c *gin.Context) (image.Image, bool) {
+	coverFile, err := c.FormFile("cover")
+	if err != nil {
+		return nil, true
+	}
+	if coverFile.Size > maxCoverBytes {
+		uploadError(c, http.StatusRequestEntityTooLarge, UploadErrCoverTooLarge, "Cover image is too large",
+			gin.H{"size": coverFile.Size, "maxBytes": maxCoverBytes})
+		return nil, false
+	}
+	f, err := coverFile.Open()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to open cover: %v", err)})
+		return nil, false
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to read cover: %v", err)})
+		return nil, false
+	}
+	img, err := services.DecodeCover(data)
+	if err != nil {
+		uploadError(c, http.StatusBadRequest, UploadErrInvalidCover, "Cover must be a JPEG, PNG, GIF or WebP image", gin.H{"reason": err.Error()})
+		return nil, false
+	}
+	return img, true
+}
@@ -3,6 +3,7 @@ package controllers
 import (
 	"context"
 	"fmt"
+	"lipur_backend/models"
 	"net/http"
 	"time"
 
@@ -17,15 +18,6 @@ type LoginRequest struct {
 	IDToken string `json:"idToken" binding:"required"`
 }
 
-type UserData struct {
-	UID         string    `firestore:"uid"`
-	Email       string    `firestore:"email,omitempty"`
-	DisplayName string    `firestore:"displayName,omitempty"`
-	PhoneNumber string    `firestore:"phoneNumber,omitempty"`
-	CreatedAt   time.Time `firestore:"createdAt"`
-	// Add other user fields as needed (e.g., photoUrl, roles)
-}
-
 // --- Public Handlers ---
 
 // RegisterUser handles the creation of a new user document after Firebase authentication.
@@ -57,12 +49,21 @@ func RegisterUser(c *gin.Context, firestoreClient *firestore.Client, authClient
 	doc, err := userRef.Get(ctx)
 	if err != nil && !doc.Exists() {
 		// User document does not exist, create it
-		metadata := UserData{
+		// Phone sign-ins carry no email or name claims
+		email, _ := token.Claims["email"].(string)
+		name, _ := token.Claims["name"].(string)
+		phone, _ := token.Claims["phone_number"].(string)
+		metadata := &models.User{
 			UID:         uid,
-			Email:       token.Claims["email"].(string),
-			DisplayName: token.Claims["name"].(string),
+			Email:       email,
+			DisplayName: name,
+			PhoneNumber: phone,
 			CreatedAt:   time.Now(),
 		}
+		if err := metadata.Validate(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 
 		_, setErr := userRef.Set(ctx, metadata)
 		if setErr != nil {
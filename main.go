@@ -2,10 +2,14 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"lipur_backend/config"
+	"lipur_backend/migrations"
 	"lipur_backend/routes"
+	"lipur_backend/search"
 	"lipur_backend/services"
+	"lipur_backend/workers"
 	"log"
 
 	"os"
@@ -40,22 +44,70 @@ func main() {
 		log.Fatalf("Failed to initialize Firebase Auth: %v", err)
 	}
 
-	// Initialize S3 client for Backblaze B2
-	s3Client, err := services.NewS3Client()
+	// Initialize the storage backend selected by STORAGE_BACKEND (b2, s3 or local)
+	storage, err := services.NewStorage()
 	if err != nil {
-		log.Fatal("Failed to initialize S3 client:", err)
+		log.Fatal("Failed to initialize storage:", err)
 	}
+	fmt.Printf("Storage backend: %T\n", storage)
 
-	// Initialize storage service
-	service := services.NewStorageService()
-	if service.AccountID == "" || service.AppKey == "" || service.BucketName == "" {
-		log.Fatal("Missing required env vars: B2_ACCOUNT_ID, B2_APPLICATION_KEY, or B2_BUCKET_NAME")
+	// One-off maintenance commands: go run . migrate-song-keys [-dry-run] [-delete-old]
+	if len(os.Args) > 1 && os.Args[1] == "migrate-song-keys" {
+		fs := flag.NewFlagSet("migrate-song-keys", flag.ExitOnError)
+		dryRun := fs.Bool("dry-run", false, "only log the planned moves")
+		deleteOld := fs.Bool("delete-old", false, "delete legacy objects after they are copied")
+		fs.Parse(os.Args[2:])
+		if err := migrations.MigrateSongKeys(ctx, storage, firestoreClient, *dryRun, *deleteOld); err != nil {
+			log.Fatal("Migration failed: ", err)
+		}
+		log.Println("Migration complete")
+		return
 	}
 
-	fmt.Println("AccountID inside service:", service.AccountID)
+	// go run . backfill-playlist-song-ids [-dry-run]
+	if len(os.Args) > 1 && os.Args[1] == "backfill-playlist-song-ids" {
+		fs := flag.NewFlagSet("backfill-playlist-song-ids", flag.ExitOnError)
+		dryRun := fs.Bool("dry-run", false, "only log the playlists that need songIds")
+		fs.Parse(os.Args[2:])
+		if err := migrations.BackfillPlaylistSongIDs(ctx, firestoreClient, *dryRun); err != nil {
+			log.Fatal("Backfill failed: ", err)
+		}
+		log.Println("Backfill complete")
+		return
+	}
+
+	// Background processing of uploaded songs; loudness analysis, waveforms and HLS packaging are skipped
+	// when ffmpeg is not installed
+	jobQueue := workers.NewJobQueue(firestoreClient)
+	hlsWorker := workers.NewHLSWorker(storage, firestoreClient)
+	loudnessAnalyzer := workers.NewLoudnessAnalyzer(firestoreClient)
+	waveformGenerator := workers.NewWaveformGenerator(storage)
+	songProcessor := workers.NewSongProcessor(jobQueue, storage, firestoreClient, hlsWorker, loudnessAnalyzer, waveformGenerator)
+	jobQueue.Start(ctx)
+	songProcessor.Backfill(ctx)
+
+	// Acoustic fingerprints for near-duplicate detection (FINGERPRINT_DUPLICATES)
+	fingerprinter := services.NewFingerprinter()
+
+	// Clean up after uploads whose metadata never made it to Firestore (see services.BeginOutbox)
+	services.StartOutboxReconciler(ctx, storage, firestoreClient)
+
+	// Per-role upload size limits (UPLOAD_MAX_MB_*)
+	uploadPolicy := services.NewUploadPolicy()
+
+	// Staging area for resumable (tus) uploads
+	tusStore, err := services.NewTusStore()
+	if err != nil {
+		log.Fatal("Failed to initialize resumable uploads:", err)
+	}
+	tusStore.StartCleanup(ctx)
+
+	// Full-text search, rebuilt from Firestore at startup and kept current by snapshot listeners
+	searchIndex := search.NewIndex()
+	searchIndex.Sync(ctx, firestoreClient)
 
 	r := gin.Default()
-	routes.RegisterRoutes(r, service, s3Client, firestoreClient, authClient)
+	routes.RegisterRoutes(r, storage, uploadPolicy, tusStore, songProcessor, fingerprinter, jobQueue, searchIndex, firestoreClient, authClient)
 
 	port := config.GetEnv("PORT")
 	log.Println("Server running on port:", port)
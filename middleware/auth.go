@@ -40,10 +40,25 @@ func AuthMiddleware(authClient *auth.Client) gin.HandlerFunc {
 			return
 		}
 
-		// 4. Authentication successful: Inject the UID into the Gin context
+		// 4. Authentication successful: Inject the UID (and admin custom claim) into the Gin context
 		c.Set("uid", token.UID)
+		isAdmin, _ := token.Claims["admin"].(bool)
+		c.Set("admin", isAdmin)
 
 		// Continue to the next handler
 		c.Next()
 	}
 }
+
+// OptionalAuthMiddleware verifies the Firebase ID Token when one is sent and lets anonymous requests through.
+// Handlers tell the two apart by the presence of "uid" in the Gin context.
+func OptionalAuthMiddleware(authClient *auth.Client) gin.HandlerFunc {
+	required := AuthMiddleware(authClient)
+	return func(c *gin.Context) {
+		if c.GetHeader("Authorization") == "" {
+			c.Next()
+			return
+		}
+		required(c)
+	}
+}
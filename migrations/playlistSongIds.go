@@ -0,0 +1,52 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"lipur_backend/models"
+	"log"
+	"slices"
+
+	"cloud.google.com/go/firestore"
+)
+
+// BackfillPlaylistSongIDs sets songIds on playlists created before it existed, so that song edits and deletions
+// (which find playlists by songIds) reach them. Playlists already in line are left alone; it can be rerun.
+func BackfillPlaylistSongIDs(ctx context.Context, firestoreClient *firestore.Client, dryRun bool) error {
+	docs, err := firestoreClient.CollectionGroup("playlists").Documents(ctx).GetAll()
+	if err != nil {
+		return fmt.Errorf("failed to list playlists: %w", err)
+	}
+
+	updated := 0
+	for _, doc := range docs {
+		var playlist models.Playlist
+		if err := doc.DataTo(&playlist); err != nil {
+			return fmt.Errorf("playlist %s: %w", doc.Ref.Path, err)
+		}
+		if _, ok := doc.Data()["songIds"]; ok && slices.Equal(playlist.SongIDs, models.PlaylistSongIDs(playlist.Songs)) {
+			continue
+		}
+		log.Printf("%s: %d songs", doc.Ref.Path, len(playlist.Songs))
+		updated++
+		if dryRun {
+			continue
+		}
+		err := firestoreClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+			snap, err := tx.Get(doc.Ref)
+			if err != nil {
+				return err
+			}
+			var current models.Playlist
+			if err := snap.DataTo(&current); err != nil {
+				return err
+			}
+			return tx.Update(doc.Ref, []firestore.Update{{Path: "songIds", Value: models.PlaylistSongIDs(current.Songs)}})
+		})
+		if err != nil {
+			return fmt.Errorf("playlist %s: %w", doc.Ref.Path, err)
+		}
+	}
+	log.Printf("%d of %d playlists needed songIds", updated, len(docs))
+	return nil
+}
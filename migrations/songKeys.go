@@ -0,0 +1,155 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"lipur_backend/models"
+	"lipur_backend/services"
+	"log"
+
+	"cloud.google.com/go/firestore"
+)
+
+// MigrateSongKeys moves songs stored under raw client file names (e.g. "Happier.mp3") to the
+// songs/{songId}/original.{ext} layout, rewriting fileName/fileUrl on the song documents and their playlist copies.
+//
+// Songs that share one legacy object (deduplicated uploads) are moved together under the ID of the song that
+// owns the object. The migration is idempotent: objects already copied are not uploaded again, so an interrupted
+// run can simply be restarted. Legacy objects are only removed when deleteOld is set; songs keep their old key in
+// legacyFileName, so a later run with deleteOld still removes objects left behind by earlier runs.
+//
+// Playlist copies are found by their songIds, so run BackfillPlaylistSongIDs first.
+func MigrateSongKeys(ctx context.Context, storage services.Storage, firestoreClient *firestore.Client, dryRun, deleteOld bool) error {
+	docs, err := firestoreClient.Collection("songs").Documents(ctx).GetAll()
+	if err != nil {
+		return fmt.Errorf("failed to list songs: %w", err)
+	}
+
+	// Group songs by the legacy object they point at, or pointed at before an earlier run
+	groups := map[string][]*firestore.DocumentSnapshot{}
+	pending := map[string]bool{} // legacy objects some song still points at
+	var order []string
+	for _, doc := range docs {
+		fileName, _ := doc.Data()["fileName"].(string)
+		oldKey, _ := doc.Data()["legacyFileName"].(string)
+		if fileName != "" && services.IsLegacySongKey(fileName) {
+			oldKey = fileName
+			pending[oldKey] = true
+		}
+		if oldKey == "" {
+			continue
+		}
+		if _, ok := groups[oldKey]; !ok {
+			order = append(order, oldKey)
+		}
+		groups[oldKey] = append(groups[oldKey], doc)
+	}
+	log.Printf("Found %d legacy objects referenced by songs, %d already moved", len(order), len(order)-len(pending))
+
+	failed := 0
+	for _, oldKey := range order {
+		var err error
+		if pending[oldKey] {
+			err = migrateObject(ctx, storage, firestoreClient, oldKey, groups[oldKey], dryRun, deleteOld)
+		} else if deleteOld {
+			err = deleteLegacyObject(ctx, storage, oldKey, dryRun)
+		}
+		if err != nil {
+			log.Printf("Failed to migrate %s: %v", oldKey, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d objects failed to migrate", failed, len(order))
+	}
+	return nil
+}
+
+func migrateObject(ctx context.Context, storage services.Storage, firestoreClient *firestore.Client, oldKey string, songs []*firestore.DocumentSnapshot, dryRun, deleteOld bool) error {
+	// The owner is the song that originally uploaded the bytes, not a deduplicated copy
+	owner := songs[0]
+	for _, doc := range songs {
+		if _, isCopy := doc.Data()["duplicateOf"]; !isCopy {
+			owner = doc
+			break
+		}
+	}
+	newKey := services.SongObjectKey(owner.Ref.ID, oldKey)
+	log.Printf("%s -> %s (%d songs)", oldKey, newKey, len(songs))
+	if dryRun {
+		return nil
+	}
+
+	info, err := storage.StatFile(ctx, newKey)
+	if errors.Is(err, services.ErrFileNotFound) {
+		info, err = copyObject(ctx, storage, oldKey, newKey)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Playlists first: once the songs point at newKey, a rerun no longer treats them as pending
+	for _, doc := range songs {
+		_, err := services.UpdateSongInPlaylists(ctx, firestoreClient, doc.Ref.ID, func(song *models.Song) {
+			song.FileName, song.FileURL = newKey, info.URL
+		})
+		if err != nil {
+			return fmt.Errorf("failed to update playlists of %s: %w", doc.Ref.ID, err)
+		}
+	}
+
+	batch := firestoreClient.Batch()
+	for _, doc := range songs {
+		updates := []firestore.Update{
+			{Path: "fileName", Value: newKey},
+			{Path: "fileUrl", Value: info.URL},
+			{Path: "legacyFileName", Value: oldKey},
+		}
+		if _, ok := doc.Data()["originalFileName"]; !ok {
+			updates = append(updates, firestore.Update{Path: "originalFileName", Value: oldKey})
+		}
+		if _, ok := doc.Data()["contentSha1"]; !ok && info.SHA1 != "" {
+			updates = append(updates, firestore.Update{Path: "contentSha1", Value: info.SHA1})
+		}
+		batch.Update(doc.Ref, updates)
+	}
+	if _, err := batch.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to update songs: %w", err)
+	}
+
+	if deleteOld {
+		return deleteLegacyObject(ctx, storage, oldKey, false)
+	}
+	return nil
+}
+
+// deleteLegacyObject removes a legacy object whose songs have all been moved, if it is still there.
+func deleteLegacyObject(ctx context.Context, storage services.Storage, oldKey string, dryRun bool) error {
+	if _, err := storage.StatFile(ctx, oldKey); errors.Is(err, services.ErrFileNotFound) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to stat legacy object: %w", err)
+	}
+	log.Printf("Deleting %s", oldKey)
+	if dryRun {
+		return nil
+	}
+	if err := storage.DeleteFile(ctx, oldKey); err != nil {
+		return fmt.Errorf("failed to delete legacy object: %w", err)
+	}
+	return nil
+}
+
+func copyObject(ctx context.Context, storage services.Storage, oldKey, newKey string) (*services.FileInfo, error) {
+	src, err := storage.StatFile(ctx, oldKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat legacy object: %w", err)
+	}
+	body, err := storage.ReadRange(ctx, oldKey, 0, -1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read legacy object: %w", err)
+	}
+	defer body.Close()
+	return storage.UploadFile(ctx, newKey, body, src.Size, src.ContentType)
+}
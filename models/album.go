@@ -0,0 +1,47 @@
+package models
+
+import "time"
+
+// Album is albums/{ID}, written by an album upload together with its songs, which point back through AlbumID.
+type Album struct {
+	ID            string            `firestore:"id" json:"id"`
+	Title         string            `firestore:"title" json:"title"`
+	ArtistID      string            `firestore:"artistId" json:"artistId"`
+	ArtistName    string            `firestore:"artistName" json:"artistName"`
+	Genre         string            `firestore:"genre" json:"genre"`
+	CreatedYear   string            `firestore:"createdYear" json:"createdYear"`
+	CoverURL      string            `firestore:"coverUrl" json:"coverUrl"`
+	CoverURLs     map[string]string `firestore:"coverUrls,omitempty" json:"coverUrls,omitempty"`
+	SongIDs       []string          `firestore:"songIds" json:"songIds"` // in track order
+	TrackCount    int               `firestore:"trackCount" json:"trackCount"`
+	TotalDuration float64           `firestore:"totalDuration" json:"totalDuration"` // seconds
+	UploadUser    string            `firestore:"upload_user" json:"upload_user"`
+	CreatedAt     time.Time         `firestore:"createdAt" json:"createdAt"`
+
+	// Set once every track is measured (see workers.LoudnessAnalyzer)
+	Loudness   *Loudness        `firestore:"loudness,omitempty" json:"loudness,omitempty"`
+	ReplayGain *AlbumReplayGain `firestore:"replayGain,omitempty" json:"replayGain,omitempty"`
+}
+
+// AlbumReplayGain is the album part of ReplayGain, which every track of the album also carries.
+type AlbumReplayGain struct {
+	AlbumGain float64 `firestore:"albumGain" json:"albumGain"`
+	AlbumPeak float64 `firestore:"albumPeak" json:"albumPeak"`
+}
+
+// Validate checks the fields every stored album must have.
+func (a *Album) Validate() error {
+	v := newValidator("album")
+	v.required("id", a.ID)
+	v.required("title", a.Title)
+	v.maxLength("title", a.Title, 300)
+	v.required("artistId", a.ArtistID)
+	v.required("artistName", a.ArtistName)
+	v.maxLength("artistName", a.ArtistName, 200)
+	v.maxLength("genre", a.Genre, 100)
+	v.check(a.CreatedYear == "" || yearPattern.MatchString(a.CreatedYear), "createdYear", "must be a four-digit year")
+	v.check(len(a.SongIDs) > 0, "songIds", "must not be empty")
+	v.check(a.TrackCount == len(a.SongIDs), "trackCount", "must match songIds")
+	v.nonNegative("totalDuration", a.TotalDuration)
+	return v.result()
+}
@@ -0,0 +1,27 @@
+package models
+
+import "time"
+
+// Artist is artists/{ID}, created by the first upload that names the artist without an artistId.
+type Artist struct {
+	ID              string    `firestore:"id" json:"id"`
+	Name            string    `firestore:"name" json:"name"`
+	Bio             string    `firestore:"bio" json:"bio"`
+	ProfileImageURL string    `firestore:"profileImageUrl" json:"profileImageUrl"`
+	CreatedAt       time.Time `firestore:"createdAt" json:"createdAt"`
+}
+
+// NewArtist returns an artist with only a name, as uploads create them.
+func NewArtist(id, name string) *Artist {
+	return &Artist{ID: id, Name: name, CreatedAt: time.Now()}
+}
+
+// Validate checks the fields every stored artist must have.
+func (a *Artist) Validate() error {
+	v := newValidator("artist")
+	v.required("id", a.ID)
+	v.required("name", a.Name)
+	v.maxLength("name", a.Name, 200)
+	v.maxLength("bio", a.Bio, 5000)
+	return v.result()
+}
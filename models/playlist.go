@@ -0,0 +1,62 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Playlist is users/{uid}/playlists/{ID}. Songs are full copies of the song documents, kept in line with the
+// songs collection by services.RemoveSongFromPlaylists and services.UpdateSongInPlaylists. SongIDs lists their
+// IDs, which lets those find the playlists holding a song with an array-contains query.
+type Playlist struct {
+	ID          string    `firestore:"id" json:"id"`
+	Name        string    `firestore:"name" json:"name"`
+	Description string    `firestore:"description" json:"description"`
+	Songs       []Song    `firestore:"songs" json:"songs"`
+	SongIDs     []string  `firestore:"songIds" json:"songIds"`
+	CreatedAt   time.Time `firestore:"createdAt" json:"createdAt"`
+}
+
+// PlaylistSongIDs is the SongIDs value for songs.
+func PlaylistSongIDs(songs []Song) []string {
+	ids := make([]string, 0, len(songs))
+	for _, song := range songs {
+		ids = append(ids, song.ID)
+	}
+	return ids
+}
+
+// HasSong reports whether the playlist contains a copy of songId.
+func (p *Playlist) HasSong(songId string) bool {
+	for _, song := range p.Songs {
+		if song.ID == songId {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the fields every stored playlist must have.
+func (p *Playlist) Validate() error {
+	v := newValidator("playlist")
+	v.required("id", p.ID)
+	v.required("name", p.Name)
+	v.maxLength("name", p.Name, 100)
+	v.maxLength("description", p.Description, 1000)
+	return v.result()
+}
+
+// MarshalJSON sends createdAt as Unix seconds, which is what clients of GET /playlists expect.
+func (p Playlist) MarshalJSON() ([]byte, error) {
+	type playlist Playlist
+	if p.Songs == nil {
+		p.Songs = []Song{}
+	}
+	if p.SongIDs == nil {
+		p.SongIDs = []string{}
+	}
+	return json.Marshal(struct {
+		playlist
+		CreatedAt int64 `json:"createdAt"`
+	}{playlist(p), p.CreatedAt.Unix()})
+}
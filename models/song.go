@@ -1,8 +1,129 @@
 package models
 
+import (
+	"encoding/json"
+	"regexp"
+	"time"
+)
+
+var yearPattern = regexp.MustCompile(`^\d{4}$`)
+
+// Song is songs/{ID}. Playlists keep full copies of songs (see Playlist.Songs).
+//
+// Fields the background processing adds (loudness, waveform, HLS rendition) are pointers or omitempty, so a
+// song written at upload time leaves them absent until the step that owns them has run.
 type Song struct {
-	ID     uint   `json:"id" gorm:"primaryKey"`
-	Title  string `json:"title"`
-	Artist string `json:"artist"`
-	URL    string `json:"url"`
+	ID          string `firestore:"id" json:"id"`
+	Title       string `firestore:"title" json:"title"`
+	ArtistName  string `firestore:"artistName" json:"artistName"`
+	ArtistID    string `firestore:"artistId" json:"artistId"`
+	Album       string `firestore:"album" json:"album"`
+	AlbumID     string `firestore:"albumId,omitempty" json:"albumId,omitempty"`
+	TrackNumber int    `firestore:"trackNumber" json:"trackNumber"`
+	DiscNumber  int    `firestore:"discNumber" json:"discNumber"`
+	Genre       string `firestore:"genre" json:"genre"`
+	CreatedYear string `firestore:"createdYear" json:"createdYear"`
+
+	// The stored audio; deduplicated uploads point at the object of the song they duplicate
+	FileName         string  `firestore:"fileName" json:"fileName"`
+	OriginalFileName string  `firestore:"originalFileName" json:"originalFileName"`
+	LegacyFileName   string  `firestore:"legacyFileName,omitempty" json:"legacyFileName,omitempty"` // key before MigrateSongKeys
+	FileURL          string  `firestore:"fileUrl" json:"fileUrl"`
+	ContentType      string  `firestore:"contentType" json:"contentType"`
+	Format           string  `firestore:"format" json:"format"`
+	ContentSha1      string  `firestore:"contentSha1" json:"contentSha1"`
+	Duration         float64 `firestore:"duration" json:"duration"` // seconds
+	Bitrate          int     `firestore:"bitrate" json:"bitrate"`   // kbit/s
+	SampleRate       int     `firestore:"sampleRate" json:"sampleRate"`
+	Channels         int     `firestore:"channels" json:"channels"`
+
+	CoverURL    string            `firestore:"coverUrl" json:"coverUrl"`
+	CoverURLs   map[string]string `firestore:"coverUrls,omitempty" json:"coverUrls,omitempty"` // by rendition name
+	CoverSource string            `firestore:"coverSource" json:"coverSource"`                 // upload, embedded, url, placeholder or album
+
+	Likes        int        `firestore:"likes" json:"likes"`
+	Downloads    int        `firestore:"downloads" json:"downloads"`
+	PlayCount    int        `firestore:"playCount" json:"playCount"`
+	LastPlayedAt *time.Time `firestore:"lastPlayedAt,omitempty" json:"lastPlayedAt,omitempty"`
+
+	// upload_user is whatever the client sent with the upload; uploaderUid is the verified uid of the uploader
+	// and decides who may change the song. It is empty for anonymous uploads and songs uploaded before it existed.
+	UploadUser  string    `firestore:"upload_user" json:"upload_user"`
+	UploaderUID string    `firestore:"uploaderUid,omitempty" json:"uploaderUid,omitempty"`
+	UploadedAt  time.Time `firestore:"uploadedAt" json:"uploadedAt"`
+
+	// Background processing (see workers.SongProcessor)
+	Status          string `firestore:"status" json:"status"`
+	ProcessingError string `firestore:"processingError,omitempty" json:"processingError,omitempty"`
+	JobID           string `firestore:"jobId,omitempty" json:"jobId,omitempty"`
+
+	DuplicateOf             string  `firestore:"duplicateOf,omitempty" json:"duplicateOf,omitempty"`
+	NearDuplicateOf         string  `firestore:"nearDuplicateOf,omitempty" json:"nearDuplicateOf,omitempty"`
+	NearDuplicateSimilarity float64 `firestore:"nearDuplicateSimilarity,omitempty" json:"nearDuplicateSimilarity,omitempty"`
+
+	HLSStatus      string `firestore:"hlsStatus,omitempty" json:"hlsStatus,omitempty"`
+	HLSError       string `firestore:"hlsError,omitempty" json:"hlsError,omitempty"`
+	HLSPlaylistKey string `firestore:"hlsPlaylistKey,omitempty" json:"hlsPlaylistKey,omitempty"`
+	HLSPlaylistURL string `firestore:"hlsPlaylistUrl,omitempty" json:"hlsPlaylistUrl,omitempty"`
+	HLSPrefix      string `firestore:"hlsPrefix,omitempty" json:"hlsPrefix,omitempty"`
+
+	Loudness   *Loudness   `firestore:"loudness,omitempty" json:"loudness,omitempty"`
+	ReplayGain *ReplayGain `firestore:"replayGain,omitempty" json:"replayGain,omitempty"`
+	Waveform   *Waveform   `firestore:"waveform,omitempty" json:"waveform,omitempty"`
+}
+
+// Loudness is an EBU R128 measurement of a song, or of an album as a whole.
+type Loudness struct {
+	Integrated float64 `firestore:"integrated" json:"integrated"`           // LUFS
+	Range      float64 `firestore:"range,omitempty" json:"range,omitempty"` // LU, songs only
+	TruePeak   float64 `firestore:"truePeak" json:"truePeak"`               // dBTP
+}
+
+// ReplayGain holds a song's normalization values: gains in dB relative to the ReplayGain reference, linear peaks.
+type ReplayGain struct {
+	TrackGain float64 `firestore:"trackGain" json:"trackGain"`
+	TrackPeak float64 `firestore:"trackPeak" json:"trackPeak"`
+	AlbumGain float64 `firestore:"albumGain" json:"albumGain"`
+	AlbumPeak float64 `firestore:"albumPeak" json:"albumPeak"`
+}
+
+// Waveform records which peak files of a song are stored (see services.WaveformResolutions).
+type Waveform struct {
+	SampleRate  int                           `firestore:"sampleRate" json:"sampleRate"`
+	Resolutions map[string]WaveformResolution `firestore:"resolutions" json:"resolutions"`
+}
+
+// WaveformResolution describes the files stored for one resolution.
+type WaveformResolution struct {
+	Points          int `firestore:"points" json:"points"`
+	SamplesPerPixel int `firestore:"samplesPerPixel" json:"samplesPerPixel"`
+}
+
+// Validate checks the fields every stored song must have.
+func (s *Song) Validate() error {
+	v := newValidator("song")
+	v.required("id", s.ID)
+	v.required("title", s.Title)
+	v.maxLength("title", s.Title, 300)
+	v.required("artistName", s.ArtistName)
+	v.maxLength("artistName", s.ArtistName, 200)
+	v.required("artistId", s.ArtistID)
+	v.maxLength("album", s.Album, 300)
+	v.maxLength("genre", s.Genre, 100)
+	v.check(s.CreatedYear == "" || yearPattern.MatchString(s.CreatedYear), "createdYear", "must be a four-digit year")
+	v.required("fileName", s.FileName)
+	v.required("upload_user", s.UploadUser)
+	v.nonNegative("duration", s.Duration)
+	v.nonNegative("trackNumber", float64(s.TrackNumber))
+	v.nonNegative("discNumber", float64(s.DiscNumber))
+	return v.result()
+}
+
+// MarshalJSON sends uploadedAt as Unix seconds, which is what clients of GET /songs expect.
+func (s Song) MarshalJSON() ([]byte, error) {
+	type song Song
+	return json.Marshal(struct {
+		song
+		UploadedAt int64 `json:"uploadedAt"`
+	}{song(s), s.UploadedAt.Unix()})
 }
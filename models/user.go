@@ -0,0 +1,24 @@
+package models
+
+import (
+	"strings"
+	"time"
+)
+
+// User is users/{UID}, created on registration after Firebase authentication. Playlists are a subcollection.
+type User struct {
+	UID         string    `firestore:"uid" json:"uid"`
+	Email       string    `firestore:"email,omitempty" json:"email,omitempty"`
+	DisplayName string    `firestore:"displayName,omitempty" json:"displayName,omitempty"`
+	PhoneNumber string    `firestore:"phoneNumber,omitempty" json:"phoneNumber,omitempty"`
+	CreatedAt   time.Time `firestore:"createdAt" json:"createdAt"`
+}
+
+// Validate checks the fields every stored user must have.
+func (u *User) Validate() error {
+	v := newValidator("user")
+	v.required("uid", u.UID)
+	v.check(u.Email == "" || strings.Contains(u.Email, "@"), "email", "must be an email address")
+	v.maxLength("displayName", u.DisplayName, 200)
+	return v.result()
+}
@@ -0,0 +1,63 @@
+package models
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// ValidationError lists every field of a document that failed validation, by Firestore field name.
+// The Validate methods of all models return either nil or a *ValidationError.
+type ValidationError struct {
+	Kind   string            // "song", "artist", "album", "playlist" or "user"
+	Fields map[string]string // field name to problem
+}
+
+func (e *ValidationError) Error() string {
+	names := make([]string, 0, len(e.Fields))
+	for name := range e.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	problems := make([]string, len(names))
+	for i, name := range names {
+		problems[i] = name + " " + e.Fields[name]
+	}
+	return fmt.Sprintf("invalid %s: %s", e.Kind, strings.Join(problems, "; "))
+}
+
+// validator collects the problems of one document; the first problem of a field wins.
+type validator struct {
+	err *ValidationError
+}
+
+func newValidator(kind string) *validator {
+	return &validator{err: &ValidationError{Kind: kind, Fields: map[string]string{}}}
+}
+
+func (v *validator) check(ok bool, field, problem string) {
+	if _, seen := v.err.Fields[field]; !ok && !seen {
+		v.err.Fields[field] = problem
+	}
+}
+
+func (v *validator) required(field, value string) {
+	v.check(strings.TrimSpace(value) != "", field, "is required")
+}
+
+func (v *validator) maxLength(field, value string, n int) {
+	v.check(utf8.RuneCountInString(value) <= n, field, fmt.Sprintf("must be at most %d characters", n))
+}
+
+func (v *validator) nonNegative(field string, value float64) {
+	v.check(value >= 0, field, "must not be negative")
+}
+
+// result returns the collected problems, or nil when there are none.
+func (v *validator) result() error {
+	if len(v.err.Fields) == 0 {
+		return nil
+	}
+	return v.err
+}
@@ -3,23 +3,81 @@ package routes
 import (
 	"lipur_backend/controllers"
 	"lipur_backend/middleware"
+	"lipur_backend/search"
 	"lipur_backend/services"
+	"lipur_backend/workers"
 
 	"cloud.google.com/go/firestore"
 	"firebase.google.com/go/auth"
 	"github.com/gin-gonic/gin"
 )
 
-func RegisterRoutes(r *gin.Engine, storageService *services.StorageService, s3Client *services.S3Client, firestoreClient *firestore.Client, authClient *auth.Client) {
-	r.POST("/upload", func(c *gin.Context) {
-		controllers.UploadSong(c, storageService, firestoreClient)
+func RegisterRoutes(r *gin.Engine, storage services.Storage, uploadPolicy *services.UploadPolicy, tusStore *services.TusStore, processor *workers.SongProcessor, fingerprinter *services.Fingerprinter, jobQueue *workers.JobQueue, searchIndex *search.Index, firestoreClient *firestore.Client, authClient *auth.Client) {
+	r.POST("/upload", middleware.OptionalAuthMiddleware(authClient), func(c *gin.Context) {
+		controllers.UploadSong(c, storage, uploadPolicy, processor, fingerprinter, firestoreClient)
 	})
+
+	// Album upload: many files or a ZIP, written as one album in a single batch
+	r.POST("/albums/upload", middleware.OptionalAuthMiddleware(authClient), func(c *gin.Context) {
+		controllers.UploadAlbum(c, storage, uploadPolicy, processor, fingerprinter, firestoreClient)
+	})
+
+	// Resumable uploads (tus 1.0), finishing through the same path as POST /upload
+	tus := r.Group("/uploads/tus", middleware.OptionalAuthMiddleware(authClient))
+	{
+		tus.OPTIONS("", func(c *gin.Context) {
+			controllers.TusOptions(c, uploadPolicy)
+		})
+		tus.POST("", func(c *gin.Context) {
+			controllers.TusCreate(c, tusStore, uploadPolicy)
+		})
+		tus.HEAD("/:id", func(c *gin.Context) {
+			controllers.TusHead(c, tusStore)
+		})
+		tus.PATCH("/:id", func(c *gin.Context) {
+			controllers.TusPatch(c, tusStore, storage, processor, fingerprinter, firestoreClient)
+		})
+		tus.DELETE("/:id", func(c *gin.Context) {
+			controllers.TusDelete(c, tusStore)
+		})
+	}
+
+	// Direct-to-bucket uploads: the client PUTs/POSTs the file to storage between init and complete
+	r.POST("/uploads/init", middleware.OptionalAuthMiddleware(authClient), func(c *gin.Context) {
+		controllers.InitDirectUpload(c, storage, uploadPolicy, firestoreClient)
+	})
+	r.POST("/uploads/complete", middleware.OptionalAuthMiddleware(authClient), func(c *gin.Context) {
+		controllers.CompleteDirectUpload(c, storage, processor, fingerprinter, firestoreClient)
+	})
+
 	r.GET("/stream-url", func(c *gin.Context) {
-		controllers.GetSignedMusicURL(c, storageService)
+		controllers.GetSignedMusicURL(c, storage, firestoreClient)
+	})
+
+	// Background processing status; ?stream=1 (or Accept: text/event-stream) streams updates as server-sent events
+	r.GET("/jobs/:id", func(c *gin.Context) {
+		controllers.GetJob(c, jobQueue)
 	})
+
 	r.GET("/songs", func(c *gin.Context) {
 		controllers.GetSongs(c, firestoreClient)
 	})
+	r.GET("/songs/:id", func(c *gin.Context) {
+		controllers.GetSong(c, firestoreClient)
+	})
+	r.GET("/artists", func(c *gin.Context) {
+		controllers.GetArtists(c, firestoreClient)
+	})
+	r.GET("/search", func(c *gin.Context) {
+		controllers.Search(c, searchIndex)
+	})
+
+	// Signed file URLs of the local storage backend point back at this server
+	if localStorage, ok := storage.(*services.LocalStorage); ok {
+		r.GET("/files/*key", func(c *gin.Context) {
+			controllers.ServeLocalFile(c, localStorage)
+		})
+	}
 
 	// for users
 	// User routes (public for registration and login)
@@ -45,6 +103,31 @@ func RegisterRoutes(r *gin.Engine, storageService *services.StorageService, s3Cl
 		protected.POST("/playlists/:id/songs", func(c *gin.Context) {
 			controllers.AddSongToPlaylist(c, firestoreClient)
 		})
+		protected.GET("/songs/:id/stream", func(c *gin.Context) {
+			controllers.StreamSong(c, storage, firestoreClient)
+		})
+		protected.HEAD("/songs/:id/stream", func(c *gin.Context) {
+			controllers.StreamSong(c, storage, firestoreClient)
+		})
+		protected.GET("/songs/:id/waveform", func(c *gin.Context) {
+			controllers.GetSongWaveform(c, storage, firestoreClient)
+		})
+		protected.PATCH("/songs/:id", func(c *gin.Context) {
+			controllers.UpdateSong(c, storage, firestoreClient)
+		})
+		protected.DELETE("/songs/:id", func(c *gin.Context) {
+			controllers.DeleteSong(c, storage, jobQueue, firestoreClient)
+		})
+		// Runtime metrics (e.g. b2_download_auth_cache hit rate), admins only
+		protected.GET("/debug/vars", func(c *gin.Context) {
+			controllers.DebugVars(c)
+		})
+		protected.GET("/admin/flags", func(c *gin.Context) {
+			controllers.GetModerationFlags(c, firestoreClient)
+		})
+		protected.PATCH("/admin/flags/:id", func(c *gin.Context) {
+			controllers.ResolveModerationFlag(c, firestoreClient)
+		})
 	}
 
 }
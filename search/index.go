@@ -0,0 +1,271 @@
+package search
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Match quality factors: how much a query term matching an indexed term counts, by kind of match.
+const (
+	exactMatch  = 1.0
+	prefixMatch = 0.7 // scaled further by how much of the term the prefix covers
+	fuzzyMatch1 = 0.5 // one edit away
+	fuzzyMatch2 = 0.3 // two edits away
+)
+
+// popularityBoost is how strongly popularity lifts relevance: a document with popularity p scores
+// relevance * (1 + popularityBoost*ln(1+p)).
+const popularityBoost = 0.15
+
+// Document is one searchable item.
+type Document struct {
+	Type   string // "song" or "artist"
+	ID     string
+	Fields []Field     // the text to index
+	Source interface{} // returned with hits, e.g. the models.Song
+}
+
+// Field is indexed text with the weight its matches get: a title counts more than an album name.
+type Field struct {
+	Text   string
+	Weight float64
+}
+
+// Hit is a search result.
+type Hit struct {
+	Document *Document
+	Score    float64
+}
+
+// Index is an in-memory inverted index with prefix and fuzzy matching, ranked by relevance and popularity.
+// It is safe for concurrent use.
+type Index struct {
+	mu         sync.RWMutex
+	docs       map[string]*Document
+	postings   map[string]map[string]float64 // term -> document key -> best field weight
+	popularity map[string]float64            // document key -> popularity, set independently of the document
+	ready      map[string]bool               // types loaded in full at least once
+	terms      []string                      // sorted vocabulary for prefix lookups, nil when stale
+}
+
+func NewIndex() *Index {
+	return &Index{
+		docs:       map[string]*Document{},
+		postings:   map[string]map[string]float64{},
+		popularity: map[string]float64{},
+		ready:      map[string]bool{},
+	}
+}
+
+func docKey(typ, id string) string {
+	return typ + "/" + id
+}
+
+// Put adds or replaces a document.
+func (ix *Index) Put(doc *Document) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.put(doc)
+}
+
+func (ix *Index) put(doc *Document) {
+	key := docKey(doc.Type, doc.ID)
+	ix.remove(key)
+	ix.docs[key] = doc
+	for _, field := range doc.Fields {
+		for _, term := range Tokenize(field.Text) {
+			postings, ok := ix.postings[term]
+			if !ok {
+				postings = map[string]float64{}
+				ix.postings[term] = postings
+				ix.terms = nil
+			}
+			postings[key] = max(postings[key], field.Weight)
+		}
+	}
+}
+
+// Remove deletes a document; its popularity is kept.
+func (ix *Index) Remove(typ, id string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.remove(docKey(typ, id))
+}
+
+func (ix *Index) remove(key string) {
+	doc, ok := ix.docs[key]
+	if !ok {
+		return
+	}
+	delete(ix.docs, key)
+	for _, field := range doc.Fields {
+		for _, term := range Tokenize(field.Text) {
+			if postings, ok := ix.postings[term]; ok {
+				delete(postings, key)
+				if len(postings) == 0 {
+					delete(ix.postings, term)
+					ix.terms = nil
+				}
+			}
+		}
+	}
+}
+
+// Replace swaps every document of a type for docs and marks the type ready.
+func (ix *Index) Replace(typ string, docs []*Document) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	for key, doc := range ix.docs {
+		if doc.Type == typ {
+			ix.remove(key)
+		}
+	}
+	for _, doc := range docs {
+		ix.put(doc)
+	}
+	ix.ready[typ] = true
+}
+
+// SetPopularity sets how popular a document is (plays, likes, ...); it only affects ranking.
+func (ix *Index) SetPopularity(typ, id string, popularity float64) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.popularity[docKey(typ, id)] = popularity
+}
+
+// Ready reports whether every given type has been loaded in full.
+func (ix *Index) Ready(types ...string) bool {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	for _, typ := range types {
+		if !ix.ready[typ] {
+			return false
+		}
+	}
+	return true
+}
+
+// Len is the number of indexed documents.
+func (ix *Index) Len() int {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return len(ix.docs)
+}
+
+// Search returns the best limit hits for query among documents of the given type ("" for all types) and the
+// total number of matches. Every query term must match the document exactly, as a prefix of one of its terms,
+// or within one or two typos.
+func (ix *Index) Search(query, typ string, limit int) ([]Hit, int) {
+	queryTerms := Tokenize(query)
+	if len(queryTerms) == 0 {
+		return nil, 0
+	}
+
+	// The vocabulary is rebuilt after changes rather than kept sorted on every Put. A snapshot of it is used
+	// below, as it is only ever replaced, never modified.
+	ix.mu.Lock()
+	if ix.terms == nil {
+		ix.terms = make([]string, 0, len(ix.postings))
+		for term := range ix.postings {
+			ix.terms = append(ix.terms, term)
+		}
+		sort.Strings(ix.terms)
+	}
+	terms := ix.terms
+	ix.mu.Unlock()
+
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	total := float64(len(ix.docs))
+	var scores map[string]float64
+	for _, qt := range queryTerms {
+		termScores := map[string]float64{}
+		for term, quality := range expand(qt, terms) {
+			postings, ok := ix.postings[term]
+			if !ok {
+				continue // removed since the vocabulary snapshot
+			}
+			idf := math.Log(1 + total/float64(len(postings)))
+			for key, weight := range postings {
+				termScores[key] = max(termScores[key], quality*weight*idf)
+			}
+		}
+		// Documents must match every query term
+		if scores == nil {
+			scores = termScores
+			continue
+		}
+		for key, score := range scores {
+			if ts, ok := termScores[key]; ok {
+				scores[key] = score + ts
+			} else {
+				delete(scores, key)
+			}
+		}
+	}
+
+	hits := make([]Hit, 0, len(scores))
+	for key, relevance := range scores {
+		doc := ix.docs[key]
+		if typ != "" && doc.Type != typ {
+			continue
+		}
+		score := relevance * (1 + popularityBoost*math.Log1p(ix.popularity[key]))
+		hits = append(hits, Hit{Document: doc, Score: math.Round(score*1000) / 1000})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].Document.ID < hits[j].Document.ID
+	})
+	count := len(hits)
+	if len(hits) > limit {
+		hits = hits[:limit]
+	}
+	return hits, count
+}
+
+// expand finds the indexed terms a query term matches, with the quality of each match. Prefixes need two
+// characters; typos are tolerated from four characters (one) and eight characters (two).
+func expand(qt string, terms []string) map[string]float64 {
+	matches := map[string]float64{}
+	i := sort.SearchStrings(terms, qt)
+	if i < len(terms) && terms[i] == qt {
+		matches[qt] = exactMatch
+	}
+	if len(qt) >= 2 {
+		for ; i < len(terms) && strings.HasPrefix(terms[i], qt); i++ {
+			if term := terms[i]; term != qt {
+				matches[term] = prefixMatch * (0.5 + 0.5*float64(len(qt))/float64(len(term)))
+			}
+		}
+	}
+
+	query := []rune(qt)
+	maxEdits := 0
+	switch {
+	case len(query) >= 8:
+		maxEdits = 2
+	case len(query) >= 4:
+		maxEdits = 1
+	}
+	if maxEdits > 0 {
+		for _, term := range terms {
+			if _, ok := matches[term]; ok {
+				continue
+			}
+			switch d := editDistance(query, []rune(term), maxEdits); {
+			case d > maxEdits:
+			case d == 1:
+				matches[term] = fuzzyMatch1
+			case d == 2:
+				matches[term] = fuzzyMatch2
+			}
+		}
+	}
+	return matches
+}
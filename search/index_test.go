@@ -0,0 +1,207 @@
+package search
+
+import (
+	"slices"
+	"testing"
+)
+
+func song(id, title, artist string) *Document {
+	return &Document{Type: "song", ID: id, Fields: []Field{{title, 3}, {artist, 2}}}
+}
+
+func artist(id, name string) *Document {
+	return &Document{Type: "artist", ID: id, Fields: []Field{{name, 3}}}
+}
+
+func hitIDs(hits []Hit) []string {
+	ids := make([]string, len(hits))
+	for i, hit := range hits {
+		ids[i] = hit.Document.ID
+	}
+	return ids
+}
+
+func testIndex() *Index {
+	ix := NewIndex()
+	ix.Replace("song", []*Document{
+		song("s1", "Yesterday", "The Beatles"),
+		song("s2", "Let It Be", "The Beatles"),
+		song("s3", "Beat It", "Michael Jackson"),
+		song("s4", "Halo", "Beyoncé"),
+		song("s5", "Bohemian Rhapsody", "Queen"),
+		song("s6", "Don't Stop Me Now", "Queen"),
+	})
+	ix.Replace("artist", []*Document{
+		artist("a1", "The Beatles"),
+		artist("a2", "Queen"),
+		artist("a3", "Beyoncé"),
+	})
+	return ix
+}
+
+func TestSearchMatching(t *testing.T) {
+	ix := testIndex()
+	tests := []struct {
+		name  string
+		query string
+		typ   string
+		want  []string // in any order
+	}{
+		{"exact", "halo", "song", []string{"s4"}},
+		{"every term must match", "beatles yesterday", "", []string{"s1"}},
+		{"prefix", "bohem", "", []string{"s5"}},
+		{"prefix of several terms", "beat", "song", []string{"s1", "s2", "s3"}},
+		{"single character is no prefix", "b", "", nil},
+		{"accents ignored", "beyonce", "", []string{"s4", "a3"}},
+		{"apostrophe dropped", "dont stop", "", []string{"s6"}},
+		{"one typo from four characters", "qeen", "artist", []string{"a2"}},
+		{"one typo in a short term", "hslo", "", []string{"s4"}},
+		{"no typo below four characters", "hla", "", nil},
+		{"two typos from eight characters", "bohemain rapsody", "", []string{"s5"}},
+		{"three typos are too many", "yestrdya", "", nil},
+		{"type filter", "queen", "artist", []string{"a2"}},
+		{"all types", "queen", "", []string{"s5", "s6", "a2"}},
+		{"no terms", "!!!", "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hits, total := ix.Search(tt.query, tt.typ, 10)
+			got := hitIDs(hits)
+			slices.Sort(got)
+			want := slices.Clone(tt.want)
+			slices.Sort(want)
+			if !slices.Equal(got, want) {
+				t.Errorf("Search(%q) = %v, want %v", tt.query, got, want)
+			}
+			if total != len(tt.want) {
+				t.Errorf("Search(%q) total = %d, want %d", tt.query, total, len(tt.want))
+			}
+		})
+	}
+}
+
+func TestSearchRanking(t *testing.T) {
+	// Every term occurs once, so only the kind of match decides
+	ix := NewIndex()
+	ix.Replace("song", []*Document{
+		song("exact", "River", "Someone"),
+		song("prefix", "Riverside", "Anyone"),
+		song("typo", "Rover", "Nobody"),
+	})
+	hits, _ := ix.Search("river", "song", 10)
+	if got, want := hitIDs(hits), []string{"exact", "prefix", "typo"}; !slices.Equal(got, want) {
+		t.Errorf("ranking = %v, want %v", got, want)
+	}
+	for i := 1; i < len(hits); i++ {
+		if hits[i].Score >= hits[i-1].Score {
+			t.Errorf("scores not strictly decreasing: %v", hits)
+		}
+	}
+
+	// A prefix covering more of the term ranks higher
+	hits, _ = ix.Search("riv", "song", 10)
+	if got, want := hitIDs(hits), []string{"exact", "prefix"}; !slices.Equal(got, want) {
+		t.Errorf("prefix ranking = %v, want %v", got, want)
+	}
+
+	// The same term weighs more in a title than in an artist name
+	ix = NewIndex()
+	ix.Replace("song", []*Document{song("title", "River", "Someone"), song("artist", "Other", "River")})
+	hits, _ = ix.Search("river", "song", 10)
+	if got, want := hitIDs(hits), []string{"title", "artist"}; !slices.Equal(got, want) {
+		t.Errorf("field ranking = %v, want %v", got, want)
+	}
+}
+
+func TestSearchPopularity(t *testing.T) {
+	ix := NewIndex()
+	ix.Replace("song", []*Document{song("a", "Hello", "X"), song("b", "Hello", "Y")})
+
+	// Equal scores fall back to the ID
+	hits, _ := ix.Search("hello", "", 10)
+	if got := hitIDs(hits); !slices.Equal(got, []string{"a", "b"}) {
+		t.Errorf("tie = %v, want [a b]", got)
+	}
+
+	ix.SetPopularity("song", "b", 1000)
+	hits, _ = ix.Search("hello", "", 10)
+	if got := hitIDs(hits); !slices.Equal(got, []string{"b", "a"}) {
+		t.Errorf("with popularity = %v, want [b a]", got)
+	}
+
+	// Popularity survives the document being replaced
+	ix.Put(song("b", "Hello Again", "Y"))
+	hits, _ = ix.Search("hello", "", 10)
+	if got := hitIDs(hits); !slices.Equal(got, []string{"b", "a"}) {
+		t.Errorf("after Put = %v, want [b a]", got)
+	}
+}
+
+func TestSearchLimit(t *testing.T) {
+	ix := testIndex()
+	hits, total := ix.Search("the", "", 2)
+	if len(hits) != 2 || total != 3 {
+		t.Errorf("Search = %d hits of %d, want 2 of 3", len(hits), total)
+	}
+}
+
+func TestIndexUpdates(t *testing.T) {
+	ix := testIndex()
+	if !ix.Ready("song", "artist") || ix.Ready("album") {
+		t.Error("Ready does not reflect the loaded types")
+	}
+
+	// Replacing a document drops its old terms
+	ix.Put(song("s4", "Crazy in Love", "Beyoncé"))
+	if hits, _ := ix.Search("halo", "", 10); len(hits) != 0 {
+		t.Errorf("old title still found: %v", hitIDs(hits))
+	}
+	if hits, _ := ix.Search("crazy", "", 10); !slices.Equal(hitIDs(hits), []string{"s4"}) {
+		t.Errorf("new title not found: %v", hitIDs(hits))
+	}
+
+	ix.Remove("song", "s5")
+	if hits, _ := ix.Search("bohemian", "", 10); len(hits) != 0 {
+		t.Errorf("removed song still found: %v", hitIDs(hits))
+	}
+
+	ix.Replace("artist", nil)
+	if n := ix.Len(); n != 5 {
+		t.Errorf("Len = %d after removing a song and all artists, want 5", n)
+	}
+}
+
+func TestTokenize(t *testing.T) {
+	tests := map[string][]string{
+		"Beyoncé – Crazy in Love": {"beyonce", "crazy", "in", "love"},
+		"Don't Stop Me Now":       {"dont", "stop", "me", "now"},
+		"AC/DC: Back in Black":    {"ac", "dc", "back", "in", "black"},
+		"Sigur Rós ÁRSTÍÐIR":      {"sigur", "ros", "arstiðir"},
+		"  ":                      nil,
+	}
+	for text, want := range tests {
+		if got := Tokenize(text); !slices.Equal(got, want) {
+			t.Errorf("Tokenize(%q) = %q, want %q", text, got, want)
+		}
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		max  int
+		want int
+	}{
+		{"queen", "queen", 2, 0},
+		{"queen", "qeen", 2, 1},
+		{"queen", "quene", 2, 2},
+		{"kitten", "sitting", 3, 3},
+		{"kitten", "sitting", 1, 2}, // past max: max+1
+		{"abc", "abcdef", 2, 3},     // length difference alone exceeds max
+	}
+	for _, tt := range tests {
+		if got := editDistance([]rune(tt.a), []rune(tt.b), tt.max); got != tt.want {
+			t.Errorf("editDistance(%q, %q, %d) = %d, want %d", tt.a, tt.b, tt.max, got, tt.want)
+		}
+	}
+}
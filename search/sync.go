@@ -0,0 +1,170 @@
+package search
+
+import (
+	"context"
+	"lipur_backend/models"
+	"log"
+	"time"
+
+	"cloud.google.com/go/firestore"
+)
+
+// Document types.
+const (
+	TypeSong   = "song"
+	TypeArtist = "artist"
+)
+
+// How long a broken listener waits before listening again, doubling up to syncMaxBackoff.
+const (
+	syncBackoff    = time.Second
+	syncMaxBackoff = time.Minute
+)
+
+// syncer keeps an Index in line with the songs and artists collections.
+type syncer struct {
+	index *Index
+
+	// Artists are as popular as their songs together; only the songs listener touches these
+	songArtist     map[string]string  // song ID -> artist ID
+	songPopularity map[string]float64 // song ID -> popularity
+	artistTotals   map[string]float64 // artist ID -> summed popularity of its songs
+}
+
+// Sync loads the songs and artists collections into the index and keeps it up to date with Firestore
+// snapshot listeners until ctx is done. The first snapshot of a listener holds every document, so the index is
+// rebuilt from scratch on startup and whenever a listener has to be restarted.
+func (ix *Index) Sync(ctx context.Context, firestoreClient *firestore.Client) {
+	s := &syncer{
+		index:          ix,
+		songArtist:     map[string]string{},
+		songPopularity: map[string]float64{},
+		artistTotals:   map[string]float64{},
+	}
+	go s.listen(ctx, firestoreClient.Collection("songs"), TypeSong, s.songDocument)
+	go s.listen(ctx, firestoreClient.Collection("artists"), TypeArtist, s.artistDocument)
+}
+
+// listen applies the snapshots of collection to the index, restarting the listener when it fails.
+func (s *syncer) listen(ctx context.Context, collection *firestore.CollectionRef, typ string, toDocument func(*firestore.DocumentSnapshot) *Document) {
+	backoff := syncBackoff
+	for ctx.Err() == nil {
+		it := collection.Snapshots(ctx)
+		first := true
+		for {
+			snap, err := it.Next()
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Printf("Search: %s listener failed: %v", collection.ID, err)
+				}
+				break
+			}
+			if first {
+				docs, err := snap.Documents.GetAll()
+				if err != nil {
+					log.Printf("Search: failed to load %s: %v", collection.ID, err)
+					break
+				}
+				if typ == TypeSong {
+					s.resetSongs()
+				}
+				indexed := make([]*Document, 0, len(docs))
+				for _, doc := range docs {
+					if d := toDocument(doc); d != nil {
+						indexed = append(indexed, d)
+					}
+				}
+				s.index.Replace(typ, indexed)
+				log.Printf("Search: indexed %d %ss", len(indexed), typ)
+				first, backoff = false, syncBackoff
+				continue
+			}
+			for _, change := range snap.Changes {
+				var d *Document
+				if change.Kind != firestore.DocumentRemoved {
+					d = toDocument(change.Doc)
+				}
+				if d != nil {
+					s.index.Put(d)
+					continue
+				}
+				// Removed, or changed into something that no longer decodes: either way its old entry is stale
+				if typ == TypeSong {
+					s.removeSong(change.Doc.Ref.ID)
+				}
+				s.index.Remove(typ, change.Doc.Ref.ID)
+			}
+		}
+		it.Stop()
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, syncMaxBackoff)
+	}
+}
+
+func (s *syncer) songDocument(doc *firestore.DocumentSnapshot) *Document {
+	var song models.Song
+	if err := doc.DataTo(&song); err != nil {
+		log.Printf("Search: skipping song %s: %v", doc.Ref.ID, err)
+		return nil
+	}
+	song.ID = doc.Ref.ID
+	s.setSongPopularity(song.ID, song.ArtistID, float64(song.PlayCount+2*song.Likes+song.Downloads))
+	return &Document{
+		Type: TypeSong,
+		ID:   song.ID,
+		Fields: []Field{
+			{Text: song.Title, Weight: 3},
+			{Text: song.ArtistName, Weight: 2},
+			{Text: song.Album, Weight: 1.5},
+			{Text: song.Genre, Weight: 0.5},
+		},
+		Source: &song,
+	}
+}
+
+func (s *syncer) artistDocument(doc *firestore.DocumentSnapshot) *Document {
+	var artist models.Artist
+	if err := doc.DataTo(&artist); err != nil {
+		log.Printf("Search: skipping artist %s: %v", doc.Ref.ID, err)
+		return nil
+	}
+	// Artists created before documents carried their ID
+	artist.ID = doc.Ref.ID
+	return &Document{
+		Type:   TypeArtist,
+		ID:     artist.ID,
+		Fields: []Field{{Text: artist.Name, Weight: 3}},
+		Source: &artist,
+	}
+}
+
+func (s *syncer) setSongPopularity(songId, artistId string, popularity float64) {
+	s.removeSong(songId)
+	s.songArtist[songId] = artistId
+	s.songPopularity[songId] = popularity
+	s.artistTotals[artistId] += popularity
+	s.index.SetPopularity(TypeSong, songId, popularity)
+	s.index.SetPopularity(TypeArtist, artistId, s.artistTotals[artistId])
+}
+
+// removeSong takes a song's popularity out of its artist's total.
+func (s *syncer) removeSong(songId string) {
+	artistId, ok := s.songArtist[songId]
+	if !ok {
+		return
+	}
+	s.artistTotals[artistId] -= s.songPopularity[songId]
+	s.index.SetPopularity(TypeArtist, artistId, s.artistTotals[artistId])
+	delete(s.songArtist, songId)
+	delete(s.songPopularity, songId)
+}
+
+func (s *syncer) resetSongs() {
+	for songId := range s.songArtist {
+		s.removeSong(songId)
+	}
+}
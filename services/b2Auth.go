@@ -0,0 +1,157 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const (
+	// B2 account and upload tokens are valid for 24h; refresh an hour early so in-flight requests never carry an expired one.
+	tokenRefreshAfter = 23 * time.Hour
+	// uploadURLPoolSize caps how many idle upload URL/token pairs are kept between uploads.
+	uploadURLPoolSize = 8
+)
+
+// b2Account is a snapshot of the credentials returned by b2_authorize_account.
+type b2Account struct {
+	AuthToken      string
+	APIUrl         string
+	DownloadUrl    string
+	ShortAccountID string // SHORT ID (from auth response)
+	S3ApiUrl       string // S3-compatible endpoint of the account's region
+	authorizedAt   time.Time
+}
+
+func (a b2Account) valid() bool {
+	return a.AuthToken != "" && time.Since(a.authorizedAt) < tokenRefreshAfter
+}
+
+// account returns valid credentials, authorizing first when there are none or they are about to expire.
+func (s *StorageService) account() (b2Account, error) {
+	s.mu.RLock()
+	acct := s.acct
+	s.mu.RUnlock()
+	if acct.valid() {
+		return acct, nil
+	}
+
+	// Only one goroutine re-authorizes; the others wait and pick up its result.
+	s.authMu.Lock()
+	defer s.authMu.Unlock()
+
+	s.mu.RLock()
+	acct = s.acct
+	s.mu.RUnlock()
+	if acct.valid() {
+		return acct, nil
+	}
+
+	if err := s.Authenticate(); err != nil {
+		return b2Account{}, fmt.Errorf("failed to authenticate: %w", err)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.acct, nil
+}
+
+// invalidateAccount drops the cached credentials if they still carry token, so the next call re-authorizes.
+// Comparing the token keeps concurrent callers from discarding credentials another goroutine just refreshed.
+func (s *StorageService) invalidateAccount(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.acct.AuthToken == token {
+		s.acct = b2Account{DownloadUrl: s.acct.DownloadUrl, S3ApiUrl: s.acct.S3ApiUrl}
+	}
+}
+
+// b2Error is the JSON error body B2 returns on every failed API call.
+type b2Error struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *b2Error) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Status, e.Code, e.Message)
+}
+
+// parseB2Error reads a failed response into a *b2Error, falling back to the raw body.
+func parseB2Error(res *http.Response) *b2Error {
+	bodyBytes, _ := ioutil.ReadAll(res.Body)
+	b2Err := &b2Error{}
+	if err := json.Unmarshal(bodyBytes, b2Err); err != nil || b2Err.Code == "" {
+		b2Err.Code = "unknown"
+		b2Err.Message = string(bodyBytes)
+	}
+	if b2Err.Status == 0 {
+		b2Err.Status = res.StatusCode
+	}
+	return b2Err
+}
+
+func isB2AuthError(err error) bool {
+	var b2Err *b2Error
+	if !errors.As(err, &b2Err) {
+		return false
+	}
+	return b2Err.Status == http.StatusUnauthorized &&
+		(b2Err.Code == "expired_auth_token" || b2Err.Code == "bad_auth_token")
+}
+
+// isB2RetryableUploadError reports whether an upload should be retried with a new upload URL:
+// the token was rejected, or the pod behind the URL is busy or timed out.
+func isB2RetryableUploadError(err error) bool {
+	var b2Err *b2Error
+	if !errors.As(err, &b2Err) {
+		return false
+	}
+	switch b2Err.Status {
+	case http.StatusUnauthorized, http.StatusRequestTimeout, http.StatusServiceUnavailable:
+		return true
+	}
+	return false
+}
+
+// pooledUploadURL is an upload URL/token pair from b2_get_upload_url or b2_get_upload_part_url.
+// B2 forbids concurrent uploads to the same URL, so a pair is held by one upload at a time.
+type pooledUploadURL struct {
+	UploadUrl          string `json:"uploadUrl"`
+	AuthorizationToken string `json:"authorizationToken"`
+	fetchedAt          time.Time
+}
+
+// acquireUploadURL takes an idle upload URL from the pool, or asks B2 for a new one.
+func (s *StorageService) acquireUploadURL(ctx context.Context) (pooledUploadURL, error) {
+	for {
+		select {
+		case u := <-s.uploadURLs:
+			if time.Since(u.fetchedAt) < tokenRefreshAfter {
+				return u, nil
+			}
+		default:
+			bucketID, err := s.getBucketID(ctx)
+			if err != nil {
+				return pooledUploadURL{}, err
+			}
+			var u pooledUploadURL
+			if err := s.b2Call(ctx, "b2_get_upload_url", map[string]string{"bucketId": bucketID}, &u); err != nil {
+				return pooledUploadURL{}, err
+			}
+			u.fetchedAt = time.Now()
+			return u, nil
+		}
+	}
+}
+
+// releaseUploadURL returns a pair that completed an upload successfully; it is dropped if the pool is full.
+func (s *StorageService) releaseUploadURL(u pooledUploadURL) {
+	select {
+	case s.uploadURLs <- u:
+	default:
+	}
+}
@@ -0,0 +1,81 @@
+package services
+
+import (
+	"expvar"
+	"sync"
+	"time"
+)
+
+// Download authorizations are requested for this much longer than the URLs need, so one can be reused for
+// that long while still covering the full ttl of every URL built from it.
+const downloadAuthReuseWindow = time.Hour
+
+// maxDownloadAuthDuration is the longest validity b2_get_download_authorization accepts.
+const maxDownloadAuthDuration = 7 * 24 * time.Hour
+
+// downloadAuthStats is published on /debug/vars as "b2_download_auth_cache".
+var downloadAuthStats = expvar.NewMap("b2_download_auth_cache")
+
+func init() {
+	downloadAuthStats.Set("hitRate", expvar.Func(func() interface{} {
+		hits := downloadAuthStats.Get("hits")
+		misses := downloadAuthStats.Get("misses")
+		if hits == nil || misses == nil {
+			return 0.0
+		}
+		h := hits.(*expvar.Int).Value()
+		total := h + misses.(*expvar.Int).Value()
+		if total == 0 {
+			return 0.0
+		}
+		return float64(h) / float64(total)
+	}))
+	downloadAuthStats.Add("hits", 0)
+	downloadAuthStats.Add("misses", 0)
+}
+
+type downloadAuth struct {
+	token     string
+	expiresAt time.Time
+}
+
+// downloadAuthCache maps a file name prefix to its b2_get_download_authorization token.
+type downloadAuthCache struct {
+	mu      sync.Mutex
+	entries map[string]downloadAuth
+}
+
+// get returns a cached token for prefix that stays valid for at least ttl from now.
+func (c *downloadAuthCache) get(prefix string, ttl time.Duration) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[prefix]
+	if !ok || entry.expiresAt.Before(time.Now().Add(ttl)) {
+		downloadAuthStats.Add("misses", 1)
+		return "", false
+	}
+	downloadAuthStats.Add("hits", 1)
+	return entry.token, true
+}
+
+func (c *downloadAuthCache) put(prefix, token string, expiresAt time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Sweep stale entries as new ones arrive so the map stays proportional to the active catalog.
+	now := time.Now()
+	for p, entry := range c.entries {
+		if now.After(entry.expiresAt) {
+			delete(c.entries, p)
+		}
+	}
+	c.entries[prefix] = downloadAuth{token: token, expiresAt: expiresAt}
+	downloadAuthStats.Set("size", expvarInt(int64(len(c.entries))))
+}
+
+func expvarInt(v int64) *expvar.Int {
+	i := new(expvar.Int)
+	i.Set(v)
+	return i
+}
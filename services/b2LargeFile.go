@@ -0,0 +1,186 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// filePart is one chunk of a large file waiting to be sent with b2_upload_part.
+type filePart struct {
+	number int // 1-based, as B2 expects
+	body   io.ReadSeeker
+	size   int64
+	sha1   string
+}
+
+// uploadLargeFile uploads body with b2_start_large_file / b2_upload_part / b2_finish_large_file.
+// Parts are uploaded in parallel; on any failure the large file is cancelled so no parts linger in the bucket.
+func (s *StorageService) uploadLargeFile(ctx context.Context, key string, body io.Reader, size int64, contentType string) (*FileInfo, error) {
+	bucketID, err := s.getBucketID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var started struct {
+		FileID string `json:"fileId"`
+	}
+	err = s.b2Call(ctx, "b2_start_large_file", map[string]string{
+		"bucketId":    bucketID,
+		"fileName":    key,
+		"contentType": contentType,
+	}, &started)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Started large file %s (%d bytes) as %s", key, size, started.FileID)
+
+	partSha1s, fileSha1, err := s.uploadParts(ctx, started.FileID, body, size)
+	if err != nil {
+		// Use a fresh context: ctx may be the reason we failed.
+		cancelErr := s.b2Call(context.Background(), "b2_cancel_large_file", map[string]string{"fileId": started.FileID}, nil)
+		if cancelErr != nil {
+			log.Printf("Failed to cancel large file %s: %v", started.FileID, cancelErr)
+		}
+		return nil, err
+	}
+
+	var finished b2FileResponse
+	err = s.b2Call(ctx, "b2_finish_large_file", map[string]interface{}{
+		"fileId":        started.FileID,
+		"partSha1Array": partSha1s,
+	}, &finished)
+	if err != nil {
+		return nil, err
+	}
+	info := s.toFileInfo(key, finished)
+	info.SHA1 = fileSha1
+	return info, nil
+}
+
+// uploadParts splits body into PartSize chunks and uploads them with UploadConcurrency workers.
+// It returns the SHA-1 of every part in part order and the SHA-1 of the whole file.
+func (s *StorageService) uploadParts(ctx context.Context, fileID string, body io.Reader, size int64) ([]string, string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	partCount := int((size + s.PartSize - 1) / s.PartSize)
+	partSha1s := make([]string, partCount)
+	fileHash := sha1.New()
+	parts := make(chan filePart)
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	for i := 0; i < s.UploadConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// B2 forbids concurrent uploads to one URL, so every worker gets its own.
+			var partURL pooledUploadURL
+			if err := s.b2Call(ctx, "b2_get_upload_part_url", map[string]string{"fileId": fileID}, &partURL); err != nil {
+				fail(err)
+				return
+			}
+			for part := range parts {
+				err := s.uploadPart(ctx, partURL, part)
+				if isB2RetryableUploadError(err) {
+					// The URL is unusable now; fetch a fresh one and retry the part once.
+					if err = s.b2Call(ctx, "b2_get_upload_part_url", map[string]string{"fileId": fileID}, &partURL); err == nil {
+						err = s.uploadPart(ctx, partURL, part)
+					}
+				}
+				if err != nil {
+					fail(fmt.Errorf("part %d: %w", part.number, err))
+					return
+				}
+			}
+		}()
+	}
+
+	// Random-access bodies (multipart temp files) are read in place; anything else is buffered one part at a time.
+	readerAt, seekable := body.(io.ReaderAt)
+produce:
+	for n := 1; n <= partCount; n++ {
+		offset := int64(n-1) * s.PartSize
+		partSize := min(s.PartSize, size-offset)
+
+		var section io.ReadSeeker
+		if seekable {
+			section = io.NewSectionReader(readerAt, offset, partSize)
+		} else {
+			buf := make([]byte, partSize)
+			if _, err := io.ReadFull(body, buf); err != nil {
+				fail(fmt.Errorf("failed to read part %d: %w", n, err))
+				break
+			}
+			section = bytes.NewReader(buf)
+		}
+
+		// Parts are produced in order, so the whole-file hash can be fed alongside the part hash.
+		h := sha1.New()
+		if _, err := io.Copy(io.MultiWriter(h, fileHash), section); err != nil {
+			fail(fmt.Errorf("failed to hash part %d: %w", n, err))
+			break
+		}
+		partSha1s[n-1] = hex.EncodeToString(h.Sum(nil))
+
+		select {
+		case parts <- filePart{number: n, body: section, size: partSize, sha1: partSha1s[n-1]}:
+		case <-ctx.Done():
+			break produce
+		}
+	}
+	close(parts)
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, "", firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+	return partSha1s, hex.EncodeToString(fileHash.Sum(nil)), nil
+}
+
+func (s *StorageService) uploadPart(ctx context.Context, partURL pooledUploadURL, part filePart) error {
+	if _, err := part.body.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", partURL.UploadUrl, part.body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = part.size
+	req.Header.Set("Authorization", partURL.AuthorizationToken)
+	req.Header.Set("X-Bz-Part-Number", strconv.Itoa(part.number))
+	req.Header.Set("X-Bz-Content-Sha1", part.sha1)
+
+	res, err := uploadClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		return fmt.Errorf("upload part failed: %w", parseB2Error(res))
+	}
+	return nil
+}
@@ -1,26 +1,31 @@
 package services
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"io/ioutil"
-	"log"
-	"net/http"
+	"io"
 	"net/url"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
 type S3Client struct {
 	s3Client      *s3.Client
 	presignClient *s3.PresignClient
+	bucketName    string
+	endpoint      string
 }
 
 // NewS3Client initializes the S3 client for Backblaze B2
@@ -30,8 +35,9 @@ func NewS3Client() (*S3Client, error) {
 	appKey := os.Getenv("B2_APPLICATION_KEY")
 	region := os.Getenv("B2_REGION")
 	endpoint := os.Getenv("B2_ENDPOINT")
-	if accountID == "" || appKey == "" || region == "" || endpoint == "" {
-		return nil, fmt.Errorf("missing required env vars: B2_ACCOUNT_ID, B2_APPLICATION_KEY, B2_REGION, or B2_ENDPOINT")
+	bucketName := os.Getenv("B2_BUCKET_NAME")
+	if accountID == "" || appKey == "" || region == "" || endpoint == "" || bucketName == "" {
+		return nil, fmt.Errorf("missing required env vars: B2_ACCOUNT_ID, B2_APPLICATION_KEY, B2_REGION, B2_ENDPOINT, or B2_BUCKET_NAME")
 	}
 
 	// Load AWS SDK configuration for Backblaze B2
@@ -60,70 +66,194 @@ func NewS3Client() (*S3Client, error) {
 	return &S3Client{
 		s3Client:      client,
 		presignClient: s3.NewPresignClient(client),
+		bucketName:    bucketName,
+		endpoint:      endpoint,
 	}, nil
 }
 
-// GenerateSignedURL creates a pre-signed URL using B2 Native API
-func (s *StorageService) GenerateSignedURL(fileName string) (string, error) {
-	if s.AuthToken == "" || s.APIUrl == "" || s.ShortAccountID == "" {
-		if err := s.Authenticate(); err != nil {
-			return "", fmt.Errorf("failed to authenticate: %w", err)
-		}
+func (c *S3Client) publicURL(key string) string {
+	return fmt.Sprintf("https://%s/%s/%s", c.endpoint, c.bucketName, escapeKey(key))
+}
+
+// isS3NotFound reports whether err is the S3 "no such key" error (HeadObject returns a bare 404).
+func isS3NotFound(err error) bool {
+	var noSuchKey *types.NoSuchKey
+	var notFound *types.NotFound
+	return errors.As(err, &noSuchKey) || errors.As(err, &notFound)
+}
+
+func (c *S3Client) UploadFile(ctx context.Context, key string, body io.Reader, size int64, contentType string) (*FileInfo, error) {
+	content := newSHA1Reader(body)
+	input := &s3.PutObjectInput{
+		Bucket:        aws.String(c.bucketName),
+		Key:           aws.String(key),
+		Body:          content,
+		ContentLength: aws.Int64(size),
+	}
+	if contentType != "" {
+		input.ContentType = aws.String(contentType)
 	}
 
-	bucketID, err := s.getBucketID()
+	// Non-seekable bodies cannot be hashed up front, so sign them as UNSIGNED-PAYLOAD (safe over HTTPS).
+	out, err := c.s3Client.PutObject(ctx, input, s3.WithAPIOptions(v4.SwapComputePayloadSHA256ForUnsignedPayloadMiddleware))
 	if err != nil {
-		return "", fmt.Errorf("failed to get bucket ID: %w", err)
+		return nil, fmt.Errorf("failed to upload object: %w", err)
 	}
 
-	requestBody := map[string]interface{}{
-		"bucketId":               bucketID,
-		"fileNamePrefix":         fileName,
-		"validDurationInSeconds": 3600, // 1 hour
+	return &FileInfo{
+		Key:         key,
+		Size:        size,
+		ContentType: contentType,
+		ETag:        strings.Trim(aws.ToString(out.ETag), `"`),
+		SHA1:        content.Sum(),
+		URL:         c.publicURL(key),
+		UpdatedAt:   time.Now(),
+	}, nil
+}
+
+func (c *S3Client) DeleteFile(ctx context.Context, key string) error {
+	_, err := c.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(c.bucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil && !isS3NotFound(err) {
+		return fmt.Errorf("failed to delete object: %w", err)
 	}
+	return nil
+}
 
-	body, err := json.Marshal(requestBody)
-	if err != nil {
-		return "", fmt.Errorf("failed to marshal request body: %w", err)
+func (c *S3Client) ListFiles(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	pages := s3.NewListObjectsV2Paginator(c.s3Client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(c.bucketName),
+		Prefix: aws.String(prefix),
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list objects: %w", err)
+		}
+		for _, obj := range page.Contents {
+			keys = append(keys, aws.ToString(obj.Key))
+		}
 	}
+	return keys, nil
+}
 
-	req, err := http.NewRequest("POST", s.APIUrl+"/b2api/v2/b2_get_download_authorization", bytes.NewBuffer(body))
+func (c *S3Client) StatFile(ctx context.Context, key string) (*FileInfo, error) {
+	out, err := c.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:       aws.String(c.bucketName),
+		Key:          aws.String(key),
+		ChecksumMode: types.ChecksumModeEnabled,
+	})
 	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
+		if isS3NotFound(err) {
+			return nil, ErrFileNotFound
+		}
+		return nil, fmt.Errorf("failed to stat object: %w", err)
 	}
-	req.Header.Set("Authorization", s.AuthToken)
-	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
+	info := &FileInfo{
+		Key:         key,
+		Size:        aws.ToInt64(out.ContentLength),
+		ContentType: aws.ToString(out.ContentType),
+		ETag:        strings.Trim(aws.ToString(out.ETag), `"`),
+		URL:         c.publicURL(key),
+		UpdatedAt:   aws.ToTime(out.LastModified),
+	}
+	// Only objects uploaded with a SHA-1 checksum (direct uploads) have one; the bucket verified it
+	if sum, err := base64.StdEncoding.DecodeString(aws.ToString(out.ChecksumSHA1)); err == nil && len(sum) == sha1.Size {
+		info.SHA1 = hex.EncodeToString(sum)
+	}
+	return info, nil
+}
+
+// GenerateSignedURL creates a pre-signed GET URL through the S3-compatible API
+func (c *S3Client) GenerateSignedURL(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	req, err := c.presignClient.PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(c.bucketName),
+		Key:    aws.String(key),
+	}, s3.WithPresignExpires(ttl))
 	if err != nil {
-		return "", fmt.Errorf("failed to get download authorization: %w", err)
+		return "", fmt.Errorf("failed to generate signed URL: %w", err)
 	}
-	defer resp.Body.Close()
+	return req.URL, nil
+}
 
-	if resp.StatusCode != 200 {
-		bodyBytes, _ := ioutil.ReadAll(resp.Body)
-		return "", fmt.Errorf("download auth failed: %s", string(bodyBytes))
+// GenerateSignedURLs presigns every key; S3 signatures are computed locally, so there is no per-key round-trip.
+func (c *S3Client) GenerateSignedURLs(ctx context.Context, prefix string, keys []string, ttl time.Duration) ([]string, error) {
+	urls := make([]string, len(keys))
+	for i, key := range keys {
+		signed, err := c.GenerateSignedURL(ctx, key, ttl)
+		if err != nil {
+			return nil, err
+		}
+		urls[i] = signed
 	}
+	return urls, nil
+}
 
-	var authResp struct {
-		AuthorizationToken string `json:"authorizationToken"`
+func (c *S3Client) ReadRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	out, err := c.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(c.bucketName),
+		Key:    aws.String(key),
+		Range:  aws.String(rangeHeader(offset, length)),
+	})
+	if err != nil {
+		if isS3NotFound(err) {
+			return nil, ErrFileNotFound
+		}
+		return nil, fmt.Errorf("failed to read object: %w", err)
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&authResp); err != nil {
-		return "", fmt.Errorf("failed to decode response: %w", err)
+	return out.Body, nil
+}
+
+// GenerateSignedURL creates a pre-signed URL using B2 Native API.
+func (s *StorageService) GenerateSignedURL(ctx context.Context, fileName string, ttl time.Duration) (string, error) {
+	urls, err := s.GenerateSignedURLs(ctx, fileName, []string{fileName}, ttl)
+	if err != nil {
+		return "", err
 	}
+	return urls[0], nil
+}
 
-	// Construct B2 Native API signed URL
-	signedURL := fmt.Sprintf(
-		"%s/file/%s/%s?Authorization=%s",
-		s.DownloadUrl,
-		s.BucketName,
-		url.PathEscape(fileName),
-		url.QueryEscape(authResp.AuthorizationToken),
-	)
+// GenerateSignedURLs authorizes the whole prefix with a single b2_get_download_authorization and appends
+// the same token to every key. Authorizations are cached per prefix and reused as long as they outlive ttl.
+func (s *StorageService) GenerateSignedURLs(ctx context.Context, prefix string, keys []string, ttl time.Duration) ([]string, error) {
+	token, ok := s.downloadAuths.get(prefix, ttl)
+	if !ok {
+		valid := min(ttl+downloadAuthReuseWindow, maxDownloadAuthDuration)
+		bucketID, err := s.getBucketID(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get bucket ID: %w", err)
+		}
+
+		requestBody := map[string]interface{}{
+			"bucketId":               bucketID,
+			"fileNamePrefix":         prefix,
+			"validDurationInSeconds": int(valid.Seconds()),
+		}
 
-	log.Printf("Generated B2 Native signed URL for %s: %s", fileName, signedURL)
-	return signedURL, nil
+		var authResp struct {
+			AuthorizationToken string `json:"authorizationToken"`
+		}
+		requestedAt := time.Now() // B2 starts the validity after this, so requestedAt+valid errs on the early side
+		if err := s.b2Call(ctx, "b2_get_download_authorization", requestBody, &authResp); err != nil {
+			return nil, fmt.Errorf("failed to get download authorization: %w", err)
+		}
+		token = authResp.AuthorizationToken
+		s.downloadAuths.put(prefix, token, requestedAt.Add(valid))
+	}
+
+	// Construct B2 Native API signed URLs
+	urls := make([]string, len(keys))
+	for i, key := range keys {
+		if !strings.HasPrefix(key, prefix) {
+			return nil, fmt.Errorf("key %q is outside prefix %q", key, prefix)
+		}
+		urls[i] = fmt.Sprintf("%s?Authorization=%s", s.publicURL(key), url.QueryEscape(token))
+	}
+	return urls, nil
 }
 
 // package services
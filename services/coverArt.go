@@ -0,0 +1,91 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+
+	// Decoders for the formats accepted as cover art
+	_ "image/gif"
+	_ "image/png"
+
+	_ "golang.org/x/image/webp"
+
+	"golang.org/x/image/draw"
+)
+
+// CoverSizes are the square renditions stored for every cover, by name and edge length in pixels.
+var CoverSizes = []struct {
+	Name string
+	Size int
+}{
+	{"small", 100},
+	{"medium", 300},
+	{"large", 600},
+}
+
+// maxCoverPixels rejects images whose header promises more pixels than a cover could sensibly have,
+// before they are decoded (decompression bombs).
+const maxCoverPixels = 8000 * 8000
+
+// ErrInvalidCover is returned for cover images that cannot be decoded.
+var ErrInvalidCover = errors.New("invalid cover image")
+
+// DecodeCover decodes a JPEG, PNG, GIF or WebP image.
+func DecodeCover(data []byte) (image.Image, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCover, err)
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > maxCoverPixels {
+		return nil, fmt.Errorf("%w: %dx%d pixels", ErrInvalidCover, cfg.Width, cfg.Height)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCover, err)
+	}
+	return img, nil
+}
+
+// StoreCover center-crops img to a square, stores a JPEG of every size in CoverSizes under prefix
+// (SongPrefix or AlbumPrefix) and returns their URLs by name.
+func StoreCover(ctx context.Context, storage Storage, prefix string, img image.Image) (map[string]string, error) {
+	square := cropSquare(img)
+	urls := map[string]string{}
+	for _, size := range CoverSizes {
+		dst := image.NewRGBA(image.Rect(0, 0, size.Size, size.Size))
+		draw.CatmullRom.Scale(dst, dst.Bounds(), img, square, draw.Src, nil)
+
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85}); err != nil {
+			return nil, err
+		}
+		info, err := storage.UploadFile(ctx, CoverKey(prefix, size.Size), &buf, int64(buf.Len()), "image/jpeg")
+		if err != nil {
+			return nil, fmt.Errorf("failed to store %s cover: %w", size.Name, err)
+		}
+		urls[size.Name] = info.URL
+	}
+	return urls, nil
+}
+
+// DeleteCover removes every stored rendition of the cover under prefix.
+func DeleteCover(ctx context.Context, storage Storage, prefix string) error {
+	for _, size := range CoverSizes {
+		if err := storage.DeleteFile(ctx, CoverKey(prefix, size.Size)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func cropSquare(img image.Image) image.Rectangle {
+	b := img.Bounds()
+	side := min(b.Dx(), b.Dy())
+	x := b.Min.X + (b.Dx()-side)/2
+	y := b.Min.Y + (b.Dy()-side)/2
+	return image.Rect(x, y, x+side, y+side)
+}
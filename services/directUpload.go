@@ -0,0 +1,125 @@
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// DirectUpload tells a client how to send one file straight to the bucket, bypassing the API servers.
+// The client issues Method on URL with exactly these headers and the file as the body.
+type DirectUpload struct {
+	Method    string            `json:"method"`
+	URL       string            `json:"url"`
+	Headers   map[string]string `json:"headers"`
+	ExpiresAt time.Time         `json:"expiresAt"`
+}
+
+// DirectUploader is implemented by backends that accept uploads from clients directly.
+// The local backend does not, since its files live on the API server anyway.
+type DirectUploader interface {
+	// PrepareDirectUpload authorizes a single upload of size bytes with the given SHA-1 (hex) to key, and to
+	// no other key.
+	PrepareDirectUpload(ctx context.Context, key, contentType string, size int64, sha1Hex string, ttl time.Duration) (*DirectUpload, error)
+}
+
+// PrepareDirectUpload presigns a PUT. Content type, length and the declared SHA-1 are part of the signature,
+// so the client cannot change them. The SHA-1 is sent as an S3 checksum, which the bucket verifies on upload
+// and StatFile reports back.
+func (c *S3Client) PrepareDirectUpload(ctx context.Context, key, contentType string, size int64, sha1Hex string, ttl time.Duration) (*DirectUpload, error) {
+	sum, err := hex.DecodeString(sha1Hex)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sha1: %w", err)
+	}
+	return presignPut(ctx, c.presignClient, &s3.PutObjectInput{
+		Bucket:            aws.String(c.bucketName),
+		Key:               aws.String(key),
+		ContentType:       aws.String(contentType),
+		ContentLength:     aws.Int64(size),
+		ChecksumAlgorithm: types.ChecksumAlgorithmSha1,
+		ChecksumSHA1:      aws.String(base64.StdEncoding.EncodeToString(sum)),
+	}, ttl)
+}
+
+// PrepareDirectUpload presigns a PUT for key on B2's S3-compatible endpoint. Native upload URLs are not used:
+// their token is valid for the whole bucket for 24 hours, so a client could write any key with it. B2 hashes
+// the content itself, and StatFile reports that hash.
+func (s *StorageService) PrepareDirectUpload(ctx context.Context, key, contentType string, size int64, sha1Hex string, ttl time.Duration) (*DirectUpload, error) {
+	presigner, err := s.s3Presigner()
+	if err != nil {
+		return nil, err
+	}
+	return presignPut(ctx, presigner, &s3.PutObjectInput{
+		Bucket:        aws.String(s.BucketName),
+		Key:           aws.String(key),
+		ContentType:   aws.String(contentType),
+		ContentLength: aws.Int64(size),
+		Metadata:      map[string]string{"sha1": sha1Hex},
+	}, ttl)
+}
+
+// s3Presigner returns a presign client for the account's S3 endpoint, signing with the same application key.
+func (s *StorageService) s3Presigner() (*s3.PresignClient, error) {
+	s.presignMu.Lock()
+	defer s.presignMu.Unlock()
+	if s.presigner != nil {
+		return s.presigner, nil
+	}
+
+	acct, err := s.account()
+	if err != nil {
+		return nil, err
+	}
+	if acct.S3ApiUrl == "" {
+		return nil, errors.New("b2_authorize_account returned no S3 endpoint")
+	}
+	endpoint, err := url.Parse(acct.S3ApiUrl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint %q: %w", acct.S3ApiUrl, err)
+	}
+	// https://s3.us-west-004.backblazeb2.com is in region us-west-004
+	region := strings.TrimSuffix(strings.TrimPrefix(endpoint.Host, "s3."), ".backblazeb2.com")
+
+	s.presigner = s3.NewPresignClient(s3.New(s3.Options{
+		Region:                     region,
+		Credentials:                credentials.NewStaticCredentialsProvider(s.AccountID, s.AppKey, ""),
+		BaseEndpoint:               aws.String(acct.S3ApiUrl),
+		UsePathStyle:               true,
+		RequestChecksumCalculation: aws.RequestChecksumCalculationWhenRequired,
+	}))
+	return s.presigner, nil
+}
+
+// presignPut presigns input and lists the headers the client has to send along.
+func presignPut(ctx context.Context, presigner *s3.PresignClient, input *s3.PutObjectInput, ttl time.Duration) (*DirectUpload, error) {
+	req, err := presigner.PresignPutObject(ctx, input, s3.WithPresignExpires(ttl))
+	if err != nil {
+		return nil, fmt.Errorf("failed to presign upload: %w", err)
+	}
+
+	// Host and Content-Length are set by the client's HTTP stack; the rest must be sent as signed
+	headers := map[string]string{}
+	for name, values := range req.SignedHeader {
+		if len(values) == 0 || strings.EqualFold(name, "Host") || strings.EqualFold(name, "Content-Length") {
+			continue
+		}
+		headers[http.CanonicalHeaderKey(name)] = values[0]
+	}
+	return &DirectUpload{
+		Method:    req.Method,
+		URL:       req.URL,
+		Headers:   headers,
+		ExpiresAt: time.Now().Add(ttl),
+	}, nil
+}
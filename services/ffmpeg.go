@@ -0,0 +1,16 @@
+package services
+
+import (
+	"os"
+	"os/exec"
+)
+
+// FFmpegPath resolves FFMPEG_PATH (default "ffmpeg" on PATH). Features built on ffmpeg (HLS packaging,
+// fingerprinting, loudness analysis) turn themselves off when it returns an error.
+func FFmpegPath() (string, error) {
+	ffmpegPath := os.Getenv("FFMPEG_PATH")
+	if ffmpegPath == "" {
+		ffmpegPath = "ffmpeg"
+	}
+	return exec.LookPath(ffmpegPath)
+}
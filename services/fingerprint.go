@@ -0,0 +1,162 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"lipur_backend/audio"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+)
+
+// Near-duplicate policies, set by FINGERPRINT_DUPLICATES.
+const (
+	DuplicatesOff    = "off"    // no fingerprinting
+	DuplicatesFlag   = "flag"   // accept the upload and open a moderation flag for admins
+	DuplicatesReject = "reject" // refuse the upload
+)
+
+const (
+	fingerprintsCollection = "fingerprints"
+
+	// Only the start of a song is fingerprinted; re-uploads are recognised well within it
+	fingerprintSeconds = 120
+
+	// Re-encodes keep their duration, so candidates are the songs within this many seconds of the upload
+	fingerprintDurationSlack = 3.0
+)
+
+// FingerprintMatch is an existing song that sounds like an upload.
+type FingerprintMatch struct {
+	SongID     string
+	Similarity float64
+}
+
+// Fingerprinter computes acoustic fingerprints of uploads (see audio.Fingerprint) and finds earlier songs that
+// are the same recording in a different encoding. Fingerprints are kept in fingerprints/{songId}.
+type Fingerprinter struct {
+	ffmpegPath string
+	Policy     string
+	Threshold  float64 // similarity from which songs count as the same recording
+}
+
+// NewFingerprinter reads FINGERPRINT_DUPLICATES ("flag" (default), "reject" or "off"), FINGERPRINT_THRESHOLD
+// (default 0.7) and FFMPEG_PATH. Without ffmpeg, fingerprinting is off.
+func NewFingerprinter() *Fingerprinter {
+	f := &Fingerprinter{Policy: strings.ToLower(os.Getenv("FINGERPRINT_DUPLICATES")), Threshold: 0.7}
+	if f.Policy != DuplicatesReject && f.Policy != DuplicatesOff {
+		f.Policy = DuplicatesFlag
+	}
+	if t, err := strconv.ParseFloat(os.Getenv("FINGERPRINT_THRESHOLD"), 64); err == nil && t > 0.5 && t <= 1 {
+		f.Threshold = t
+	}
+
+	if f.Policy != DuplicatesOff {
+		ffmpegPath, err := FFmpegPath()
+		if err != nil {
+			log.Printf("ffmpeg not found (%v), acoustic fingerprinting disabled", err)
+			f.Policy = DuplicatesOff
+		}
+		f.ffmpegPath = ffmpegPath
+	}
+	return f
+}
+
+// Enabled reports whether uploads are fingerprinted.
+func (f *Fingerprinter) Enabled() bool {
+	return f != nil && f.Policy != DuplicatesOff
+}
+
+// Compute decodes the first two minutes of the audio in r with ffmpeg and fingerprints them. It returns nil
+// for audio too short or quiet to fingerprint.
+func (f *Fingerprinter) Compute(ctx context.Context, r io.ReaderAt, size int64) ([]uint32, error) {
+	// ffmpeg needs a seekable input for some containers (MP4 with the index at the end)
+	input, ok := r.(*os.File)
+	if !ok {
+		tmp, err := os.CreateTemp("", "fingerprint-*")
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		if _, err := io.Copy(tmp, io.NewSectionReader(r, 0, size)); err != nil {
+			return nil, err
+		}
+		input = tmp
+	}
+	return f.compute(ctx, input.Name())
+}
+
+// ComputeURL fingerprints the audio behind a (signed) URL. ffmpeg fetches only what it decodes, so only about
+// the first two minutes are downloaded.
+func (f *Fingerprinter) ComputeURL(ctx context.Context, url string) ([]uint32, error) {
+	return f.compute(ctx, url)
+}
+
+func (f *Fingerprinter) compute(ctx context.Context, input string) ([]uint32, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, f.ffmpegPath,
+		"-hide_banner", "-loglevel", "error",
+		"-i", input,
+		"-t", strconv.Itoa(fingerprintSeconds),
+		"-vn", "-ac", "1", "-ar", strconv.Itoa(audio.FingerprintSampleRate),
+		"-f", "s16le", "-",
+	)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	samples := make([]int16, stdout.Len()/2)
+	if err := binary.Read(&stdout, binary.LittleEndian, samples); err != nil {
+		return nil, err
+	}
+	return audio.Fingerprint(samples), nil
+}
+
+// FindMatch returns the stored song most similar to fingerprint among those of about the same duration,
+// or nil when none reaches the threshold.
+func (f *Fingerprinter) FindMatch(ctx context.Context, firestoreClient *firestore.Client, fingerprint []uint32, duration float64) (*FingerprintMatch, error) {
+	docs, err := firestoreClient.Collection(fingerprintsCollection).
+		Where("duration", ">=", duration-fingerprintDurationSlack).
+		Where("duration", "<=", duration+fingerprintDurationSlack).
+		Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	var best *FingerprintMatch
+	for _, doc := range docs {
+		data, _ := doc.Data()["data"].([]byte)
+		similarity := audio.Similarity(fingerprint, audio.DecodeFingerprint(data))
+		if similarity >= f.Threshold && (best == nil || similarity > best.Similarity) {
+			best = &FingerprintMatch{SongID: doc.Ref.ID, Similarity: similarity}
+		}
+	}
+	return best, nil
+}
+
+// FingerprintDoc is the fingerprints/{songId} document for a song.
+func FingerprintDoc(fingerprint []uint32, duration float64) map[string]interface{} {
+	return map[string]interface{}{
+		"duration":  duration,
+		"frames":    len(fingerprint),
+		"data":      audio.EncodeFingerprint(fingerprint),
+		"createdAt": time.Now(),
+	}
+}
+
+// FingerprintRef returns the fingerprint document of songId.
+func FingerprintRef(firestoreClient *firestore.Client, songId string) *firestore.DocumentRef {
+	return firestoreClient.Collection(fingerprintsCollection).Doc(songId)
+}
@@ -0,0 +1,123 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// HLSContentType is the MIME type of .m3u8 playlists.
+const HLSContentType = "application/vnd.apple.mpegurl"
+
+// hlsURIAttr matches the URI="..." attribute of tags such as #EXT-X-MAP.
+var hlsURIAttr = regexp.MustCompile(`URI="([^"]+)"`)
+
+// readPlaylist fetches a playlist and returns its lines plus the keys of every relative URI it references.
+func readPlaylist(ctx context.Context, storage Storage, playlistKey string) ([]string, []string, error) {
+	body, err := storage.ReadRange(ctx, playlistKey, 0, -1)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer body.Close()
+	playlist, err := io.ReadAll(body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var keys []string
+	lines := strings.Split(string(playlist), "\n")
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			if m := hlsURIAttr.FindStringSubmatch(line); m != nil {
+				if key, ok := resolveHLSURI(playlistKey, m[1]); ok {
+					keys = append(keys, key)
+				}
+			}
+			continue
+		}
+		if key, ok := resolveHLSURI(playlistKey, line); ok {
+			keys = append(keys, key)
+		}
+	}
+	return lines, keys, nil
+}
+
+// resolveHLSURI maps a URI relative to the playlist onto an object key; absolute URIs are left alone.
+func resolveHLSURI(playlistKey, uri string) (string, bool) {
+	if strings.Contains(uri, "://") || strings.HasPrefix(uri, "/") {
+		return "", false
+	}
+	return path.Join(path.Dir(playlistKey), uri), true
+}
+
+// SignHLSPlaylist reads the playlist at playlistKey and rewrites every segment (and init segment) URI
+// into a signed URL. All URIs are signed against the playlist's directory, so B2 needs one authorization per song.
+func SignHLSPlaylist(ctx context.Context, storage Storage, playlistKey string, ttl time.Duration) ([]byte, error) {
+	lines, keys, err := readPlaylist(ctx, storage, playlistKey)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := path.Dir(playlistKey) + "/"
+	signed, err := storage.GenerateSignedURLs(ctx, prefix, keys, ttl)
+	if err != nil {
+		return nil, err
+	}
+	signedByKey := make(map[string]string, len(keys))
+	for i, key := range keys {
+		signedByKey[key] = signed[i]
+	}
+
+	var out bytes.Buffer
+	w := bufio.NewWriter(&out)
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+		case strings.HasPrefix(trimmed, "#"):
+			line = hlsURIAttr.ReplaceAllStringFunc(trimmed, func(attr string) string {
+				uri := hlsURIAttr.FindStringSubmatch(attr)[1]
+				if key, ok := resolveHLSURI(playlistKey, uri); ok {
+					return fmt.Sprintf(`URI="%s"`, signedByKey[key])
+				}
+				return attr
+			})
+		default:
+			if key, ok := resolveHLSURI(playlistKey, trimmed); ok {
+				line = signedByKey[key]
+			}
+		}
+		w.WriteString(line)
+		w.WriteString("\n")
+	}
+	w.Flush()
+	return append(bytes.TrimRight(out.Bytes(), "\n"), '\n'), nil
+}
+
+// DeleteHLSRendition removes every segment referenced by the playlist, then the playlist itself.
+func DeleteHLSRendition(ctx context.Context, storage Storage, playlistKey string) error {
+	_, keys, err := readPlaylist(ctx, storage, playlistKey)
+	if errors.Is(err, ErrFileNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := storage.DeleteFile(ctx, key); err != nil {
+			return err
+		}
+	}
+	return storage.DeleteFile(ctx, playlistKey)
+}
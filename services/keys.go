@@ -0,0 +1,75 @@
+package services
+
+import (
+	"path"
+	"strconv"
+	"strings"
+)
+
+// songKeyPrefix is the root of every per-song object: songs/{songId}/...
+const songKeyPrefix = "songs/"
+
+// SongPrefix returns the object prefix that holds everything stored for a song.
+func SongPrefix(songId string) string {
+	return songKeyPrefix + songId + "/"
+}
+
+// SongObjectKey returns the key of a song's original upload, e.g. songs/{songId}/original.mp3.
+// The client's file name only contributes its extension; it is kept as metadata on the song document.
+func SongObjectKey(songId, originalFileName string) string {
+	ext := strings.ToLower(path.Ext(originalFileName))
+	return SongPrefix(songId) + "original" + ext
+}
+
+// IsLegacySongKey reports whether key predates the songs/{songId}/ layout (raw client file names).
+func IsLegacySongKey(key string) bool {
+	return !strings.HasPrefix(key, songKeyPrefix)
+}
+
+// ObjectKeyFromURL recovers the object key from a public URL produced by any backend:
+// B2 "/file/{bucket}/{key}", local "/files/{key}" or S3 path-style "/{bucket}/{key}".
+// The path is already percent-decoded by url.Parse.
+func ObjectKeyFromURL(urlPath string) string {
+	p := strings.TrimPrefix(urlPath, "/")
+	switch {
+	case strings.HasPrefix(p, "file/"):
+		parts := strings.SplitN(p, "/", 3)
+		if len(parts) < 3 {
+			return ""
+		}
+		return parts[2]
+	case strings.HasPrefix(p, "files/"):
+		return strings.TrimPrefix(p, "files/")
+	default:
+		if i := strings.Index(p, "/"); i >= 0 {
+			return p[i+1:]
+		}
+		return ""
+	}
+}
+
+// SongHLSPrefix is where a song's HLS rendition (playlist, init segment and media segments) is stored.
+func SongHLSPrefix(songId string) string {
+	return SongPrefix(songId) + "hls/"
+}
+
+// SongHLSPlaylistKey is the key of a song's HLS media playlist.
+func SongHLSPlaylistKey(songId string) string {
+	return SongHLSPrefix(songId) + "playlist.m3u8"
+}
+
+// CoverKey is where the cover rendition with the given edge length is stored under a song or album prefix.
+func CoverKey(prefix string, size int) string {
+	return prefix + "cover/" + strconv.Itoa(size) + ".jpg"
+}
+
+// AlbumPrefix returns the object prefix that holds everything stored for an album (its cover).
+func AlbumPrefix(albumId string) string {
+	return "albums/" + albumId + "/"
+}
+
+// SongWaveformKey is where a song's waveform peaks at one resolution are stored, e.g.
+// songs/{songId}/waveform/medium.json; format is "json" or "dat".
+func SongWaveformKey(songId, resolution, format string) string {
+	return SongPrefix(songId) + "waveform/" + resolution + "." + format
+}
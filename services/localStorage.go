@@ -0,0 +1,247 @@
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LocalStorage keeps objects on the local filesystem so the server can run without a cloud bucket.
+// Files are served back through the /files/*key route using HMAC-signed, expiring URLs.
+type LocalStorage struct {
+	RootDir string
+	BaseURL string // externally reachable server URL, e.g. http://localhost:8080
+	secret  []byte
+}
+
+// NewLocalStorage reads LOCAL_STORAGE_DIR, LOCAL_STORAGE_BASE_URL and LOCAL_STORAGE_SECRET.
+// A random secret is generated when none is configured, which invalidates signed URLs on restart.
+func NewLocalStorage() (*LocalStorage, error) {
+	rootDir := os.Getenv("LOCAL_STORAGE_DIR")
+	if rootDir == "" {
+		rootDir = "./data"
+	}
+	baseURL := os.Getenv("LOCAL_STORAGE_BASE_URL")
+	if baseURL == "" {
+		baseURL = "http://localhost:" + os.Getenv("PORT")
+	}
+
+	secret := []byte(os.Getenv("LOCAL_STORAGE_SECRET"))
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, fmt.Errorf("failed to generate signing secret: %w", err)
+		}
+		log.Println("LOCAL_STORAGE_SECRET not set, signed URLs will not survive a restart")
+	}
+
+	if err := os.MkdirAll(rootDir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create storage dir: %w", err)
+	}
+
+	return &LocalStorage{
+		RootDir: rootDir,
+		BaseURL: strings.TrimRight(baseURL, "/"),
+		secret:  secret,
+	}, nil
+}
+
+// Path maps an object key to its file path, rejecting keys that escape RootDir.
+func (l *LocalStorage) Path(key string) (string, error) {
+	clean := path.Clean("/" + key)
+	if clean == "/" {
+		return "", errors.New("empty object key")
+	}
+	return filepath.Join(l.RootDir, filepath.FromSlash(clean)), nil
+}
+
+func (l *LocalStorage) publicURL(key string) string {
+	return l.BaseURL + "/files/" + escapeKey(key)
+}
+
+func (l *LocalStorage) fileInfo(key string, fi os.FileInfo) *FileInfo {
+	return &FileInfo{
+		Key:         key,
+		Size:        fi.Size(),
+		ContentType: mime.TypeByExtension(filepath.Ext(key)),
+		ETag:        fmt.Sprintf("%x-%x", fi.ModTime().UnixNano(), fi.Size()),
+		URL:         l.publicURL(key),
+		UpdatedAt:   fi.ModTime(),
+	}
+}
+
+func (l *LocalStorage) UploadFile(ctx context.Context, key string, body io.Reader, size int64, contentType string) (*FileInfo, error) {
+	dest, err := l.Path(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return nil, err
+	}
+
+	// Write to a temp file first so readers never observe a partial object.
+	tmp, err := os.CreateTemp(filepath.Dir(dest), ".upload-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+
+	content := newSHA1Reader(body)
+	written, err := io.Copy(tmp, content)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to write file: %w", err)
+	}
+	if size >= 0 && written != size {
+		return nil, fmt.Errorf("upload size mismatch: expected %d bytes, got %d", size, written)
+	}
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		return nil, err
+	}
+
+	info, err := l.StatFile(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	info.SHA1 = content.Sum()
+	return info, nil
+}
+
+func (l *LocalStorage) DeleteFile(ctx context.Context, key string) error {
+	p, err := l.Path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// ListFiles walks the directory prefix ends in, so prefix should end in a slash.
+func (l *LocalStorage) ListFiles(ctx context.Context, prefix string) ([]string, error) {
+	dir, err := l.Path(prefix)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	err = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".upload-") {
+			return nil
+		}
+		rel, err := filepath.Rel(l.RootDir, p)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return keys, err
+}
+
+func (l *LocalStorage) StatFile(ctx context.Context, key string) (*FileInfo, error) {
+	p, err := l.Path(key)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(p)
+	if os.IsNotExist(err) {
+		return nil, ErrFileNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return l.fileInfo(key, fi), nil
+}
+
+func (l *LocalStorage) sign(key string, expires int64) string {
+	mac := hmac.New(sha256.New, l.secret)
+	fmt.Fprintf(mac, "%s\n%d", key, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// GenerateSignedURL returns a /files URL carrying an expiry and an HMAC over key and expiry.
+func (l *LocalStorage) GenerateSignedURL(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	if _, err := l.Path(key); err != nil {
+		return "", err
+	}
+	expires := time.Now().Add(ttl).Unix()
+	q := url.Values{}
+	q.Set("expires", strconv.FormatInt(expires, 10))
+	q.Set("sig", l.sign(key, expires))
+	return l.publicURL(key) + "?" + q.Encode(), nil
+}
+
+func (l *LocalStorage) GenerateSignedURLs(ctx context.Context, prefix string, keys []string, ttl time.Duration) ([]string, error) {
+	urls := make([]string, len(keys))
+	for i, key := range keys {
+		signed, err := l.GenerateSignedURL(ctx, key, ttl)
+		if err != nil {
+			return nil, err
+		}
+		urls[i] = signed
+	}
+	return urls, nil
+}
+
+// VerifySignedURL checks the expires/sig query values produced by GenerateSignedURL.
+func (l *LocalStorage) VerifySignedURL(key, expires, sig string) bool {
+	exp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return false
+	}
+	return hmac.Equal([]byte(sig), []byte(l.sign(key, exp)))
+}
+
+// sectionReadCloser pairs a bounded reader with the underlying file's Close.
+type sectionReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func (l *LocalStorage) ReadRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	p, err := l.Path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, ErrFileNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if length < 0 {
+		return f, nil
+	}
+	return sectionReadCloser{Reader: io.LimitReader(f, length), Closer: f}, nil
+}
@@ -0,0 +1,126 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+// ReadAt fetches objects in blocks of objectBlockSize and keeps up to maxObjectBlocks of them.
+const (
+	objectBlockSize = 64 << 10
+	maxObjectBlocks = 32
+)
+
+// ObjectReader exposes a stored object as an io.ReadSeeker, which lets http.ServeContent answer
+// Range and If-Range requests. Each Seek drops the open stream and the next Read issues a ranged
+// ReadRange from the new offset, so only the bytes that are actually sent are fetched.
+//
+// It is also an io.ReaderAt for parsers that jump around a file (sniffing, tag and container parsing), which
+// then only fetch the blocks around the offsets they read.
+type ObjectReader struct {
+	ctx     context.Context
+	storage Storage
+	key     string
+	size    int64
+	offset  int64
+	body    io.ReadCloser
+
+	blocksMu sync.Mutex
+	blocks   map[int64][]byte // by index, offset / objectBlockSize
+}
+
+func NewObjectReader(ctx context.Context, storage Storage, key string, size int64) *ObjectReader {
+	return &ObjectReader{ctx: ctx, storage: storage, key: key, size: size}
+}
+
+func (r *ObjectReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		body, err := r.storage.ReadRange(r.ctx, r.key, r.offset, r.size-r.offset)
+		if err != nil {
+			return 0, err
+		}
+		r.body = body
+	}
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *ObjectReader) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = r.offset + offset
+	case io.SeekEnd:
+		abs = r.size + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if abs < 0 {
+		return 0, errors.New("negative position")
+	}
+	if abs != r.offset {
+		r.Close()
+		r.offset = abs
+	}
+	return abs, nil
+}
+
+func (r *ObjectReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.blocksMu.Lock()
+	defer r.blocksMu.Unlock()
+	n := 0
+	for n < len(p) && off+int64(n) < r.size {
+		pos := off + int64(n)
+		block, err := r.block(pos / objectBlockSize)
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], block[pos%objectBlockSize:])
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// block returns block i of the object, fetching it unless it is cached.
+func (r *ObjectReader) block(i int64) ([]byte, error) {
+	if block, ok := r.blocks[i]; ok {
+		return block, nil
+	}
+	start := i * objectBlockSize
+	body, err := r.storage.ReadRange(r.ctx, r.key, start, min(objectBlockSize, r.size-start))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	block := make([]byte, min(objectBlockSize, r.size-start))
+	if _, err := io.ReadFull(body, block); err != nil {
+		return nil, err
+	}
+	if r.blocks == nil || len(r.blocks) >= maxObjectBlocks {
+		r.blocks = map[int64][]byte{}
+	}
+	r.blocks[i] = block
+	return block, nil
+}
+
+func (r *ObjectReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
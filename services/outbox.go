@@ -0,0 +1,191 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"lipur_backend/utils"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/google/uuid"
+)
+
+// An upload stores objects first and writes Firestore documents afterwards, and the two cannot commit together.
+// Every such operation is therefore recorded in the outbox collection: the entry is written as pending before
+// the first object is stored, deleted in the same batch as the documents are written, or flipped to compensated
+// once the objects are deleted again after a failure. Entries a crash left pending, or whose objects could not be
+// deleted, are picked up by the reconciler. Only failures stay in the collection.
+
+const outboxCollection = "outbox"
+
+// Outbox entry states.
+const (
+	OutboxPending            = "pending"
+	OutboxCommitted          = "committed" // written by earlier versions; the reconciler deletes these
+	OutboxCompensated        = "compensated"
+	OutboxCompensationFailed = "compensation_failed"
+)
+
+// outboxStaleAfter is how long a pending entry is left alone, so uploads still in progress are not undone.
+const outboxStaleAfter = 6 * time.Hour
+
+// OutboxEntry is outbox/{ID}.
+type OutboxEntry struct {
+	ID        string    `firestore:"id"`
+	Operation string    `firestore:"operation"` // "song" or "album"
+	Objects   []string  `firestore:"objects"`   // keys the operation may have stored
+	Documents []string  `firestore:"documents"` // paths written by the commit; any of them existing proves it happened
+	Status    string    `firestore:"status"`
+	Error     string    `firestore:"error"`
+	Attempts  int       `firestore:"attempts"` // compensation attempts
+	CreatedAt time.Time `firestore:"createdAt"`
+	UpdatedAt time.Time `firestore:"updatedAt"`
+}
+
+// NewOutboxEntry returns an entry with a fresh ID; fill in Objects and Documents before BeginOutbox.
+func NewOutboxEntry(operation string) *OutboxEntry {
+	return &OutboxEntry{ID: uuid.New().String(), Operation: operation}
+}
+
+// BeginOutbox records entry as pending. Call it before storing any object, and give up on the operation if it fails.
+func BeginOutbox(ctx context.Context, firestoreClient *firestore.Client, entry *OutboxEntry) error {
+	entry.Status = OutboxPending
+	entry.CreatedAt = time.Now()
+	entry.UpdatedAt = entry.CreatedAt
+	_, err := firestoreClient.Collection(outboxCollection).Doc(entry.ID).Set(ctx, entry)
+	return err
+}
+
+// CommitOutbox adds deleting entry to batch: once the documents are written there is nothing left to settle.
+func CommitOutbox(firestoreClient *firestore.Client, batch *firestore.WriteBatch, entry *OutboxEntry) {
+	batch.Delete(firestoreClient.Collection(outboxCollection).Doc(entry.ID))
+}
+
+// CompensateOutbox deletes the objects of a failed operation and records the outcome. cause is the error that
+// made the operation fail. If the outcome cannot be recorded the entry stays pending and the reconciler retries.
+func CompensateOutbox(ctx context.Context, storage Storage, firestoreClient *firestore.Client, entry *OutboxEntry, cause error) {
+	status, message := OutboxCompensated, cause.Error()
+	if failed := DeleteObjects(ctx, storage, entry.Objects); len(failed) > 0 {
+		status = OutboxCompensationFailed
+		message = fmt.Sprintf("%s; could not delete %s", message, strings.Join(failed, ", "))
+	}
+	entry.Attempts++
+	log.Printf("Outbox %s (%s): %s: %s", entry.ID, entry.Operation, status, message)
+
+	_, err := firestoreClient.Collection(outboxCollection).Doc(entry.ID).Update(ctx, []firestore.Update{
+		{Path: "status", Value: status},
+		{Path: "error", Value: message},
+		{Path: "attempts", Value: entry.Attempts},
+		{Path: "updatedAt", Value: time.Now()},
+	})
+	if err != nil {
+		log.Printf("Failed to record outbox %s as %s: %v", entry.ID, status, err)
+	}
+}
+
+// DeleteObjects deletes keys, retrying each a few times, and returns the ones that could not be deleted.
+func DeleteObjects(ctx context.Context, storage Storage, keys []string) []string {
+	var failed []string
+	for _, key := range keys {
+		err := utils.Retry(3, time.Second, func() error {
+			return storage.DeleteFile(ctx, key)
+		})
+		if err != nil {
+			log.Printf("Failed to delete %s: %v", key, err)
+			failed = append(failed, key)
+		}
+	}
+	return failed
+}
+
+// ReconcileOutbox settles stale pending entries and retries failed compensations. An entry whose documents
+// exist was committed and is deleted; otherwise its objects are deleted. It returns how many entries were settled.
+func ReconcileOutbox(ctx context.Context, storage Storage, firestoreClient *firestore.Client) (int, error) {
+	docs, err := firestoreClient.Collection(outboxCollection).
+		Where("status", "in", []string{OutboxPending, OutboxCompensationFailed, OutboxCommitted}).
+		Documents(ctx).GetAll()
+	if err != nil {
+		return 0, err
+	}
+
+	settled := 0
+	for _, doc := range docs {
+		var entry OutboxEntry
+		if err := doc.DataTo(&entry); err != nil {
+			log.Printf("Skipping malformed outbox entry %s: %v", doc.Ref.ID, err)
+			continue
+		}
+		if entry.Status == OutboxPending && time.Since(entry.UpdatedAt) < outboxStaleAfter {
+			continue
+		}
+
+		committed := entry.Status == OutboxCommitted
+		if !committed {
+			if committed, err = outboxDocumentsExist(ctx, firestoreClient, entry.Documents); err != nil {
+				return settled, err
+			}
+		}
+		if committed {
+			if _, err := doc.Ref.Delete(ctx); err != nil {
+				return settled, err
+			}
+		} else {
+			cause := entry.Error
+			if cause == "" {
+				cause = "abandoned while pending"
+			}
+			CompensateOutbox(ctx, storage, firestoreClient, &entry, fmt.Errorf("reconciled: %s", cause))
+		}
+		settled++
+	}
+	return settled, nil
+}
+
+func outboxDocumentsExist(ctx context.Context, firestoreClient *firestore.Client, paths []string) (bool, error) {
+	if len(paths) == 0 {
+		return false, nil
+	}
+	refs := make([]*firestore.DocumentRef, len(paths))
+	for i, path := range paths {
+		refs[i] = firestoreClient.Doc(path)
+	}
+	snaps, err := firestoreClient.GetAll(ctx, refs)
+	if err != nil {
+		return false, err
+	}
+	for _, snap := range snaps {
+		if snap.Exists() {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// StartOutboxReconciler runs ReconcileOutbox at startup and then every OUTBOX_RECONCILE_MINUTES (default 30)
+// until ctx is done.
+func StartOutboxReconciler(ctx context.Context, storage Storage, firestoreClient *firestore.Client) {
+	interval := 30 * time.Minute
+	if minutes, err := strconv.Atoi(os.Getenv("OUTBOX_RECONCILE_MINUTES")); err == nil && minutes > 0 {
+		interval = time.Duration(minutes) * time.Minute
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if settled, err := ReconcileOutbox(ctx, storage, firestoreClient); err != nil {
+				log.Printf("Outbox reconciliation failed: %v", err)
+			} else if settled > 0 {
+				log.Printf("Outbox reconciliation settled %d entries", settled)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
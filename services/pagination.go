@@ -0,0 +1,170 @@
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/firestore"
+)
+
+// Page sizes for list endpoints.
+const (
+	DefaultPageSize = 20
+	MaxPageSize     = 100
+)
+
+// ErrInvalidCursor is returned for a cursor that was not produced by Paginate for the same ordering.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Order is one sort key of a paginated query.
+type Order struct {
+	Field     string
+	Direction firestore.Direction
+}
+
+// Page is one page of a paginated query.
+type Page struct {
+	Docs       []*firestore.DocumentSnapshot
+	NextCursor string // empty on the last page
+}
+
+// Paginate returns up to limit documents of query, ordered by orders and then by document ID so that equal
+// sort values still have a stable order, starting after the document cursor points at ("" for the first page).
+//
+// Cursors are opaque to clients: they hold the sort values and ID of the last document of the previous page,
+// which are passed to Firestore's StartAfter. They stay valid when that document is deleted.
+func Paginate(ctx context.Context, query firestore.Query, orders []Order, limit int, cursor string) (*Page, error) {
+	if len(orders) == 0 {
+		return nil, errors.New("paginate: no order")
+	}
+	for _, order := range orders {
+		query = query.OrderBy(order.Field, order.Direction)
+	}
+	query = query.OrderBy(firestore.DocumentID, orders[len(orders)-1].Direction)
+
+	if cursor != "" {
+		values, err := decodeCursor(cursor, orders)
+		if err != nil {
+			return nil, err
+		}
+		query = query.StartAfter(values...)
+	}
+
+	// One extra document tells whether there is a next page
+	docs, err := query.Limit(limit + 1).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	page := &Page{Docs: docs}
+	if len(docs) > limit {
+		page.Docs = docs[:limit]
+		page.NextCursor, err = encodeCursor(docs[limit-1], orders)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return page, nil
+}
+
+// pageCursor is what a cursor encodes: the ordering it belongs to and the last document's sort values and ID.
+type pageCursor struct {
+	Order  string        `json:"o"`
+	Values []cursorValue `json:"v"`
+}
+
+// orderKey identifies an ordering, so a cursor is not applied to a query sorted differently.
+func orderKey(orders []Order) string {
+	key := ""
+	for _, order := range orders {
+		key += fmt.Sprintf("%s:%d,", order.Field, order.Direction)
+	}
+	return key
+}
+
+// cursorValue is one sort value of a cursor. JSON alone would turn timestamps into strings, which Firestore
+// orders differently, so every value keeps its type.
+type cursorValue struct {
+	Time   *time.Time `json:"t,omitempty"`
+	Number *float64   `json:"n,omitempty"`
+	String *string    `json:"s,omitempty"`
+	Bool   *bool      `json:"b,omitempty"`
+}
+
+func encodeCursor(doc *firestore.DocumentSnapshot, orders []Order) (string, error) {
+	values := make([]interface{}, len(orders))
+	for i, order := range orders {
+		v, err := doc.DataAt(order.Field)
+		if err != nil {
+			return "", fmt.Errorf("cursor: %w", err)
+		}
+		values[i] = v
+	}
+	return encodeCursorValues(values, doc.Ref.ID, orders)
+}
+
+// encodeCursorValues encodes the sort values (one per order) and ID of a document.
+func encodeCursorValues(sortValues []interface{}, id string, orders []Order) (string, error) {
+	values := make([]cursorValue, 0, len(orders)+1)
+	for i, order := range orders {
+		var cv cursorValue
+		switch v := sortValues[i].(type) {
+		case time.Time:
+			cv.Time = &v
+		case int64:
+			n := float64(v)
+			cv.Number = &n
+		case float64:
+			cv.Number = &v
+		case string:
+			cv.String = &v
+		case bool:
+			cv.Bool = &v
+		default:
+			return "", fmt.Errorf("cursor: unsupported %s value %T", order.Field, v)
+		}
+		values = append(values, cv)
+	}
+	values = append(values, cursorValue{String: &id})
+
+	data, err := json.Marshal(pageCursor{Order: orderKey(orders), Values: values})
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeCursor(cursor string, orders []Order) ([]interface{}, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var c pageCursor
+	count := len(orders) + 1
+	if err := json.Unmarshal(data, &c); err != nil || c.Order != orderKey(orders) || len(c.Values) != count {
+		return nil, ErrInvalidCursor
+	}
+	decoded := make([]interface{}, count)
+	for i, v := range c.Values {
+		switch {
+		case v.Time != nil:
+			decoded[i] = *v.Time
+		case v.Number != nil:
+			decoded[i] = *v.Number
+		case v.String != nil:
+			decoded[i] = *v.String
+		case v.Bool != nil:
+			decoded[i] = *v.Bool
+		default:
+			return nil, ErrInvalidCursor
+		}
+	}
+	// The last value is the document ID
+	if _, ok := decoded[count-1].(string); !ok {
+		return nil, ErrInvalidCursor
+	}
+	return decoded, nil
+}
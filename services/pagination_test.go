@@ -0,0 +1,95 @@
+package services
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	uploaded := time.Date(2024, 3, 1, 12, 30, 0, 123456789, time.UTC)
+	tests := []struct {
+		name   string
+		orders []Order
+		values []interface{}
+		want   []interface{} // what StartAfter receives, ID last
+	}{
+		{"timestamp", []Order{{"uploadedAt", firestore.Desc}}, []interface{}{uploaded}, []interface{}{uploaded, "song-1"}},
+		{"integer", []Order{{"playCount", firestore.Desc}}, []interface{}{int64(42)}, []interface{}{float64(42), "song-1"}},
+		{"float", []Order{{"score", firestore.Asc}}, []interface{}{0.25}, []interface{}{0.25, "song-1"}},
+		{"string", []Order{{"title", firestore.Asc}}, []interface{}{"Ünïcode & co"}, []interface{}{"Ünïcode & co", "song-1"}},
+		{"empty string", []Order{{"title", firestore.Asc}}, []interface{}{""}, []interface{}{"", "song-1"}},
+		{"bool", []Order{{"explicit", firestore.Asc}}, []interface{}{false}, []interface{}{false, "song-1"}},
+		{
+			"several keys",
+			[]Order{{"genre", firestore.Asc}, {"uploadedAt", firestore.Desc}},
+			[]interface{}{"Rock", uploaded},
+			[]interface{}{"Rock", uploaded, "song-1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cursor, err := encodeCursorValues(tt.values, "song-1", tt.orders)
+			if err != nil {
+				t.Fatalf("encode: %v", err)
+			}
+			got, err := decodeCursor(cursor, tt.orders)
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("decoded %d values, want %d", len(got), len(tt.want))
+			}
+			for i := range got {
+				// Values must keep their type: Firestore orders a timestamp and its string form differently
+				if want, ok := tt.want[i].(time.Time); ok {
+					if g, ok := got[i].(time.Time); !ok || !g.Equal(want) {
+						t.Errorf("value %d = %#v, want %v", i, got[i], want)
+					}
+					continue
+				}
+				if got[i] != tt.want[i] {
+					t.Errorf("value %d = %#v, want %#v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCursorUnsupportedValue(t *testing.T) {
+	if _, err := encodeCursorValues([]interface{}{[]string{"a"}}, "song-1", []Order{{"tags", firestore.Asc}}); err == nil {
+		t.Error("encoding an array sort value succeeded")
+	}
+}
+
+func TestDecodeCursorRejects(t *testing.T) {
+	byUpload := []Order{{"uploadedAt", firestore.Desc}}
+	cursor, err := encodeCursorValues([]interface{}{time.Now()}, "song-1", byUpload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		cursor string
+		orders []Order
+	}{
+		{"other field", cursor, []Order{{"playCount", firestore.Desc}}},
+		{"other direction", cursor, []Order{{"uploadedAt", firestore.Asc}}},
+		{"extra key", cursor, []Order{{"uploadedAt", firestore.Desc}, {"title", firestore.Asc}}},
+		{"not base64", "not a cursor!", byUpload},
+		{"not JSON", base64.RawURLEncoding.EncodeToString([]byte("{")), byUpload},
+		{"missing values", base64.RawURLEncoding.EncodeToString([]byte(`{"o":"uploadedAt:2,","v":[]}`)), byUpload},
+		{"untyped value", base64.RawURLEncoding.EncodeToString([]byte(`{"o":"uploadedAt:2,","v":[{},{"s":"song-1"}]}`)), byUpload},
+		{"ID not a string", base64.RawURLEncoding.EncodeToString([]byte(`{"o":"uploadedAt:2,","v":[{"n":1},{"n":2}]}`)), byUpload},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodeCursor(tt.cursor, tt.orders); err != ErrInvalidCursor {
+				t.Errorf("decodeCursor = %v, want ErrInvalidCursor", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"lipur_backend/models"
+
+	"cloud.google.com/go/firestore"
+)
+
+// Playlists live in users/{uid}/playlists/{id} and carry full copies of their songs in a "songs" array
+// (see AddSongToPlaylist). These helpers keep those copies in line with the songs collection.
+
+// PlaylistFieldOverrides enables array-contains queries on songIds across all users' playlists, which
+// Firestore does not index for collection groups by default.
+func PlaylistFieldOverrides() []FirestoreFieldOverride {
+	return []FirestoreFieldOverride{{
+		CollectionGroup: "playlists",
+		FieldPath:       "songIds",
+		Indexes: []FirestoreFieldIndex{
+			{ArrayConfig: "CONTAINS", QueryScope: "COLLECTION"},
+			{ArrayConfig: "CONTAINS", QueryScope: "COLLECTION_GROUP"},
+		},
+	}}
+}
+
+// RemoveSongFromPlaylists strips songId from the denormalized songs array of every user's playlists
+// and returns how many playlists were changed.
+func RemoveSongFromPlaylists(ctx context.Context, firestoreClient *firestore.Client, songId string) (int, error) {
+	return rewritePlaylists(ctx, firestoreClient, songId, func(songs []models.Song) []models.Song {
+		kept := []models.Song{}
+		for _, song := range songs {
+			if song.ID != songId {
+				kept = append(kept, song)
+			}
+		}
+		return kept
+	})
+}
+
+// UpdateSongInPlaylists applies update to every playlist copy of songId and returns how many playlists changed.
+func UpdateSongInPlaylists(ctx context.Context, firestoreClient *firestore.Client, songId string, update func(song *models.Song)) (int, error) {
+	return rewritePlaylists(ctx, firestoreClient, songId, func(songs []models.Song) []models.Song {
+		for i := range songs {
+			if songs[i].ID == songId {
+				update(&songs[i])
+			}
+		}
+		return songs
+	})
+}
+
+// rewritePlaylists replaces the songs array of every playlist containing songId with rewrite's result,
+// each in its own transaction.
+func rewritePlaylists(ctx context.Context, firestoreClient *firestore.Client, songId string, rewrite func([]models.Song) []models.Song) (int, error) {
+	// Playlist entries are whole song maps, which Firestore cannot filter on; songIds mirrors their IDs
+	docs, err := firestoreClient.CollectionGroup("playlists").Where("songIds", "array-contains", songId).Documents(ctx).GetAll()
+	if err != nil {
+		return 0, err
+	}
+
+	changed := 0
+	for _, doc := range docs {
+		var playlist models.Playlist
+		if err := doc.DataTo(&playlist); err != nil {
+			return changed, fmt.Errorf("playlist %s: %w", doc.Ref.Path, err)
+		}
+		if !playlist.HasSong(songId) {
+			continue
+		}
+		err := firestoreClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+			snap, err := tx.Get(doc.Ref)
+			if err != nil {
+				return err
+			}
+			var current models.Playlist
+			if err := snap.DataTo(&current); err != nil {
+				return err
+			}
+			songs := rewrite(current.Songs)
+			return tx.Update(doc.Ref, []firestore.Update{
+				{Path: "songs", Value: songs},
+				{Path: "songIds", Value: models.PlaylistSongIDs(songs)},
+			})
+		})
+		if err != nil {
+			return changed, fmt.Errorf("playlist %s: %w", doc.Ref.Path, err)
+		}
+		changed++
+	}
+	return changed, nil
+}
@@ -0,0 +1,80 @@
+package services
+
+import "cloud.google.com/go/firestore"
+
+//go:generate go run ../cmd/firestoreindexes -o ../firestore.indexes.json
+
+// SongFilter is an equality filter of GET /songs: a query parameter and the song field it matches.
+type SongFilter struct {
+	Param string
+	Field string
+}
+
+// SongFilters are the catalog filters; they can be combined.
+var SongFilters = []SongFilter{
+	{"genre", "genre"},
+	{"artistId", "artistId"},
+	{"createdYear", "createdYear"},
+	{"uploadUser", "upload_user"},
+}
+
+// SongSort is a sort key of GET /songs with the direction used when ?order is not given.
+type SongSort struct {
+	Key       string
+	Direction firestore.Direction
+}
+
+// SongSorts are the catalog sort keys; the first is the default. Keys are song field names.
+var SongSorts = []SongSort{
+	{"uploadedAt", firestore.Desc},
+	{"playCount", firestore.Desc},
+	{"likes", firestore.Desc},
+	{"title", firestore.Asc},
+}
+
+// FirestoreIndex is a composite index in the firestore.indexes.json format of the Firebase CLI.
+type FirestoreIndex struct {
+	CollectionGroup string                `json:"collectionGroup"`
+	QueryScope      string                `json:"queryScope"`
+	Fields          []FirestoreIndexField `json:"fields"`
+}
+
+type FirestoreIndexField struct {
+	FieldPath string `json:"fieldPath"`
+	Order     string `json:"order"`
+}
+
+// FirestoreFieldOverride replaces the automatic single-field indexes of one field.
+type FirestoreFieldOverride struct {
+	CollectionGroup string                `json:"collectionGroup"`
+	FieldPath       string                `json:"fieldPath"`
+	Indexes         []FirestoreFieldIndex `json:"indexes"`
+}
+
+type FirestoreFieldIndex struct {
+	Order       string `json:"order,omitempty"`
+	ArrayConfig string `json:"arrayConfig,omitempty"`
+	QueryScope  string `json:"queryScope"`
+}
+
+// SongCatalogIndexes lists the composite indexes the catalog queries need: one per filter, sort key and
+// direction. Firestore merges these for queries that combine several filters, so combinations need no
+// indexes of their own. Sorting without a filter uses the automatic single-field indexes.
+func SongCatalogIndexes() []FirestoreIndex {
+	var indexes []FirestoreIndex
+	for _, filter := range SongFilters {
+		for _, sort := range SongSorts {
+			for _, order := range []string{"ASCENDING", "DESCENDING"} {
+				indexes = append(indexes, FirestoreIndex{
+					CollectionGroup: "songs",
+					QueryScope:      "COLLECTION",
+					Fields: []FirestoreIndexField{
+						{FieldPath: filter.Field, Order: "ASCENDING"},
+						{FieldPath: sort.Key, Order: order},
+					},
+				})
+			}
+		}
+	}
+	return indexes
+}
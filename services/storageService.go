@@ -3,28 +3,56 @@ package services
 import (
 	"bytes"
 	"context"
+	"crypto/sha1"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
+	"strconv"
+	"sync"
 	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
 )
 
 type StorageService struct {
-	AccountID      string // FULL ID (from ENV)
-	ShortAccountID string // SHORT ID (from auth response)
-	AppKey         string
-	BucketName     string
-
-	AuthToken       string
-	APIUrl          string
-	DownloadUrl     string
-	UploadUrl       string
-	UploadAuthToken string
+	AccountID  string // FULL ID (from ENV)
+	AppKey     string
+	BucketName string
+
+	// Large-file settings: uploads above LargeFileThreshold bytes are split into PartSize parts
+	// and sent through b2_upload_part by UploadConcurrency workers.
+	LargeFileThreshold int64
+	PartSize           int64
+	UploadConcurrency  int
+
+	// Account credentials are shared by concurrent handlers; see b2Auth.go.
+	mu         sync.RWMutex
+	authMu     sync.Mutex // serializes b2_authorize_account calls
+	acct       b2Account
+	uploadURLs chan pooledUploadURL
+
+	// Bucket IDs never change, so the first successful lookup is kept for the process lifetime.
+	bucketMu sync.Mutex
+	bucketID string
+
+	downloadAuths downloadAuthCache
+
+	// Presigns uploads through B2's S3-compatible endpoint; built on first use, see PrepareDirectUpload.
+	presignMu sync.Mutex
+	presigner *s3.PresignClient
+}
+
+// envInt64 reads a positive integer env var, falling back to def when unset or invalid.
+func envInt64(key string, def int64) int64 {
+	v, err := strconv.ParseInt(os.Getenv(key), 10, 64)
+	if err != nil || v <= 0 {
+		return def
+	}
+	return v
 }
 
 func NewStorageService() *StorageService {
@@ -32,15 +60,15 @@ func NewStorageService() *StorageService {
 	appKey := os.Getenv("B2_APPLICATION_KEY")
 	bucketName := os.Getenv("B2_BUCKET_NAME")
 
-	fmt.Println("Loaded ENV values:")
-	fmt.Println("AccountID (from ENV):", accountID)
-	fmt.Println("AppKey (partial):", appKey[:5]+"...")
-	fmt.Println("BucketName:", bucketName)
-
 	return &StorageService{
-		AccountID:  accountID,
-		AppKey:     appKey,
-		BucketName: bucketName,
+		AccountID:          accountID,
+		AppKey:             appKey,
+		BucketName:         bucketName,
+		LargeFileThreshold: envInt64("B2_LARGE_FILE_THRESHOLD_MB", 64) << 20,
+		PartSize:           max(envInt64("B2_PART_SIZE_MB", 16), 5) << 20, // B2 minimum part size is 5 MB
+		UploadConcurrency:  int(envInt64("B2_UPLOAD_CONCURRENCY", 4)),
+		uploadURLs:         make(chan pooledUploadURL, uploadURLPoolSize),
+		downloadAuths:      downloadAuthCache{entries: map[string]downloadAuth{}},
 	}
 }
 
@@ -49,8 +77,10 @@ type authResponse struct {
 	APIUrl             string `json:"apiUrl"`
 	DownloadUrl        string `json:"downloadUrl"`
 	AccountId          string `json:"accountId"` // SHORT ID from response
+	S3ApiUrl           string `json:"s3ApiUrl"`
 }
 
+// Authenticate calls b2_authorize_account and replaces the cached account credentials.
 func (s *StorageService) Authenticate() error {
 	req, err := http.NewRequest("GET", "https://api.backblazeb2.com/b2api/v2/b2_authorize_account", nil)
 	if err != nil {
@@ -67,8 +97,7 @@ func (s *StorageService) Authenticate() error {
 	defer res.Body.Close()
 
 	if res.StatusCode != 200 {
-		bodyBytes, _ := ioutil.ReadAll(res.Body)
-		return fmt.Errorf("failed to authorize account: %s", string(bodyBytes))
+		return fmt.Errorf("failed to authorize account: %w", parseB2Error(res))
 	}
 
 	var authRes authResponse
@@ -76,14 +105,18 @@ func (s *StorageService) Authenticate() error {
 		return err
 	}
 
-	s.AuthToken = authRes.AuthorizationToken
-	s.APIUrl = authRes.APIUrl
-	s.DownloadUrl = authRes.DownloadUrl
-	s.ShortAccountID = authRes.AccountId // This is the short accountId
-	fmt.Println("AuthToken being used:", s.AuthToken)
+	s.mu.Lock()
+	s.acct = b2Account{
+		AuthToken:      authRes.AuthorizationToken,
+		APIUrl:         authRes.APIUrl,
+		DownloadUrl:    authRes.DownloadUrl,
+		ShortAccountID: authRes.AccountId, // This is the short accountId
+		S3ApiUrl:       authRes.S3ApiUrl,
+		authorizedAt:   time.Now(),
+	}
+	s.mu.Unlock()
 
-	fmt.Println("Authenticated! API URL:", s.APIUrl)
-	fmt.Println("Short Account ID:", s.ShortAccountID)
+	log.Printf("Authorized with B2, API URL %s", authRes.APIUrl)
 	return nil
 }
 
@@ -94,42 +127,31 @@ type bucketListResponse struct {
 	} `json:"buckets"`
 }
 
-func (s *StorageService) getBucketID() (string, error) {
-	bodyMap := map[string]string{
-		"accountId": s.ShortAccountID, // <-- Use SHORT account ID here!
-	}
-	bodyBytes, err := json.Marshal(bodyMap)
-	if err != nil {
-		return "", err
+func (s *StorageService) getBucketID(ctx context.Context) (string, error) {
+	s.bucketMu.Lock()
+	defer s.bucketMu.Unlock()
+	if s.bucketID != "" {
+		return s.bucketID, nil
 	}
 
-	req, err := http.NewRequest("POST", s.APIUrl+"/b2api/v2/b2_list_buckets", bytes.NewBuffer(bodyBytes))
+	acct, err := s.account()
 	if err != nil {
 		return "", err
 	}
-	req.Header.Set("Authorization", s.AuthToken)
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{Timeout: 10 * time.Second}
-	res, err := client.Do(req)
-	if err != nil {
-		return "", err
-	}
-	defer res.Body.Close()
-
-	if res.StatusCode != 200 {
-		bodyBytes, _ := ioutil.ReadAll(res.Body)
-		return "", fmt.Errorf("list buckets failed: %s", string(bodyBytes))
-	}
 
 	var bucketRes bucketListResponse
-	if err := json.NewDecoder(res.Body).Decode(&bucketRes); err != nil {
+	err = s.b2Call(ctx, "b2_list_buckets", map[string]string{
+		"accountId":  acct.ShortAccountID, // <-- Use SHORT account ID here!
+		"bucketName": s.BucketName,
+	}, &bucketRes)
+	if err != nil {
 		return "", err
 	}
 
 	for _, b := range bucketRes.Buckets {
 		if b.BucketName == s.BucketName {
 			log.Println("Found bucket:", b.BucketName, "with ID:", b.BucketID)
+			s.bucketID = b.BucketID
 			return b.BucketID, nil
 		}
 	}
@@ -137,146 +159,327 @@ func (s *StorageService) getBucketID() (string, error) {
 	return "", errors.New("bucket not found")
 }
 
-type uploadUrlResponse struct {
-	UploadUrl          string `json:"uploadUrl"`
-	AuthorizationToken string `json:"authorizationToken"`
-}
-
-func (s *StorageService) getUploadURL() error {
-	bucketID, err := s.getBucketID()
+// b2Call POSTs reqBody as JSON to the named B2 API operation and decodes the response into out (if non-nil).
+// An expired or rejected account token is refreshed and the call retried once.
+func (s *StorageService) b2Call(ctx context.Context, apiName string, reqBody interface{}, out interface{}) error {
+	body, err := json.Marshal(reqBody)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to marshal %s request: %w", apiName, err)
 	}
 
-	reqBody := []byte(fmt.Sprintf(`{"bucketId":"%s"}`, bucketID))
-	req, err := http.NewRequest("POST", s.APIUrl+"/b2api/v2/b2_get_upload_url", bytes.NewBuffer(reqBody))
-	if err != nil {
-		return err
-	}
-	req.Header.Set("Authorization", s.AuthToken)
-	req.Header.Set("Content-Type", "application/json")
+	for attempt := 0; ; attempt++ {
+		acct, err := s.account()
+		if err != nil {
+			return err
+		}
 
-	client := &http.Client{Timeout: 10 * time.Second}
-	res, err := client.Do(req)
-	if err != nil {
-		return err
-	}
-	defer res.Body.Close()
+		req, err := http.NewRequestWithContext(ctx, "POST", acct.APIUrl+"/b2api/v2/"+apiName, bytes.NewBuffer(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", acct.AuthToken)
+		req.Header.Set("Content-Type", "application/json")
 
-	if res.StatusCode != 200 {
-		bodyBytes, _ := ioutil.ReadAll(res.Body)
-		return fmt.Errorf("get upload url failed: %s", string(bodyBytes))
+		client := &http.Client{Timeout: 10 * time.Second}
+		res, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+
+		if res.StatusCode != 200 {
+			b2Err := parseB2Error(res)
+			res.Body.Close()
+			if attempt == 0 && isB2AuthError(b2Err) {
+				s.invalidateAccount(acct.AuthToken)
+				continue
+			}
+			return fmt.Errorf("%s failed: %w", apiName, b2Err)
+		}
+
+		defer res.Body.Close()
+		if out == nil {
+			return nil
+		}
+		return json.NewDecoder(res.Body).Decode(out)
 	}
+}
 
-	var uploadRes uploadUrlResponse
-	if err := json.NewDecoder(res.Body).Decode(&uploadRes); err != nil {
-		return err
+func (s *StorageService) publicURL(key string) string {
+	s.mu.RLock()
+	downloadUrl := s.acct.DownloadUrl
+	s.mu.RUnlock()
+	return fmt.Sprintf("%s/file/%s/%s", downloadUrl, s.BucketName, escapeKey(key))
+}
+
+// uploadClient has no overall timeout: upload bodies are streamed and can take minutes.
+// Cancellation comes from the request context instead.
+var uploadClient = &http.Client{}
+
+// b2FileResponse is the file description returned by b2_upload_file and b2_finish_large_file.
+type b2FileResponse struct {
+	ContentLength   int64  `json:"contentLength"`
+	ContentSha1     string `json:"contentSha1"`
+	ContentType     string `json:"contentType"`
+	FileID          string `json:"fileId"`
+	UploadTimestamp int64  `json:"uploadTimestamp"`
+}
+
+func (s *StorageService) toFileInfo(key string, f b2FileResponse) *FileInfo {
+	return &FileInfo{
+		Key:         key,
+		Size:        f.ContentLength,
+		ContentType: f.ContentType,
+		ETag:        f.FileID,
+		SHA1:        f.ContentSha1,
+		URL:         s.publicURL(key),
+		UpdatedAt:   time.UnixMilli(f.UploadTimestamp),
 	}
+}
 
-	s.UploadUrl = uploadRes.UploadUrl
-	s.UploadAuthToken = uploadRes.AuthorizationToken
+// trailingSHA1 emits the hex digest of its sha1Reader once the content has been fully read,
+// which is what B2 expects after the body when X-Bz-Content-Sha1 is "hex_digits_at_end".
+type trailingSHA1 struct {
+	content *sha1Reader
+	digest  *bytes.Reader
+}
 
-	log.Println("Got upload URL:", s.UploadUrl)
-	return nil
+func (t *trailingSHA1) Read(p []byte) (int, error) {
+	if t.digest == nil {
+		t.digest = bytes.NewReader([]byte(t.content.Sum()))
+	}
+	return t.digest.Read(p)
 }
 
-func (s *StorageService) UploadFile(ctx context.Context, filename string, data []byte) (string, error) {
-	// Authenticate if needed
-	if s.AuthToken == "" || s.APIUrl == "" || s.ShortAccountID == "" {
-		if err := s.Authenticate(); err != nil {
-			return "", err
-		}
+// UploadFile streams body to B2. Files larger than LargeFileThreshold go through the large-file API.
+// The SHA-1 is computed while streaming and appended to the body, so B2 rejects corrupted uploads.
+// Seekable bodies are retried once with a fresh upload URL when B2 rejects the token or the URL is busy.
+func (s *StorageService) UploadFile(ctx context.Context, key string, body io.Reader, size int64, contentType string) (*FileInfo, error) {
+	if contentType == "" {
+		contentType = "b2/x-auto"
+	}
+	if size > s.LargeFileThreshold {
+		return s.uploadLargeFile(ctx, key, body, size, contentType)
 	}
 
-	// Get upload URL if needed
-	if s.UploadUrl == "" || s.UploadAuthToken == "" {
-		if err := s.getUploadURL(); err != nil {
-			return "", err
+	seeker, seekable := body.(io.Seeker)
+	for attempt := 0; ; attempt++ {
+		uploadURL, err := s.acquireUploadURL(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		info, err := s.uploadOnce(ctx, uploadURL, key, body, size, contentType)
+		if err == nil {
+			s.releaseUploadURL(uploadURL)
+			return info, nil
+		}
+		// A failed upload URL must not be reused; B2 expects the client to fetch a new one.
+		if attempt > 0 || !seekable || !isB2RetryableUploadError(err) {
+			return nil, err
+		}
+		log.Printf("Retrying upload of %s with a new upload URL: %v", key, err)
+		if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+			return nil, err
 		}
 	}
-	safeFileName := url.PathEscape(filename)
+}
 
-	req, err := http.NewRequest("POST", s.UploadUrl, bytes.NewReader(data))
+func (s *StorageService) uploadOnce(ctx context.Context, uploadURL pooledUploadURL, key string, body io.Reader, size int64, contentType string) (*FileInfo, error) {
+	content := newSHA1Reader(body)
+	req, err := http.NewRequestWithContext(ctx, "POST", uploadURL.UploadUrl, io.MultiReader(content, &trailingSHA1{content: content}))
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	req.ContentLength = size + sha1.Size*2
 
-	req.Header.Set("Authorization", s.UploadAuthToken)
-	req.Header.Set("X-Bz-File-Name", safeFileName) // <-- fixed here
-	req.Header.Set("Content-Type", "b2/x-auto")
-	req.Header.Set("X-Bz-Content-Sha1", "do_not_verify")
-	req.Header.Set("Content-Length", fmt.Sprintf("%d", len(data)))
+	req.Header.Set("Authorization", uploadURL.AuthorizationToken)
+	req.Header.Set("X-Bz-File-Name", escapeKey(key))
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Bz-Content-Sha1", "hex_digits_at_end")
 
-	client := &http.Client{Timeout: 60 * time.Second}
-	res, err := client.Do(req)
+	res, err := uploadClient.Do(req)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer res.Body.Close()
 
 	if res.StatusCode != 200 {
-		bodyBytes, _ := ioutil.ReadAll(res.Body)
-		return "", fmt.Errorf("upload failed: %s", string(bodyBytes))
+		return nil, fmt.Errorf("upload failed: %w", parseB2Error(res))
 	}
 
-	publicUrl := fmt.Sprintf("%s/file/%s/%s", s.DownloadUrl, s.BucketName, filename)
-	return publicUrl, nil
+	var uploadRes b2FileResponse
+	if err := json.NewDecoder(res.Body).Decode(&uploadRes); err != nil {
+		return nil, err
+	}
+	info := s.toFileInfo(key, uploadRes)
+	info.SHA1 = content.Sum()
+	return info, nil
 }
 
-func (s *StorageService) GenerateDownloadURL(fileName string, validDurationSeconds int) (string, error) {
-	if s.AuthToken == "" || s.APIUrl == "" || s.ShortAccountID == "" {
-		if err := s.Authenticate(); err != nil {
-			return "", err
+// DeleteFile removes every stored version of key via b2_delete_file_version.
+func (s *StorageService) DeleteFile(ctx context.Context, key string) error {
+	bucketID, err := s.getBucketID(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Versions are listed by name, then newest first; names sharing key as a prefix come after all of its versions
+	req := map[string]interface{}{
+		"bucketId":      bucketID,
+		"startFileName": key,
+		"prefix":        key,
+		"maxFileCount":  100,
+	}
+	for {
+		var versions struct {
+			Files []struct {
+				FileID   string `json:"fileId"`
+				FileName string `json:"fileName"`
+			} `json:"files"`
+			NextFileName *string `json:"nextFileName"`
+			NextFileID   *string `json:"nextFileId"`
+		}
+		if err := s.b2Call(ctx, "b2_list_file_versions", req, &versions); err != nil {
+			return err
+		}
+
+		for _, f := range versions.Files {
+			if f.FileName != key {
+				continue
+			}
+			err := s.b2Call(ctx, "b2_delete_file_version", map[string]string{
+				"fileName": f.FileName,
+				"fileId":   f.FileID,
+			}, nil)
+			if err != nil {
+				return err
+			}
+			log.Println("Deleted file version:", f.FileName, f.FileID)
+		}
+
+		if versions.NextFileName == nil || *versions.NextFileName != key {
+			return nil
+		}
+		req["startFileName"] = *versions.NextFileName
+		if versions.NextFileID != nil {
+			req["startFileId"] = *versions.NextFileID
 		}
 	}
+}
 
-	bucketID, err := s.getBucketID()
+// ListFiles pages through b2_list_file_names.
+func (s *StorageService) ListFiles(ctx context.Context, prefix string) ([]string, error) {
+	bucketID, err := s.getBucketID(ctx)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	requestBody := map[string]interface{}{
-		"bucketId":               bucketID,
-		"fileNamePrefix":         fileName,
-		"validDurationInSeconds": validDurationSeconds,
+	var keys []string
+	startFileName := ""
+	for {
+		var page struct {
+			Files []struct {
+				FileName string `json:"fileName"`
+			} `json:"files"`
+			NextFileName *string `json:"nextFileName"`
+		}
+		req := map[string]interface{}{
+			"bucketId":     bucketID,
+			"prefix":       prefix,
+			"maxFileCount": 1000,
+		}
+		if startFileName != "" {
+			req["startFileName"] = startFileName
+		}
+		if err := s.b2Call(ctx, "b2_list_file_names", req, &page); err != nil {
+			return nil, err
+		}
+		for _, f := range page.Files {
+			keys = append(keys, f.FileName)
+		}
+		if page.NextFileName == nil {
+			return keys, nil
+		}
+		startFileName = *page.NextFileName
 	}
+}
 
-	body, _ := json.Marshal(requestBody)
+// downloadRequest issues an authorized request against the B2 download endpoint for key.
+func (s *StorageService) downloadRequest(ctx context.Context, method, key, rangeValue string) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		acct, err := s.account()
+		if err != nil {
+			return nil, err
+		}
 
-	req, err := http.NewRequest("POST", s.APIUrl+"/b2api/v2/b2_get_download_authorization", bytes.NewBuffer(body))
-	if err != nil {
-		return "", err
+		req, err := http.NewRequestWithContext(ctx, method, s.publicURL(key), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", acct.AuthToken)
+		if rangeValue != "" {
+			req.Header.Set("Range", rangeValue)
+		}
+
+		// No client timeout: range reads stream for as long as the caller consumes them.
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		switch res.StatusCode {
+		case http.StatusOK, http.StatusPartialContent:
+			return res, nil
+		case http.StatusNotFound:
+			res.Body.Close()
+			return nil, ErrFileNotFound
+		}
+
+		b2Err := parseB2Error(res)
+		res.Body.Close()
+		if attempt == 0 && isB2AuthError(b2Err) {
+			s.invalidateAccount(acct.AuthToken)
+			continue
+		}
+		return nil, fmt.Errorf("download failed: %w", b2Err)
 	}
-	req.Header.Set("Authorization", s.AuthToken)
-	req.Header.Set("Content-Type", "application/json")
+}
 
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
+// StatFile reads the object headers with a HEAD request on the download URL.
+func (s *StorageService) StatFile(ctx context.Context, key string) (*FileInfo, error) {
+	res, err := s.downloadRequest(ctx, "HEAD", key, "")
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		bodyBytes, _ := ioutil.ReadAll(resp.Body)
-		return "", fmt.Errorf("download auth failed: %s", string(bodyBytes))
+	res.Body.Close()
+
+	info := &FileInfo{
+		Key:         key,
+		Size:        res.ContentLength,
+		ContentType: res.Header.Get("Content-Type"),
+		ETag:        res.Header.Get("X-Bz-File-Id"),
+		SHA1:        res.Header.Get("X-Bz-Content-Sha1"),
+		URL:         s.publicURL(key),
 	}
-
-	var authResp struct {
-		AuthorizationToken string `json:"authorizationToken"`
+	// Large files have no whole-file hash of their own; it is kept in the large_file_sha1 file info.
+	if info.SHA1 == "" || info.SHA1 == "none" {
+		info.SHA1 = res.Header.Get("X-Bz-Info-Large_file_sha1")
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&authResp); err != nil {
-		return "", err
+	if ts, err := strconv.ParseInt(res.Header.Get("X-Bz-Upload-Timestamp"), 10, 64); err == nil {
+		info.UpdatedAt = time.UnixMilli(ts)
 	}
+	return info, nil
+}
 
-	// Construct pre-signed URL
-	url := fmt.Sprintf(
-		"%s/file/%s/%s?Authorization=%s",
-		s.DownloadUrl,
-		s.BucketName,
-		fileName,
-		authResp.AuthorizationToken,
-	)
+func (s *StorageService) ReadRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	res, err := s.downloadRequest(ctx, "GET", key, rangeHeader(offset, length))
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
 
-	return url, nil
+// GenerateDownloadURL is GenerateSignedURL with the validity given in seconds.
+func (s *StorageService) GenerateDownloadURL(fileName string, validDurationSeconds int) (string, error) {
+	return s.GenerateSignedURL(context.Background(), fileName, time.Duration(validDurationSeconds)*time.Second)
 }
@@ -0,0 +1,221 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ErrUploadNotFound is returned for unknown, terminated or expired resumable uploads.
+var ErrUploadNotFound = errors.New("upload not found")
+
+// TusUpload is the state of one resumable upload, persisted next to its data so uploads survive restarts.
+type TusUpload struct {
+	ID          string            `json:"id"`
+	Length      int64             `json:"length"`
+	Offset      int64             `json:"offset"`
+	Metadata    map[string]string `json:"metadata"`
+	RawMetadata string            `json:"rawMetadata"` // Upload-Metadata as sent, echoed back on HEAD
+	Uid         string            `json:"uid,omitempty"`
+	Format      string            `json:"format,omitempty"` // sniffed once the first bytes arrive
+	SongID      string            `json:"songId,omitempty"` // set once the song document exists
+	CreatedAt   time.Time         `json:"createdAt"`
+	UpdatedAt   time.Time         `json:"updatedAt"`
+}
+
+// TusStore stages resumable uploads on local disk until they are complete: {id}.bin holds the bytes
+// received so far and {id}.json the upload state. Instances behind a load balancer need a shared
+// TUS_UPLOAD_DIR or sticky sessions.
+type TusStore struct {
+	Dir    string
+	Expiry time.Duration
+
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+// NewTusStore reads TUS_UPLOAD_DIR (default $TMPDIR/lipur-tus) and TUS_UPLOAD_EXPIRY_HOURS (default 24).
+func NewTusStore() (*TusStore, error) {
+	dir := os.Getenv("TUS_UPLOAD_DIR")
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "lipur-tus")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create tus upload dir: %w", err)
+	}
+	return &TusStore{
+		Dir:    dir,
+		Expiry: time.Duration(envInt64("TUS_UPLOAD_EXPIRY_HOURS", 24)) * time.Hour,
+		locks:  map[string]*sync.Mutex{},
+	}, nil
+}
+
+func (s *TusStore) dataPath(id string) string { return filepath.Join(s.Dir, id+".bin") }
+func (s *TusStore) infoPath(id string) string { return filepath.Join(s.Dir, id+".json") }
+
+// Create assigns an ID to u and allocates its (empty) data file.
+func (s *TusStore) Create(u *TusUpload) error {
+	u.ID = uuid.New().String()
+	u.CreatedAt = time.Now()
+	f, err := os.Create(s.dataPath(u.ID))
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return s.Save(u)
+}
+
+// Get loads an upload's state. IDs are validated so they can never address files outside Dir.
+func (s *TusStore) Get(id string) (*TusUpload, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrUploadNotFound
+	}
+	data, err := os.ReadFile(s.infoPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrUploadNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var u TusUpload
+	if err := json.Unmarshal(data, &u); err != nil {
+		return nil, err
+	}
+	if time.Now().After(s.ExpiresAt(&u)) {
+		return nil, ErrUploadNotFound
+	}
+	return &u, nil
+}
+
+// Save writes the upload state atomically, so a crash never leaves a truncated record behind.
+func (s *TusStore) Save(u *TusUpload) error {
+	u.UpdatedAt = time.Now()
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	tmp := s.infoPath(u.ID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.infoPath(u.ID))
+}
+
+// Append writes r at the upload's current offset, never past its declared length, and records the new offset.
+// Bytes received before a dropped connection are kept, so the client can resume right after them.
+func (s *TusStore) Append(u *TusUpload, r io.Reader) (int64, error) {
+	f, err := os.OpenFile(s.dataPath(u.ID), os.O_WRONLY, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := f.Seek(u.Offset, io.SeekStart); err != nil {
+		f.Close()
+		return 0, err
+	}
+	n, copyErr := io.Copy(f, io.LimitReader(r, u.Length-u.Offset))
+	if err := f.Sync(); copyErr == nil {
+		copyErr = err
+	}
+	f.Close()
+
+	u.Offset += n
+	if err := s.Save(u); err != nil {
+		return n, err
+	}
+	return n, copyErr
+}
+
+// Open returns the bytes received so far.
+func (s *TusStore) Open(id string) (*os.File, error) {
+	return os.Open(s.dataPath(id))
+}
+
+// ReleaseData removes the staged bytes of a finished upload but keeps its state for HEAD requests.
+func (s *TusStore) ReleaseData(id string) error {
+	if err := os.Remove(s.dataPath(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Delete removes an upload entirely.
+func (s *TusStore) Delete(id string) error {
+	if err := s.ReleaseData(id); err != nil {
+		return err
+	}
+	if err := os.Remove(s.infoPath(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// ExpiresAt is when an upload that receives no further data is discarded.
+func (s *TusStore) ExpiresAt(u *TusUpload) time.Time {
+	return u.UpdatedAt.Add(s.Expiry)
+}
+
+// Lock serializes requests on one upload; tus clients must not send concurrent PATCHes, but retries can overlap.
+func (s *TusStore) Lock(id string) func() {
+	s.mu.Lock()
+	l, ok := s.locks[id]
+	if !ok {
+		l = &sync.Mutex{}
+		s.locks[id] = l
+	}
+	s.mu.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+// StartCleanup removes expired uploads every hour until ctx is done.
+func (s *TusStore) StartCleanup(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for {
+			s.cleanup()
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (s *TusStore) cleanup() {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		log.Printf("Failed to list tus uploads: %v", err)
+		return
+	}
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok {
+			continue
+		}
+		// Finished uploads are kept for the same period, so clients can still HEAD them for the song ID
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < s.Expiry {
+			continue
+		}
+		unlock := s.Lock(id)
+		if err := s.Delete(id); err != nil {
+			log.Printf("Failed to remove expired upload %s: %v", id, err)
+		}
+		unlock()
+		s.mu.Lock()
+		delete(s.locks, id)
+		s.mu.Unlock()
+	}
+}
@@ -0,0 +1,74 @@
+package services
+
+import (
+	"log"
+	"os"
+	"strconv"
+)
+
+// Upload roles, derived from the caller's Firebase token.
+const (
+	RoleAdmin     = "admin"
+	RoleUser      = "user"
+	RoleAnonymous = "anonymous"
+)
+
+// UploadPolicy holds the maximum upload size per role, for single files and for whole albums.
+// A limit of 0 means the role may not upload at all.
+type UploadPolicy struct {
+	maxBytes      map[string]int64
+	maxAlbumBytes map[string]int64
+}
+
+// NewUploadPolicy reads UPLOAD_MAX_MB_ADMIN (default 1024), UPLOAD_MAX_MB_USER (default 200)
+// and UPLOAD_MAX_MB_ANONYMOUS (default 50) for files, and UPLOAD_MAX_ALBUM_MB_ADMIN (default 4096),
+// UPLOAD_MAX_ALBUM_MB_USER (default 1024) and UPLOAD_MAX_ALBUM_MB_ANONYMOUS (default 200) for albums.
+func NewUploadPolicy() *UploadPolicy {
+	p := &UploadPolicy{
+		maxBytes: map[string]int64{
+			RoleAdmin:     uploadLimitMB("UPLOAD_MAX_MB_ADMIN", 1024),
+			RoleUser:      uploadLimitMB("UPLOAD_MAX_MB_USER", 200),
+			RoleAnonymous: uploadLimitMB("UPLOAD_MAX_MB_ANONYMOUS", 50),
+		},
+		maxAlbumBytes: map[string]int64{
+			RoleAdmin:     uploadLimitMB("UPLOAD_MAX_ALBUM_MB_ADMIN", 4096),
+			RoleUser:      uploadLimitMB("UPLOAD_MAX_ALBUM_MB_USER", 1024),
+			RoleAnonymous: uploadLimitMB("UPLOAD_MAX_ALBUM_MB_ANONYMOUS", 200),
+		},
+	}
+	log.Printf("Upload limits: admin %d MB, user %d MB, anonymous %d MB",
+		p.maxBytes[RoleAdmin]>>20, p.maxBytes[RoleUser]>>20, p.maxBytes[RoleAnonymous]>>20)
+	log.Printf("Album upload limits: admin %d MB, user %d MB, anonymous %d MB",
+		p.maxAlbumBytes[RoleAdmin]>>20, p.maxAlbumBytes[RoleUser]>>20, p.maxAlbumBytes[RoleAnonymous]>>20)
+	return p
+}
+
+// MaxBytes returns the largest file the role may upload; unknown roles get the anonymous limit.
+func (p *UploadPolicy) MaxBytes(role string) int64 {
+	if limit, ok := p.maxBytes[role]; ok {
+		return limit
+	}
+	return p.maxBytes[RoleAnonymous]
+}
+
+// MaxAlbumBytes returns how much the role may upload in one album request, counting ZIP archives both as
+// sent and as extracted; unknown roles get the anonymous limit.
+func (p *UploadPolicy) MaxAlbumBytes(role string) int64 {
+	if limit, ok := p.maxAlbumBytes[role]; ok {
+		return limit
+	}
+	return p.maxAlbumBytes[RoleAnonymous]
+}
+
+func uploadLimitMB(name string, def int64) int64 {
+	mb := def
+	if v := os.Getenv(name); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			log.Printf("Ignoring invalid %s=%q", name, v)
+		} else {
+			mb = n
+		}
+	}
+	return mb << 20
+}
@@ -0,0 +1,18 @@
+package services
+
+// WaveformResolutions are the peak files stored per song, by name and width in points (min/max pairs): small
+// enough for a list thumbnail, a phone-wide seek bar and a zoomable desktop view.
+var WaveformResolutions = []struct {
+	Name   string
+	Points int
+}{
+	{"low", 256},
+	{"medium", 1024},
+	{"high", 4096},
+}
+
+// WaveformFormats are the audiowaveform formats each resolution is stored in, with their content types.
+var WaveformFormats = map[string]string{
+	"json": "application/json",
+	"dat":  "application/octet-stream",
+}
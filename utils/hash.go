@@ -0,0 +1,16 @@
+package utils
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+)
+
+// SHA1Hex returns the hex-encoded SHA-1 of everything read from r.
+func SHA1Hex(r io.Reader) (string, error) {
+	h := sha1.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,18 @@
+package utils
+
+import "time"
+
+// Retry calls fn up to attempts times, doubling delay after every failure, and returns the last error.
+func Retry(attempts int, delay time.Duration, fn func() error) error {
+	var err error
+	for i := 0; i < attempts; i++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		if i < attempts-1 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+	return err
+}
@@ -0,0 +1,147 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"lipur_backend/services"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+)
+
+// HLS status values stored in the song document's hlsStatus field.
+const (
+	HLSPending = "pending"
+	HLSReady   = "ready"
+	HLSFailed  = "failed"
+)
+
+// HLSWorker packages uploaded songs into HLS (fMP4 segments plus a .m3u8 playlist) with a local ffmpeg,
+// and stores the rendition under songs/{songId}/hls/ next to the original. It runs as a step of song processing.
+type HLSWorker struct {
+	storage         services.Storage
+	firestoreClient *firestore.Client
+	ffmpegPath      string
+}
+
+// NewHLSWorker reads FFMPEG_PATH (default "ffmpeg" on PATH). Without ffmpeg the worker is disabled
+// and songs simply have no HLS rendition.
+func NewHLSWorker(storage services.Storage, firestoreClient *firestore.Client) *HLSWorker {
+	resolved, err := services.FFmpegPath()
+	if err != nil {
+		log.Printf("ffmpeg not found (%v), HLS packaging disabled", err)
+		resolved = ""
+	}
+
+	return &HLSWorker{
+		storage:         storage,
+		firestoreClient: firestoreClient,
+		ffmpegPath:      resolved,
+	}
+}
+
+// Enabled reports whether ffmpeg is available.
+func (w *HLSWorker) Enabled() bool {
+	return w != nil && w.ffmpegPath != ""
+}
+
+// Package builds the HLS rendition of a song whose hlsStatus is pending and records the result on the song.
+// Songs that are already packaged (or that share the rendition of identical content) are left alone.
+func (w *HLSWorker) Package(ctx context.Context, song *songSource) error {
+	if !w.Enabled() || song.Song.HLSStatus == HLSReady {
+		return nil
+	}
+
+	songRef := song.Ref
+	started := time.Now()
+	playlist, err := w.packageSong(ctx, song)
+	if errors.Is(err, errSongDeleted) {
+		return err
+	}
+	if err != nil {
+		songRef.Update(ctx, []firestore.Update{
+			{Path: "hlsStatus", Value: HLSFailed},
+			{Path: "hlsError", Value: err.Error()},
+		})
+		return fmt.Errorf("HLS packaging: %w", err)
+	}
+
+	_, err = songRef.Update(ctx, []firestore.Update{
+		{Path: "hlsStatus", Value: HLSReady},
+		{Path: "hlsError", Value: firestore.Delete},
+		{Path: "hlsPlaylistKey", Value: playlist.Key},
+		{Path: "hlsPlaylistUrl", Value: playlist.URL},
+		{Path: "hlsPrefix", Value: services.SongHLSPrefix(songRef.ID)},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save HLS result: %w", err)
+	}
+	log.Printf("Packaged song %s as HLS in %s", songRef.ID, time.Since(started).Round(time.Millisecond))
+	return nil
+}
+
+func (w *HLSWorker) packageSong(ctx context.Context, song *songSource) (*services.FileInfo, error) {
+	input, err := song.Input(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	outDir := filepath.Join(song.workDir, "hls")
+	if err := os.Mkdir(outDir, 0o755); err != nil {
+		return nil, err
+	}
+	cmd := exec.CommandContext(ctx, w.ffmpegPath,
+		"-hide_banner", "-loglevel", "error",
+		"-i", input,
+		"-vn", "-c:a", "aac", "-b:a", "128k",
+		"-f", "hls",
+		"-hls_time", "6",
+		"-hls_playlist_type", "vod",
+		"-hls_segment_type", "fmp4",
+		"-hls_fmp4_init_filename", "init.mp4",
+		"-hls_segment_filename", filepath.Join(outDir, "seg_%05d.m4s"),
+		filepath.Join(outDir, "playlist.m3u8"),
+	)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("ffmpeg: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	// Upload segments before the playlist, so a visible playlist never references missing segments
+	entries, err := os.ReadDir(outDir)
+	if err != nil {
+		return nil, err
+	}
+	prefix := services.SongHLSPrefix(song.Ref.ID)
+	for _, entry := range entries {
+		if entry.Name() == "playlist.m3u8" {
+			continue
+		}
+		if _, err := w.upload(ctx, song, filepath.Join(outDir, entry.Name()), prefix+entry.Name(), "audio/mp4"); err != nil {
+			return nil, err
+		}
+	}
+	return w.upload(ctx, song, filepath.Join(outDir, "playlist.m3u8"), services.SongHLSPlaylistKey(song.Ref.ID), services.HLSContentType)
+}
+
+func (w *HLSWorker) upload(ctx context.Context, song *songSource, src, key, contentType string) (*services.FileInfo, error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	info, err := song.Upload(ctx, key, f, fi.Size(), contentType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload %s: %w", key, err)
+	}
+	return info, nil
+}
@@ -0,0 +1,385 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"lipur_backend/services"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Job status values.
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+)
+
+const jobsCollection = "jobs"
+
+// Retry backoff: jobBackoff after the first failure, doubling up to jobMaxBackoff.
+const (
+	jobBackoff    = 30 * time.Second
+	jobMaxBackoff = time.Hour
+)
+
+// retryDelay is the backoff after the given number of failed attempts. It stops doubling at jobMaxBackoff, as a
+// plain shift overflows for large MaxAttempts.
+func retryDelay(attempts int) time.Duration {
+	delay := jobBackoff
+	for i := 1; i < attempts && delay < jobMaxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, jobMaxBackoff)
+}
+
+// Job is jobs/{ID}, the persistent record of one unit of background work.
+type Job struct {
+	ID          string    `firestore:"id" json:"id"`
+	Type        string    `firestore:"type" json:"type"`
+	SongID      string    `firestore:"songId" json:"songId,omitempty"`
+	Status      string    `firestore:"status" json:"status"`
+	Stage       string    `firestore:"stage" json:"stage"`       // what the handler is doing right now
+	Progress    float64   `firestore:"progress" json:"progress"` // 0 to 1
+	Error       string    `firestore:"error" json:"error,omitempty"`
+	Attempts    int       `firestore:"attempts" json:"attempts"`
+	MaxAttempts int       `firestore:"maxAttempts" json:"maxAttempts"`
+	RunAt       time.Time `firestore:"runAt" json:"runAt"`  // not before; pushed back by retries
+	LeaseUntil  time.Time `firestore:"leaseUntil" json:"-"` // a running job past its lease is taken over
+	CreatedAt   time.Time `firestore:"createdAt" json:"createdAt"`
+	UpdatedAt   time.Time `firestore:"updatedAt" json:"updatedAt"`
+	FinishedAt  time.Time `firestore:"finishedAt" json:"finishedAt"` // zero until succeeded or failed
+}
+
+// Finished reports whether the job reached a final state.
+func (j *Job) Finished() bool {
+	return j.Status == JobSucceeded || j.Status == JobFailed
+}
+
+// ProgressFunc lets a handler report its stage and progress (0 to 1); every report also renews the lease.
+type ProgressFunc func(stage string, progress float64)
+
+// JobHandler runs a job. A returned error schedules a retry until MaxAttempts is reached.
+type JobHandler func(ctx context.Context, job *Job, progress ProgressFunc) error
+
+// JobQueue keeps jobs in Firestore so they survive restarts, and runs them on a local worker pool.
+// Several instances may share the collection: a job is claimed in a transaction and leased to one of them.
+type JobQueue struct {
+	firestoreClient *firestore.Client
+	handlers        map[string]JobHandler
+	workers         int
+	maxAttempts     int
+	pollInterval    time.Duration
+	lease           time.Duration
+	wake            chan struct{}
+
+	// OnFinish, when set, is called once a job succeeded or finally failed.
+	OnFinish func(ctx context.Context, job *Job)
+}
+
+// NewJobQueue reads JOB_WORKERS (parallel jobs, default 2), JOB_MAX_ATTEMPTS (default 5) and
+// JOB_POLL_SECONDS (default 10). Register handlers before Start.
+func NewJobQueue(firestoreClient *firestore.Client) *JobQueue {
+	return &JobQueue{
+		firestoreClient: firestoreClient,
+		handlers:        map[string]JobHandler{},
+		workers:         envInt("JOB_WORKERS", 2),
+		maxAttempts:     envInt("JOB_MAX_ATTEMPTS", 5),
+		pollInterval:    time.Duration(envInt("JOB_POLL_SECONDS", 10)) * time.Second,
+		lease:           30 * time.Minute,
+		wake:            make(chan struct{}, 1),
+	}
+}
+
+func envInt(name string, fallback int) int {
+	if n, err := strconv.Atoi(os.Getenv(name)); err == nil && n > 0 {
+		return n
+	}
+	return fallback
+}
+
+// Handle registers the handler for jobType.
+func (q *JobQueue) Handle(jobType string, handler JobHandler) {
+	q.handlers[jobType] = handler
+}
+
+// NewJob returns a queued job, due now, that is not stored yet.
+func (q *JobQueue) NewJob(jobType, songId string) *Job {
+	now := time.Now()
+	return &Job{
+		ID:          uuid.New().String(),
+		Type:        jobType,
+		SongID:      songId,
+		Status:      JobQueued,
+		Stage:       "queued",
+		MaxAttempts: q.maxAttempts,
+		RunAt:       now,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+}
+
+// Ref returns the document of job id.
+func (q *JobQueue) Ref(id string) *firestore.DocumentRef {
+	return q.firestoreClient.Collection(jobsCollection).Doc(id)
+}
+
+// Add stores job as part of batch, so it exists exactly when the documents it works on do. Call Notify
+// once the batch is committed.
+func (q *JobQueue) Add(batch *firestore.WriteBatch, job *Job) {
+	batch.Set(q.Ref(job.ID), job)
+}
+
+// Enqueue stores job on its own and wakes the pool.
+func (q *JobQueue) Enqueue(ctx context.Context, job *Job) error {
+	if _, err := q.Ref(job.ID).Set(ctx, job); err != nil {
+		return err
+	}
+	q.Notify()
+	return nil
+}
+
+// Notify makes the pool look for due jobs now instead of at the next poll.
+func (q *JobQueue) Notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Delete removes job id, which cancels it: a queued job never runs, and a running one can no longer record its
+// progress or outcome. Its handler keeps going, so it must check that its work is still wanted before side effects.
+func (q *JobQueue) Delete(ctx context.Context, id string) error {
+	_, err := q.Ref(id).Delete(ctx)
+	return err
+}
+
+// ErrJobNotFound is returned by Get for unknown IDs.
+var ErrJobNotFound = errors.New("job not found")
+
+// Get loads job id.
+func (q *JobQueue) Get(ctx context.Context, id string) (*Job, error) {
+	snap, err := q.Ref(id).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, ErrJobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var job Job
+	if err := snap.DataTo(&job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// Start runs jobs until ctx is done, picking up jobs left queued or abandoned by earlier runs.
+func (q *JobQueue) Start(ctx context.Context) {
+	slots := make(chan struct{}, q.workers)
+	go func() {
+		ticker := time.NewTicker(q.pollInterval)
+		defer ticker.Stop()
+		for {
+			q.dispatch(ctx, slots)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			case <-q.wake:
+			}
+		}
+	}()
+}
+
+// dispatch claims due jobs, oldest first, while workers are free.
+func (q *JobQueue) dispatch(ctx context.Context, slots chan struct{}) {
+	if len(slots) == cap(slots) {
+		return
+	}
+	due, err := q.dueJobs(ctx, cap(slots)-len(slots))
+	if err != nil {
+		log.Printf("Failed to load jobs: %v", err)
+		return
+	}
+	for _, ref := range due {
+		select {
+		case slots <- struct{}{}:
+		default:
+			return
+		}
+		job, err := q.claim(ctx, ref)
+		if job == nil {
+			if err != nil {
+				log.Printf("Failed to claim job %s: %v", ref.ID, err)
+			}
+			<-slots
+			continue
+		}
+		go func() {
+			defer func() { <-slots }()
+			q.run(ctx, job)
+			q.Notify() // a slot is free again
+		}()
+	}
+}
+
+// dueJobs lists up to n queued jobs whose time has come and running jobs whose lease ran out (their worker
+// died), oldest first. Both queries are served by the indexes in JobIndexes, so a long history of finished
+// or retrying jobs is never read.
+func (q *JobQueue) dueJobs(ctx context.Context, n int) ([]*firestore.DocumentRef, error) {
+	now := time.Now()
+	jobs := q.firestoreClient.Collection(jobsCollection)
+	queries := []firestore.Query{
+		jobs.Where("status", "==", JobQueued).Where("runAt", "<=", now).OrderBy("runAt", firestore.Asc).Limit(n),
+		jobs.Where("status", "==", JobRunning).Where("leaseUntil", "<", now).OrderBy("leaseUntil", firestore.Asc).Limit(n),
+	}
+
+	type candidate struct {
+		ref   *firestore.DocumentRef
+		runAt time.Time
+	}
+	var due []candidate
+	for _, query := range queries {
+		docs, err := query.Documents(ctx).GetAll()
+		if err != nil {
+			return nil, err
+		}
+		for _, doc := range docs {
+			var job Job
+			if err := doc.DataTo(&job); err != nil {
+				continue
+			}
+			due = append(due, candidate{doc.Ref, job.RunAt})
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].runAt.Before(due[j].runAt) })
+	if len(due) > n {
+		due = due[:n]
+	}
+
+	refs := make([]*firestore.DocumentRef, len(due))
+	for i, c := range due {
+		refs[i] = c.ref
+	}
+	return refs, nil
+}
+
+// JobIndexes lists the composite indexes dueJobs needs, in the firestore.indexes.json format.
+func JobIndexes() []services.FirestoreIndex {
+	var indexes []services.FirestoreIndex
+	for _, field := range []string{"runAt", "leaseUntil"} {
+		indexes = append(indexes, services.FirestoreIndex{
+			CollectionGroup: jobsCollection,
+			QueryScope:      "COLLECTION",
+			Fields: []services.FirestoreIndexField{
+				{FieldPath: "status", Order: "ASCENDING"},
+				{FieldPath: field, Order: "ASCENDING"},
+			},
+		})
+	}
+	return indexes
+}
+
+// claim leases the job to this instance. It returns nil without an error when another instance was faster.
+func (q *JobQueue) claim(ctx context.Context, ref *firestore.DocumentRef) (*Job, error) {
+	var claimed *Job
+	err := q.firestoreClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		claimed = nil
+		snap, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		var job Job
+		if err := snap.DataTo(&job); err != nil {
+			return err
+		}
+		now := time.Now()
+		available := (job.Status == JobQueued && !job.RunAt.After(now)) || (job.Status == JobRunning && job.LeaseUntil.Before(now))
+		if !available {
+			return nil
+		}
+		job.Status = JobRunning
+		job.Attempts++
+		job.LeaseUntil = now.Add(q.lease)
+		job.UpdatedAt = now
+		claimed = &job
+		return tx.Set(ref, &job)
+	})
+	return claimed, err
+}
+
+func (q *JobQueue) run(ctx context.Context, job *Job) {
+	ref := q.Ref(job.ID)
+	handler := q.handlers[job.Type]
+	var err error
+	if handler == nil {
+		err = fmt.Errorf("no handler for job type %q", job.Type)
+		job.Attempts = job.MaxAttempts // retrying cannot help
+	} else {
+		progress := func(stage string, progress float64) {
+			job.Stage, job.Progress = stage, progress
+			_, err := ref.Update(ctx, []firestore.Update{
+				{Path: "stage", Value: stage},
+				{Path: "progress", Value: progress},
+				{Path: "leaseUntil", Value: time.Now().Add(q.lease)},
+				{Path: "updatedAt", Value: time.Now()},
+			})
+			if err != nil {
+				log.Printf("Failed to record progress of job %s: %v", job.ID, err)
+			}
+		}
+		started := time.Now()
+		err = handler(ctx, job, progress)
+		if err == nil {
+			log.Printf("Job %s (%s) succeeded in %s", job.ID, job.Type, time.Since(started).Round(time.Millisecond))
+		}
+	}
+
+	now := time.Now()
+	updates := []firestore.Update{{Path: "updatedAt", Value: now}}
+	switch {
+	case err == nil:
+		job.Status, job.Stage, job.Progress, job.Error, job.FinishedAt = JobSucceeded, "done", 1, "", now
+		updates = append(updates,
+			firestore.Update{Path: "progress", Value: 1.0},
+			firestore.Update{Path: "stage", Value: job.Stage},
+			firestore.Update{Path: "error", Value: ""},
+			firestore.Update{Path: "finishedAt", Value: now})
+	case job.Attempts >= job.MaxAttempts:
+		log.Printf("Job %s (%s) failed for good after %d attempts: %v", job.ID, job.Type, job.Attempts, err)
+		job.Status, job.Error, job.FinishedAt = JobFailed, err.Error(), now
+		updates = append(updates,
+			firestore.Update{Path: "error", Value: job.Error},
+			firestore.Update{Path: "finishedAt", Value: now})
+	default:
+		delay := retryDelay(job.Attempts)
+		log.Printf("Job %s (%s) attempt %d failed, retrying in %s: %v", job.ID, job.Type, job.Attempts, delay, err)
+		job.Status, job.Error, job.RunAt = JobQueued, err.Error(), now.Add(delay)
+		updates = append(updates,
+			firestore.Update{Path: "error", Value: job.Error},
+			firestore.Update{Path: "runAt", Value: job.RunAt})
+	}
+	updates = append(updates, firestore.Update{Path: "status", Value: job.Status})
+	if _, err := ref.Update(ctx, updates); status.Code(err) == codes.NotFound {
+		log.Printf("Job %s (%s) was deleted while it ran", job.ID, job.Type)
+		return
+	} else if err != nil {
+		// The lease runs out and the job is run again
+		log.Printf("Failed to record outcome of job %s: %v", job.ID, err)
+		return
+	}
+
+	if job.Finished() && q.OnFinish != nil {
+		q.OnFinish(ctx, job)
+	}
+}
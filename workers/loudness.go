@@ -0,0 +1,200 @@
+package workers
+
+import (
+	"context"
+	"fmt"
+	"lipur_backend/models"
+	"lipur_backend/services"
+	"log"
+	"math"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/firestore"
+)
+
+// ReplayGainReference is the loudness ReplayGain 2.0 normalizes to, in LUFS.
+const ReplayGainReference = -18.0
+
+// Floors for silent input, which ffmpeg reports as -70 LUFS and -inf dBTP (Firestore and JSON have no -inf).
+const (
+	silentLoudness = -70.0
+	silentPeak     = -120.0
+)
+
+var (
+	ebur128Integrated = regexp.MustCompile(`I:\s+(-?[\d.]+|-inf)\s+LUFS`)
+	ebur128Range      = regexp.MustCompile(`LRA:\s+(-?[\d.]+)\s+LU\b`)
+	ebur128Peak       = regexp.MustCompile(`Peak:\s+(-?[\d.]+|-inf)\s+dBFS`)
+)
+
+// LoudnessAnalyzer measures songs with ffmpeg's ebur128 filter and stores the loudness and ReplayGain values
+// players need to normalize volume: loudness {integrated, range, truePeak} and replayGain {trackGain, trackPeak,
+// albumGain, albumPeak} on the song document. Gains are in dB relative to ReplayGainReference, peaks are linear.
+type LoudnessAnalyzer struct {
+	firestoreClient *firestore.Client
+	ffmpegPath      string
+}
+
+// NewLoudnessAnalyzer uses the ffmpeg from FFMPEG_PATH; without it, songs are not analyzed.
+func NewLoudnessAnalyzer(firestoreClient *firestore.Client) *LoudnessAnalyzer {
+	ffmpegPath, err := services.FFmpegPath()
+	if err != nil {
+		log.Printf("ffmpeg not found (%v), loudness analysis disabled", err)
+		ffmpegPath = ""
+	}
+	return &LoudnessAnalyzer{firestoreClient: firestoreClient, ffmpegPath: ffmpegPath}
+}
+
+// Enabled reports whether ffmpeg is available.
+func (a *LoudnessAnalyzer) Enabled() bool {
+	return a != nil && a.ffmpegPath != ""
+}
+
+// Analyze is the loudness step of song processing. Singles get album gain equal to track gain; album tracks get
+// the album's values once every track of the album is measured.
+func (a *LoudnessAnalyzer) Analyze(ctx context.Context, song *songSource) error {
+	if !a.Enabled() {
+		return nil
+	}
+	if song.Song.Loudness != nil {
+		return nil
+	}
+
+	input, err := song.Input(ctx)
+	if err != nil {
+		return err
+	}
+	loudness, err := a.measure(ctx, input)
+	if err != nil {
+		return err
+	}
+
+	trackGain, trackPeak := replayGain(loudness.Integrated), linearPeak(loudness.TruePeak)
+	_, err = song.Ref.Update(ctx, []firestore.Update{
+		{Path: "loudness", Value: loudness},
+		{Path: "replayGain", Value: &models.ReplayGain{
+			TrackGain: trackGain,
+			TrackPeak: trackPeak,
+			AlbumGain: trackGain,
+			AlbumPeak: trackPeak,
+		}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save loudness: %w", err)
+	}
+
+	if song.Song.AlbumID != "" {
+		if err := a.updateAlbumGain(ctx, song.Song.AlbumID); err != nil {
+			return fmt.Errorf("album gain: %w", err)
+		}
+	}
+	return nil
+}
+
+func (a *LoudnessAnalyzer) measure(ctx context.Context, input string) (*models.Loudness, error) {
+	// The summary is logged at info level after the last frame; per-frame logging is turned off
+	cmd := exec.CommandContext(ctx, a.ffmpegPath,
+		"-hide_banner", "-nostats", "-loglevel", "info",
+		"-i", input,
+		"-vn", "-af", "ebur128=peak=true:framelog=quiet",
+		"-f", "null", "-",
+	)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg: %v: %s", err, lastLines(string(output), 3))
+	}
+	return parseEBUR128(string(output))
+}
+
+// parseEBUR128 reads the summary the ebur128 filter prints at the end of its output.
+func parseEBUR128(output string) (*models.Loudness, error) {
+	value := func(re *regexp.Regexp, floor float64) (float64, bool) {
+		matches := re.FindAllStringSubmatch(output, -1)
+		if matches == nil {
+			return 0, false
+		}
+		last := matches[len(matches)-1][1]
+		if last == "-inf" {
+			return floor, true
+		}
+		v, err := strconv.ParseFloat(last, 64)
+		return max(v, floor), err == nil
+	}
+	integrated, ok1 := value(ebur128Integrated, silentLoudness)
+	lra, ok2 := value(ebur128Range, 0)
+	peak, ok3 := value(ebur128Peak, silentPeak)
+	if !ok1 || !ok2 || !ok3 {
+		return nil, fmt.Errorf("no loudness summary in ffmpeg output: %s", lastLines(output, 3))
+	}
+	return &models.Loudness{Integrated: integrated, Range: lra, TruePeak: peak}, nil
+}
+
+// updateAlbumGain sets the album gain and peak on every track once all tracks are measured. The album loudness
+// is the duration-weighted energy mean of the track loudnesses, the album peak the highest track peak.
+func (a *LoudnessAnalyzer) updateAlbumGain(ctx context.Context, albumId string) error {
+	tracks, err := a.firestoreClient.Collection("songs").Where("albumId", "==", albumId).Documents(ctx).GetAll()
+	if err != nil {
+		return err
+	}
+
+	var energy, totalDuration, peak float64
+	peak = silentPeak
+	for _, track := range tracks {
+		var song models.Song
+		if err := track.DataTo(&song); err != nil {
+			return err
+		}
+		if song.Loudness == nil {
+			return nil // the last track to finish does it
+		}
+		duration := song.Duration
+		if duration <= 0 {
+			duration = 1
+		}
+		energy += duration * math.Pow(10, song.Loudness.Integrated/10)
+		totalDuration += duration
+		peak = max(peak, song.Loudness.TruePeak)
+	}
+	if totalDuration == 0 {
+		return nil
+	}
+	albumLoudness := 10 * math.Log10(energy/totalDuration)
+	albumGain, albumPeak := replayGain(albumLoudness), linearPeak(peak)
+
+	batch := a.firestoreClient.Batch()
+	for _, track := range tracks {
+		batch.Update(track.Ref, []firestore.Update{
+			{Path: "replayGain.albumGain", Value: albumGain},
+			{Path: "replayGain.albumPeak", Value: albumPeak},
+		})
+	}
+	batch.Update(a.firestoreClient.Collection("albums").Doc(albumId), []firestore.Update{
+		{Path: "loudness", Value: &models.Loudness{Integrated: round(albumLoudness, 2), TruePeak: peak}},
+		{Path: "replayGain", Value: &models.AlbumReplayGain{AlbumGain: albumGain, AlbumPeak: albumPeak}},
+	})
+	_, err = batch.Commit(ctx)
+	return err
+}
+
+// replayGain is the gain in dB that brings loudness to ReplayGainReference.
+func replayGain(loudness float64) float64 {
+	return round(ReplayGainReference-loudness, 2)
+}
+
+// linearPeak converts a true peak in dBTP to the linear sample scale ReplayGain peaks use.
+func linearPeak(dbtp float64) float64 {
+	return round(math.Pow(10, dbtp/20), 6)
+}
+
+func round(v float64, decimals int) float64 {
+	scale := math.Pow(10, float64(decimals))
+	return math.Round(v*scale) / scale
+}
+
+func lastLines(s string, n int) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return strings.Join(lines[max(0, len(lines)-n):], "\n")
+}
@@ -0,0 +1,222 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"lipur_backend/models"
+	"lipur_backend/services"
+	"log"
+	"os"
+	"path/filepath"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Song status values stored in the song document's status field.
+const (
+	SongProcessing = "processing"
+	SongReady      = "ready"
+	SongFailed     = "failed"
+)
+
+// JobProcessSong runs every processing step for one song after its upload.
+const JobProcessSong = "processSong"
+
+// songStep is one stage of song processing. A retry runs all steps again, so each one skips work whose
+// result is already recorded on the song.
+type songStep struct {
+	Name string
+	Run  func(ctx context.Context, song *songSource) error
+}
+
+// errSongDeleted ends the processing of a song that was deleted while its job ran.
+var errSongDeleted = errors.New("song was deleted")
+
+// songSource is the song a processing job works on, as it was when the job started. The original audio is
+// fetched on first use and shared by all steps.
+type songSource struct {
+	Ref             *firestore.DocumentRef
+	Song            *models.Song
+	storage         services.Storage
+	firestoreClient *firestore.Client
+	workDir         string
+	input           string
+}
+
+// Input returns the path of a local copy of the original audio, downloading it the first time.
+func (s *songSource) Input(ctx context.Context) (string, error) {
+	if s.input != "" {
+		return s.input, nil
+	}
+	fileName := s.Song.FileName
+	if fileName == "" {
+		return "", fmt.Errorf("song has no fileName")
+	}
+
+	// ffmpeg needs a seekable input for some containers, so fetch the original to disk first
+	input := filepath.Join(s.workDir, "original"+filepath.Ext(fileName))
+	body, err := s.storage.ReadRange(ctx, fileName, 0, -1)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch original: %w", err)
+	}
+	defer body.Close()
+	f, err := os.Create(input)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(f, body); err != nil {
+		f.Close()
+		return "", fmt.Errorf("failed to fetch original: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	s.input = input
+	return input, nil
+}
+
+// Upload stores an object derived from the song, unless the song has been deleted (or its deletion started)
+// since the job began: DeleteSong removes everything under the song's prefix, and an upload landing afterwards
+// would never be cleaned up.
+func (s *songSource) Upload(ctx context.Context, key string, body io.Reader, size int64, contentType string) (*services.FileInfo, error) {
+	docs, err := s.firestoreClient.GetAll(ctx, []*firestore.DocumentRef{
+		s.Ref,
+		s.firestoreClient.Collection("songDeletions").Doc(s.Ref.ID),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !docs[0].Exists() || docs[1].Exists() {
+		return nil, errSongDeleted
+	}
+	return s.storage.UploadFile(ctx, key, body, size, contentType)
+}
+
+// SongProcessor does the slow part of an upload in the background: the song document is written with status
+// "processing" together with a processSong job, and the job moves it to "ready" or "failed".
+type SongProcessor struct {
+	queue           *JobQueue
+	storage         services.Storage
+	firestoreClient *firestore.Client
+	hls             *HLSWorker
+	steps           []songStep
+}
+
+// NewSongProcessor registers the processSong handler on queue.
+func NewSongProcessor(queue *JobQueue, storage services.Storage, firestoreClient *firestore.Client, hls *HLSWorker, loudness *LoudnessAnalyzer, waveform *WaveformGenerator) *SongProcessor {
+	p := &SongProcessor{queue: queue, storage: storage, firestoreClient: firestoreClient, hls: hls}
+	p.steps = []songStep{
+		{"loudness", loudness.Analyze},
+		{"waveform", waveform.Generate},
+		{"hls", hls.Package},
+	}
+	queue.Handle(JobProcessSong, p.process)
+	queue.OnFinish = p.finish
+	return p
+}
+
+// HLSEnabled reports whether songs get an HLS rendition, i.e. whether new songs start with hlsStatus "pending".
+func (p *SongProcessor) HLSEnabled() bool {
+	return p.hls.Enabled()
+}
+
+// Schedule adds a processSong job for songId to batch, next to the song document, and returns it.
+// Call Notify once the batch is committed.
+func (p *SongProcessor) Schedule(batch *firestore.WriteBatch, songId string) *Job {
+	job := p.queue.NewJob(JobProcessSong, songId)
+	p.queue.Add(batch, job)
+	return job
+}
+
+// Notify wakes the worker pool for newly scheduled songs.
+func (p *SongProcessor) Notify() {
+	p.queue.Notify()
+}
+
+func (p *SongProcessor) process(ctx context.Context, job *Job, progress ProgressFunc) error {
+	songDoc, err := p.firestoreClient.Collection("songs").Doc(job.SongID).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		log.Printf("Song %s was deleted before processing", job.SongID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	workDir, err := os.MkdirTemp("", "song-"+job.SongID+"-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(workDir)
+	song := &songSource{Ref: songDoc.Ref, Song: &models.Song{}, storage: p.storage, firestoreClient: p.firestoreClient, workDir: workDir}
+	if err := songDoc.DataTo(song.Song); err != nil {
+		return fmt.Errorf("failed to read song: %w", err)
+	}
+
+	for i, step := range p.steps {
+		progress(step.Name, float64(i)/float64(len(p.steps)))
+		err := step.Run(ctx, song)
+		if errors.Is(err, errSongDeleted) {
+			log.Printf("Song %s was deleted during processing", job.SongID)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", step.Name, err)
+		}
+	}
+	return nil
+}
+
+func (p *SongProcessor) finish(ctx context.Context, job *Job) {
+	if job.Type != JobProcessSong {
+		return
+	}
+	songStatus := SongReady
+	if job.Status == JobFailed {
+		songStatus = SongFailed
+	}
+	_, err := p.firestoreClient.Collection("songs").Doc(job.SongID).Update(ctx, []firestore.Update{
+		{Path: "status", Value: songStatus},
+		{Path: "processingError", Value: job.Error},
+	})
+	if err != nil && status.Code(err) != codes.NotFound {
+		log.Printf("Failed to set status of song %s: %v", job.SongID, err)
+	}
+}
+
+// Backfill schedules songs uploaded before the job queue existed that still wait for HLS packaging.
+func (p *SongProcessor) Backfill(ctx context.Context) {
+	if !p.hls.Enabled() {
+		return
+	}
+	docs, err := p.firestoreClient.Collection("songs").Where("hlsStatus", "==", HLSPending).Documents(ctx).GetAll()
+	if err != nil {
+		log.Printf("Failed to load songs pending HLS: %v", err)
+		return
+	}
+	for _, doc := range docs {
+		var song models.Song
+		if err := doc.DataTo(&song); err != nil {
+			log.Printf("Skipping song %s: %v", doc.Ref.ID, err)
+			continue
+		}
+		if song.JobID != "" {
+			continue
+		}
+		job := p.queue.NewJob(JobProcessSong, doc.Ref.ID)
+		batch := p.firestoreClient.Batch()
+		p.queue.Add(batch, job)
+		batch.Update(doc.Ref, []firestore.Update{
+			{Path: "jobId", Value: job.ID},
+			{Path: "status", Value: SongProcessing},
+		})
+		if _, err := batch.Commit(ctx); err != nil {
+			log.Printf("Failed to schedule song %s: %v", doc.Ref.ID, err)
+		}
+	}
+	p.queue.Notify()
+}
@@ -0,0 +1,139 @@
+package workers
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"lipur_backend/audio"
+	"lipur_backend/models"
+	"lipur_backend/services"
+	"log"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/firestore"
+)
+
+const (
+	// Audio is decoded at this rate for peaks, which is plenty for a seek bar
+	waveformSampleRate = 22050
+
+	// The finest resolution computed; the stored resolutions are merged from it
+	waveformBaseSamplesPerPixel = 32
+)
+
+// WaveformGenerator stores the peaks of every song at each of services.WaveformResolutions, in audiowaveform's
+// JSON and binary formats, and records what is available in the song's waveform field.
+type WaveformGenerator struct {
+	storage    services.Storage
+	ffmpegPath string
+}
+
+// NewWaveformGenerator uses the ffmpeg from FFMPEG_PATH; without it, songs get no waveform.
+func NewWaveformGenerator(storage services.Storage) *WaveformGenerator {
+	ffmpegPath, err := services.FFmpegPath()
+	if err != nil {
+		log.Printf("ffmpeg not found (%v), waveform generation disabled", err)
+		ffmpegPath = ""
+	}
+	return &WaveformGenerator{storage: storage, ffmpegPath: ffmpegPath}
+}
+
+// Enabled reports whether ffmpeg is available.
+func (g *WaveformGenerator) Enabled() bool {
+	return g != nil && g.ffmpegPath != ""
+}
+
+// Generate is the waveform step of song processing.
+func (g *WaveformGenerator) Generate(ctx context.Context, song *songSource) error {
+	if !g.Enabled() {
+		return nil
+	}
+	if song.Song.Waveform != nil {
+		return nil
+	}
+
+	input, err := song.Input(ctx)
+	if err != nil {
+		return err
+	}
+	base, err := g.peaks(ctx, input)
+	if err != nil {
+		return err
+	}
+
+	waveform := &models.Waveform{SampleRate: waveformSampleRate, Resolutions: map[string]models.WaveformResolution{}}
+	for _, resolution := range services.WaveformResolutions {
+		peaks := base.Downsample(resolution.Points)
+		jsonData, err := peaks.MarshalJSON()
+		if err != nil {
+			return err
+		}
+		files := map[string][]byte{"json": jsonData, "dat": peaks.MarshalDat()}
+		for format, data := range files {
+			key := services.SongWaveformKey(song.Ref.ID, resolution.Name, format)
+			_, err := song.Upload(ctx, key, bytes.NewReader(data), int64(len(data)), services.WaveformFormats[format])
+			if err != nil {
+				return fmt.Errorf("failed to upload %s: %w", key, err)
+			}
+		}
+		waveform.Resolutions[resolution.Name] = models.WaveformResolution{
+			Points:          peaks.Points(),
+			SamplesPerPixel: peaks.SamplesPerPixel,
+		}
+	}
+
+	_, err = song.Ref.Update(ctx, []firestore.Update{
+		{Path: "waveform", Value: waveform},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save waveform: %w", err)
+	}
+	return nil
+}
+
+// peaks streams the decoded audio through a PeakBuilder, so long mixes never sit in memory as samples.
+func (g *WaveformGenerator) peaks(ctx context.Context, input string) (*audio.Waveform, error) {
+	cmd := exec.CommandContext(ctx, g.ffmpegPath,
+		"-hide_banner", "-loglevel", "error",
+		"-i", input,
+		"-vn", "-ac", "1", "-ar", strconv.Itoa(waveformSampleRate),
+		"-f", "s16le", "-",
+	)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	builder := audio.NewPeakBuilder(waveformSampleRate, waveformBaseSamplesPerPixel)
+	buf := make([]byte, 64<<10)
+	samples := make([]int16, len(buf)/2)
+	for {
+		n, err := io.ReadFull(stdout, buf)
+		count := n / 2
+		for i := 0; i < count; i++ {
+			samples[i] = int16(binary.LittleEndian.Uint16(buf[2*i:]))
+		}
+		builder.Add(samples[:count])
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			cmd.Wait()
+			return nil, err
+		}
+	}
+	if err := cmd.Wait(); err != nil {
+		return nil, fmt.Errorf("ffmpeg: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return builder.Waveform(), nil
+}